@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+)
+
+// The admin token is read from the environment so it stays out of process listings
+const adminTokenEnv = "MESITIS_ADMIN_TOKEN"
+
+// adminRequest calls an admin endpoint of a running broker, presenting the
+// token in MESITIS_ADMIN_TOKEN
+func adminRequest(method, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
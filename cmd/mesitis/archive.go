@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/jonahbenton/mesitis/pkg/controller"
+)
+
+// The passphrase is read from the environment so it stays out of process listings
+const archivePassphraseEnv = "MESITIS_ARCHIVE_PASSPHRASE"
+
+// exportCommand dumps broker state either from a running broker's admin
+// endpoint or directly from the storage described by STORAGE_* variables.
+// A running broker is the only way to reach MemStorage.
+func exportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "-", "file to write the archive to, - for stdout")
+	broker := fs.String("broker", "", "admin URL of a running broker to export from, ex http://localhost:8081")
+	encrypt := fs.Bool("encrypt", false, "encrypt the archive with the passphrase in "+archivePassphraseEnv)
+	fs.Parse(args)
+
+	passphrase, err := archivePassphrase(*encrypt)
+	if err != nil {
+		exitWith(err)
+	}
+
+	var archive *controller.Archive
+	if *broker != "" {
+		archive, err = fetchArchive(*broker)
+	} else {
+		archive, err = controller.ExportArchive(storageFromEnv())
+	}
+	if err != nil {
+		exitWith(err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			exitWith(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := controller.WriteArchive(w, archive, passphrase); err != nil {
+		exitWith(err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d records\n", len(archive.Records))
+}
+
+func importCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "-", "file to read the archive from, - for stdin")
+	broker := fs.String("broker", "", "admin URL of a running broker to import into")
+	decrypt := fs.Bool("decrypt", false, "decrypt the archive with the passphrase in "+archivePassphraseEnv)
+	overwrite := fs.Bool("overwrite", false, "replace records that already exist")
+	fs.Parse(args)
+
+	passphrase, err := archivePassphrase(*decrypt)
+	if err != nil {
+		exitWith(err)
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			exitWith(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	archive, err := controller.ReadArchive(r, passphrase)
+	if err != nil {
+		exitWith(err)
+	}
+
+	var written int
+	if *broker != "" {
+		written, err = pushArchive(*broker, archive, *overwrite)
+	} else {
+		written, err = controller.ImportArchive(storageFromEnv(), archive, *overwrite)
+	}
+	if err != nil {
+		exitWith(err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d of %d records\n", written, len(archive.Records))
+}
+
+func archivePassphrase(required bool) (string, error) {
+	if !required {
+		return "", nil
+	}
+	passphrase := os.Getenv(archivePassphraseEnv)
+	if passphrase == "" {
+		return "", fmt.Errorf("%s must be set", archivePassphraseEnv)
+	}
+	return passphrase, nil
+}
+
+func fetchArchive(broker string) (*controller.Archive, error) {
+	resp, err := adminRequest("GET", broker+"/admin/export", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Export from %s failed: %s", broker, resp.Status)
+	}
+
+	var archive controller.Archive
+	if err := json.NewDecoder(resp.Body).Decode(&archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+func pushArchive(broker string, archive *controller.Archive, overwrite bool) (int, error) {
+	body, err := json.Marshal(archive)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := adminRequest("POST", fmt.Sprintf("%s/admin/import?overwrite=%t", broker, overwrite), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Import into %s failed: %s", broker, resp.Status)
+	}
+
+	var result map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result["imported"], nil
+}
+
+func exitWith(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jonahbenton/mesitis/pkg/controller"
+	"k8s.io/api/core/v1"
+)
+
+// lintCommand validates catalog entries and wrapped resources, either from
+// manifests in a directory, as CI would see them before applying, or from
+// the ConfigMaps already in a namespace. Exits non-zero on errors.
+func lintCommand(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "fail on warnings as well as errors")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mesitis lint [-strict] <dir|namespace>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target := fs.Arg(0)
+
+	var items []v1.ConfigMap
+	var err error
+	if info, statErr := os.Stat(target); statErr == nil && info.IsDir() {
+		items, err = configMapsFromDir(target)
+	} else {
+		items, err = configMapsFromNamespace(target)
+	}
+	if err != nil {
+		exitWith(err)
+	}
+
+	errs := controller.LintConfigMaps(items)
+	for _, e := range errs {
+		fmt.Printf("%s: %s\n", e.Severity, e)
+	}
+
+	if errs.HasErrors() || (*strict && len(errs) > 0) {
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Checked %d ConfigMaps, %d problems\n", len(items), len(errs))
+}
+
+func configMapsFromDir(dir string) ([]v1.ConfigMap, error) {
+	items := make([]v1.ConfigMap, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		found, err := controller.ReadConfigMapManifests(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		items = append(items, found...)
+		return nil
+	})
+	return items, err
+}
+
+func configMapsFromNamespace(namespace string) ([]v1.ConfigMap, error) {
+	kube, err := controller.NewRealKube(namespace, os.TempDir())
+	if err != nil {
+		return nil, err
+	}
+	list, err := kube.ListConfigMaps(namespace, "mesitis/kind")
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
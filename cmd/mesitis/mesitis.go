@@ -8,7 +8,9 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,14 +23,31 @@ import (
 func init() {
 	//	flag.StringVar(&options.TLSCert, "tlsCert", "", "base-64 encoded PEM block to use as the certificate for TLS. If '--tlsCert' is used, then '--tlsKey' must also be used. If '--tlsCert' is not used, then TLS will not be used.")
 	//	flag.StringVar(&options.TLSKey, "tlsKey", "", "base-64 encoded PEM block to use as the private key matching the TLS certificate. If '--tlsKey' is used, then '--tlsCert' must also be used")
-	flag.Parse()
 }
 
 func main() {
+	// parsed here rather than in init, where go test has not yet defined its flags
+	flag.Parse()
 	// TODO differentiate between command line run, print to stdout, and glog
-	if flag.Arg(0) == "version" {
+	switch flag.Arg(0) {
+	case "version":
 		fmt.Printf("%s/%s\n", path.Base(os.Args[0]), pkg.VERSION)
 		return
+	case "export":
+		exportCommand(flag.Args()[1:])
+		return
+	case "import":
+		importCommand(flag.Args()[1:])
+		return
+	case "lint":
+		lintCommand(flag.Args()[1:])
+		return
+	case "plan":
+		planCommand(flag.Args()[1:])
+		return
+	case "rollout":
+		rolloutCommand(flag.Args()[1:])
+		return
 	}
 	//	if (options.TLSCert != "" || options.TLSKey != "") &&
 	//		(options.TLSCert == "" || options.TLSKey == "") {
@@ -36,32 +55,43 @@ func main() {
 	//		return
 	//	}
 
-	// TODO make a config object for redis
 	storageType := getEnv("STORAGE_TYPE", "memory")
-	var storage controller.Storage
-
-	switch storageType {
-	case "memory":
-		storage = controller.NewMemStorage()
-	case "redis":
-		db := getEnv("STORAGE_REDIS_DATABASE", "0")
-		database, err := strconv.Atoi(db)
-		if err != nil {
-			glog.Fatalf("Invalid STORAGE_REDIS_DATABASE: %s", err)
-		}
-		address := getEnv("STORAGE_REDIS_ADDRESS", "UNKNOWN")
-		password := getEnv("STORAGE_REDIS_PASSWORD", "")
-		storage = controller.NewRedisStorage(address, password, database)
-
-	default:
-		glog.Fatalf("Invalid STORAGE_TYPE: %s", storageType)
-	}
+	storage := storageFromEnv()
 
 	name := getEnv("POD_NAME", "UNKNOWN")
 	namespace := getEnv("POD_NAMESPACE", "UNKNOWN")
 	tmpdir := getEnv("TMPDIR", "/unknown")
 
-	c := controller.CreateProductionController(name, namespace, storage, tmpdir)
+	c, err := controller.CreateProductionController(controller.ControllerOptions{
+		BrokerName:        name,
+		BrokerNamespace:   namespace,
+		Tmpdir:            tmpdir,
+		ServiceBrokerName: getEnv("SERVICE_BROKER_NAME", ""),
+		CatalogSources:    catalogSourcesFromEnv(tmpdir),
+		Quota: controller.Quota{
+			InstancesPerNamespace: getEnvInt("QUOTA_INSTANCES_PER_NAMESPACE", "0"),
+			Instances:             getEnvInt("QUOTA_INSTANCES", "0"),
+			BindingsPerInstance:   getEnvInt("QUOTA_BINDINGS_PER_INSTANCE", "0"),
+		},
+		Sweeper: controller.SweeperOptions{
+			Interval: getEnvDuration("SWEEP_INTERVAL", "10m"),
+			Delete:   getEnvBool("SWEEP_DELETE", "false"),
+			Grace:    getEnvDuration("SWEEP_GRACE", "24h"),
+		},
+		Reconciler: controller.ReconcilerOptions{
+			Interval: getEnvDuration("RECONCILE_INTERVAL", "5m"),
+		},
+		Expirer: controller.ExpirerOptions{
+			Interval:  getEnvDuration("EXPIRE_INTERVAL", "1m"),
+			Retention: getEnvDuration("EXPIRED_RETENTION", "168h"),
+		},
+		Hooks: controller.HookOptions{
+			Timeout: getEnvDuration("HOOK_TIMEOUT", "1m"),
+		},
+	}, storage)
+	if err != nil {
+		glog.Fatalf("Failed to create controller: %s", err)
+	}
 
 	w := controller.CreateHTTPWrapper(c)
 
@@ -84,6 +114,12 @@ func main() {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	cancelOnInterrupt(ctx, cancelFunc)
 
+	go func() {
+		if err := c.Run(ctx.Done()); err != nil {
+			glog.Fatalf("Controller failed: %s", err)
+		}
+	}()
+
 	go func() {
 		<-ctx.Done()
 		c, cancel := context.WithTimeout(context.Background(), time.Duration(gracefulSeconds)*time.Second)
@@ -92,6 +128,28 @@ func main() {
 			server.Close()
 		}
 	}()
+
+	// the admin endpoints are off unless given a listener of their own
+	if adminListenOn := getEnv("ADMIN_LISTEN_ON", ""); adminListenOn != "" {
+		adminToken := getEnv("ADMIN_TOKEN", "")
+		if adminToken == "" {
+			glog.Fatalf("ADMIN_TOKEN must be set to use ADMIN_LISTEN_ON")
+		}
+		glog.Infof("Serving admin endpoints on %s\n", adminListenOn)
+		adminServer := &http.Server{
+			Addr:    adminListenOn,
+			Handler: controller.CreateAdminHTTPWrapper(c, adminToken),
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Fatalf("Admin server failed: %s", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			adminServer.Close()
+		}()
+	}
 	err = server.ListenAndServe()
 
 	if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
@@ -114,6 +172,97 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	}()
 }
 
+// storageFromEnv builds the Storage described by the STORAGE_* variables
+func storageFromEnv() controller.Storage {
+	storageType := getEnv("STORAGE_TYPE", "memory")
+	var storage controller.Storage
+
+	switch storageType {
+	case "memory":
+		storage = controller.NewMemStorage()
+	case "redis":
+		s, err := controller.NewRedisStorage(redisOptionsFromEnv())
+		if err != nil {
+			glog.Fatalf("Invalid redis configuration: %s", err)
+		}
+		storage = s
+
+	default:
+		glog.Fatalf("Invalid STORAGE_TYPE: %s", storageType)
+	}
+	return storage
+}
+
+// catalogSourcesFromEnv builds the catalog sources described by the
+// CATALOG_* variables, in the order of precedence given by CATALOG_SOURCES.
+// Sources named there but not configured are skipped.
+func catalogSourcesFromEnv(tmpdir string) []controller.CatalogSource {
+	names := getEnvList("CATALOG_SOURCES")
+	if len(names) == 0 {
+		names = []string{"namespace", "directory", "git", "url"}
+	}
+
+	sources := make([]controller.CatalogSource, 0)
+	for _, name := range names {
+		switch name {
+		case "namespace":
+			sources = append(sources, &controller.KubeCatalogSource{})
+		case "directory":
+			if directory := getEnv("CATALOG_DIRECTORY", ""); directory != "" {
+				sources = append(sources, controller.NewDirectoryCatalogSource(
+					directory,
+					getEnvDuration("CATALOG_DIRECTORY_INTERVAL", "30s"),
+				))
+			}
+		case "git":
+			if repository := getEnv("CATALOG_GIT_REPOSITORY", ""); repository != "" {
+				sources = append(sources, controller.NewGitCatalogSource(
+					repository,
+					getEnv("CATALOG_GIT_REF", "master"),
+					getEnv("CATALOG_GIT_DIRECTORY", ""),
+					filepath.Join(tmpdir, "catalog-git"),
+					getEnvDuration("CATALOG_GIT_INTERVAL", "1m"),
+				))
+			}
+		case "url":
+			if url := getEnv("CATALOG_URL", ""); url != "" {
+				header := http.Header{}
+				if token := getEnv("CATALOG_URL_TOKEN", ""); token != "" {
+					header.Set("Authorization", "Bearer "+token)
+				}
+				sources = append(sources, controller.NewHTTPCatalogSource(
+					url,
+					header,
+					getEnvDuration("CATALOG_URL_INTERVAL", "1m"),
+				))
+			}
+		default:
+			glog.Fatalf("Invalid CATALOG_SOURCES: unknown source %s", name)
+		}
+	}
+	return sources
+}
+
+func redisOptionsFromEnv() *controller.RedisOptions {
+	return &controller.RedisOptions{
+		Address:               getEnv("STORAGE_REDIS_ADDRESS", "UNKNOWN"),
+		Password:              getEnv("STORAGE_REDIS_PASSWORD", ""),
+		Database:              getEnvInt("STORAGE_REDIS_DATABASE", "0"),
+		MasterName:            getEnv("STORAGE_REDIS_SENTINEL_MASTER", ""),
+		SentinelAddresses:     getEnvList("STORAGE_REDIS_SENTINEL_ADDRESSES"),
+		ClusterAddresses:      getEnvList("STORAGE_REDIS_CLUSTER_ADDRESSES"),
+		KeyPrefix:             getEnv("STORAGE_REDIS_KEY_PREFIX", ""),
+		TLS:                   getEnvBool("STORAGE_REDIS_TLS", "false"),
+		TLSCAFile:             getEnv("STORAGE_REDIS_TLS_CA_FILE", ""),
+		TLSServerName:         getEnv("STORAGE_REDIS_TLS_SERVER_NAME", ""),
+		TLSInsecureSkipVerify: getEnvBool("STORAGE_REDIS_TLS_INSECURE_SKIP_VERIFY", "false"),
+		DialTimeout:           getEnvDuration("STORAGE_REDIS_DIAL_TIMEOUT", "5s"),
+		ReadTimeout:           getEnvDuration("STORAGE_REDIS_READ_TIMEOUT", "3s"),
+		WriteTimeout:          getEnvDuration("STORAGE_REDIS_WRITE_TIMEOUT", "3s"),
+		MaxRetries:            getEnvInt("STORAGE_REDIS_MAX_RETRIES", "3"),
+	}
+}
+
 func getEnv(name string, def string) string {
 	var v string
 	if v = os.Getenv(name); v == "" {
@@ -121,3 +270,38 @@ func getEnv(name string, def string) string {
 	}
 	return v
 }
+
+func getEnvInt(name string, def string) int {
+	i, err := strconv.Atoi(getEnv(name, def))
+	if err != nil {
+		glog.Fatalf("Invalid %s: %s", name, err)
+	}
+	return i
+}
+
+func getEnvBool(name string, def string) bool {
+	b, err := strconv.ParseBool(getEnv(name, def))
+	if err != nil {
+		glog.Fatalf("Invalid %s: %s", name, err)
+	}
+	return b
+}
+
+func getEnvDuration(name string, def string) time.Duration {
+	d, err := time.ParseDuration(getEnv(name, def))
+	if err != nil {
+		glog.Fatalf("Invalid %s: %s", name, err)
+	}
+	return d
+}
+
+// comma separated, empty entries dropped
+func getEnvList(name string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(getEnv(name, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
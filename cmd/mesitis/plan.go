@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/jonahbenton/mesitis/pkg/controller"
+)
+
+// planCommand asks a running broker what provisioning an offering into a
+// namespace would do, without changing anything. Exits non-zero if the
+// provision would be refused.
+func planCommand(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	broker := fs.String("broker", "http://localhost:8081", "admin URL of the broker to plan with")
+	namespace := fs.String("namespace", "", "consumer namespace to provision into")
+	parameters := fs.String("parameters", "", "provision parameters, as a JSON object")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mesitis plan <offering> -namespace <consumer> [-parameters JSON] [-broker URL]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	// the offering may come before the flags
+	if fs.NArg() > 0 {
+		offering := fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+		args = append([]string{offering}, fs.Args()...)
+	} else {
+		args = fs.Args()
+	}
+	if len(args) != 1 || *namespace == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	req := controller.PlanRequest{Offering: args[0], Namespace: *namespace}
+	if *parameters != "" {
+		if err := json.Unmarshal([]byte(*parameters), &req.Parameters); err != nil {
+			exitWith(fmt.Errorf("Invalid parameters: %s", err))
+		}
+	}
+
+	plan, err := fetchPlan(*broker, &req)
+	if err != nil {
+		exitWith(err)
+	}
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		exitWith(err)
+	}
+	fmt.Println(string(out))
+
+	for _, p := range plan.Problems {
+		fmt.Fprintf(os.Stderr, "problem: %s\n", p)
+	}
+	if !plan.Allowed {
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Would create %d objects\n", len(plan.Objects))
+}
+
+func fetchPlan(broker string, req *controller.PlanRequest) (*controller.Plan, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := adminRequest("POST", broker+"/admin/plan", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Plan with %s failed: %s %s", broker, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var plan controller.Plan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
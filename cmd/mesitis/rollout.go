@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/jonahbenton/mesitis/pkg/controller"
+)
+
+// rolloutCommand asks a running broker to upgrade the instances of an
+// offering to its current version. Exits non-zero if any instance failed.
+func rolloutCommand(args []string) {
+	fs := flag.NewFlagSet("rollout", flag.ExitOnError)
+	broker := fs.String("broker", "http://localhost:8081", "admin URL of the broker to roll out with")
+	batch := fs.Int("batch", 0, "instances upgraded before checking for failures, 5 if zero")
+	dryRun := fs.Bool("dry-run", false, "list the instances to upgrade without upgrading them")
+	force := fs.Bool("force", false, "take over fields of the objects other field managers have changed")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mesitis rollout <offering> [-batch N] [-dry-run] [-force] [-broker URL]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	// the offering may come before the flags
+	if fs.NArg() > 0 {
+		offering := fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+		args = append([]string{offering}, fs.Args()...)
+	} else {
+		args = fs.Args()
+	}
+	if len(args) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	rollout, err := fetchRollout(*broker, &controller.RolloutRequest{Offering: args[0], BatchSize: *batch, DryRun: *dryRun, Force: *force})
+	if err != nil {
+		exitWith(err)
+	}
+	out, err := json.MarshalIndent(rollout, "", "  ")
+	if err != nil {
+		exitWith(err)
+	}
+	fmt.Println(string(out))
+
+	for _, f := range rollout.Failed {
+		fmt.Fprintf(os.Stderr, "failed: %s: %s\n", f.InstanceID, f.Error)
+	}
+	if len(rollout.Failed) > 0 {
+		os.Exit(1)
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "Would upgrade %d instances to version %s\n", len(rollout.Pending), rollout.Version)
+	} else {
+		fmt.Fprintf(os.Stderr, "Upgraded %d instances to version %s\n", len(rollout.Upgraded), rollout.Version)
+	}
+}
+
+func fetchRollout(broker string, req *controller.RolloutRequest) (*controller.Rollout, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := adminRequest("POST", broker+"/admin/rollout", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Rollout with %s failed: %s %s", broker, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var rollout controller.Rollout
+	if err := json.NewDecoder(resp.Body).Decode(&rollout); err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
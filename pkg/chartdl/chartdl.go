@@ -161,7 +161,7 @@ func untar(destdir string, srcpath string) (string, error) {
 			}
 
 		default:
-			return "", fmt.Errorf("Target %s has unknown type. %v, %v\n", target, header.Typeflag)
+			return "", fmt.Errorf("Target %s has unknown type %v", target, header.Typeflag)
 		}
 	}
 	// calculate tarroot
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/golang/glog"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Which consumer namespaces may provision and bind an entry. A namespace
+// is allowed when its name matches a whitelist pattern, or its labels match
+// the namespace selector, and it matches neither the deny list nor the deny
+// selector. Patterns are globs, ex team-*. Labels are read from the live
+// Namespace, only when the entry has a selector.
+
+// CheckAccess returns a BrokerError naming the rule that refuses the
+// namespace, or nil if it is allowed
+func (e *Entry) CheckAccess(kube Kube, namespace string) error {
+	if namespace == "" {
+		return forbidden("Service %s requires the consumer namespace.", e.serviceName())
+	}
+
+	var nsLabels labels.Set
+	if e.NamespaceSelector != "" || e.DenyNamespaceSelector != "" {
+		ns, err := kube.GetNamespace(namespace)
+		if k8serr.IsNotFound(err) {
+			return forbidden("Namespace %s does not exist.", namespace)
+		} else if err != nil {
+			glog.Errorf("Failed to read namespace %s to check access to %s: %s", namespace, e.serviceName(), err)
+			return err
+		}
+		nsLabels = labels.Set(ns.Labels)
+	}
+
+	if pattern, ok := matchPattern(e.Denylist, namespace); ok {
+		return forbidden("Namespace %s is denied service %s by pattern %s.", namespace, e.serviceName(), pattern)
+	}
+	if matched, err := matchSelector(e.DenyNamespaceSelector, nsLabels); err != nil {
+		return err
+	} else if matched {
+		return forbidden("Namespace %s is denied service %s by selector %s.", namespace, e.serviceName(), e.DenyNamespaceSelector)
+	}
+
+	if _, ok := matchPattern(e.Whitelist, namespace); ok {
+		return nil
+	}
+	if matched, err := matchSelector(e.NamespaceSelector, nsLabels); err != nil {
+		return err
+	} else if matched {
+		return nil
+	}
+	return forbidden("Namespace %s is not allowed service %s.", namespace, e.serviceName())
+}
+
+// matchPattern returns the first pattern matching the name
+func matchPattern(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// an empty selector matches nothing
+func matchSelector(selector string, set labels.Set) (bool, error) {
+	if selector == "" {
+		return false, nil
+	}
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return false, fmt.Errorf("invalid namespace selector %s: %s", selector, err)
+	}
+	return parsed.Matches(set), nil
+}
+
+// validateAccess checks patterns and selectors parse, and that some
+// namespace could be allowed
+func (e *Entry) validateAccess() ValidationErrors {
+	errs := ValidationErrors{}
+
+	for _, field := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"whitelist", e.Whitelist},
+		{"denylist", e.Denylist},
+	} {
+		for i, pattern := range field.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, ValidationError{e.Origin, fmt.Sprintf("%s[%d]", field.name, i), fmt.Sprintf("invalid pattern %s: %s", pattern, err), SeverityError})
+			}
+		}
+	}
+	for _, field := range []struct{ name, selector string }{
+		{"namespaceselector", e.NamespaceSelector},
+		{"denynamespaceselector", e.DenyNamespaceSelector},
+	} {
+		if _, err := labels.Parse(field.selector); field.selector != "" && err != nil {
+			errs = append(errs, ValidationError{e.Origin, field.name, fmt.Sprintf("invalid selector: %s", err), SeverityError})
+		}
+	}
+
+	if len(e.Whitelist) == 0 && e.NamespaceSelector == "" {
+		errs = append(errs, ValidationError{e.Origin, "whitelist", "empty, and no namespaceselector, no namespace may provision this entry", SeverityWarning})
+	}
+	return errs
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestCheckAccessPatterns(t *testing.T) {
+	e := &Entry{Team: "api", Offering: "api-service", Whitelist: []string{"client-ns", "payments-*"}, Denylist: []string{"payments-sandbox"}}
+
+	cases := []struct {
+		namespace string
+		allowed   bool
+	}{
+		{"client-ns", true},
+		{"payments-prod", true},
+		{"payments-sandbox", false},
+		{"other-ns", false},
+		{"", false},
+	}
+
+	// without selectors the namespace is never read, so no kube is needed
+	for _, c := range cases {
+		err := e.CheckAccess(nil, c.namespace)
+		if (err == nil) != c.allowed {
+			t.Errorf("%q: expected allowed %t, got %v", c.namespace, c.allowed, err)
+		}
+		if _, ok := err.(*BrokerError); err != nil && !ok {
+			t.Errorf("%q: expected a BrokerError, got %v", c.namespace, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Objects are applied with server-side apply, so the api server tracks
+// which fields the broker set. Provisioning, updates, upgrades and drift
+// correction patch objects in place, and fields another field manager has
+// set to other values are reported as conflicts rather than overwritten,
+// unless forced.
+const fieldManager = "mesitis"
+
+// applyObject applies an object as the broker. Documents without a name,
+// left to the api server to generate, can only be created.
+func applyObject(kube Kube, kind, namespace, doc string, force bool) (*ResourcesKubeObject, error) {
+	name := documentName(doc)
+	if name == "" {
+		return createObject(kube, kind, namespace, doc)
+	}
+	if _, err := kube.ApplyObject(kind, namespace, doc, force); err != nil {
+		return nil, applyError(kind, namespace, name, err)
+	}
+	return &ResourcesKubeObject{Kind: kind, Name: name, Namespace: namespace}, nil
+}
+
+// applyError explains a conflict with other field managers, naming each
+// field and its manager
+func applyError(kind, namespace, name string, err error) error {
+	conflicts := applyConflicts(err)
+	if len(conflicts) == 0 {
+		return err
+	}
+	return NewBrokerError(http.StatusConflict, "", "The %s %s in namespace %s has fields managed by others: %s.", kind, name, namespace, strings.Join(conflicts, "; "))
+}
+
+func applyConflicts(err error) []string {
+	status, ok := err.(k8serr.APIStatus)
+	if !ok || !k8serr.IsConflict(err) || status.Status().Details == nil {
+		return nil
+	}
+	conflicts := make([]string, 0)
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s)", cause.Field, cause.Message))
+		}
+	}
+	return conflicts
+}
+
+// appliedObject is what the broker last applied to a live object: the
+// fields its field manager owns, with their live values. Applied again, it
+// puts back the broker's fields and leaves those of other managers alone.
+func appliedObject(live map[string]interface{}) (string, error) {
+	metadata, _ := live["metadata"].(map[string]interface{})
+	managed, _ := metadata["managedFields"].([]interface{})
+	var owned map[string]interface{}
+	for _, m := range managed {
+		entry, _ := m.(map[string]interface{})
+		if entry["manager"] == fieldManager && entry["operation"] == "Apply" {
+			owned, _ = entry["fieldsV1"].(map[string]interface{})
+			break
+		}
+	}
+	if owned == nil {
+		return "", fmt.Errorf("no fields applied by %s", fieldManager)
+	}
+
+	obj, _ := ownedFields(live, owned).(map[string]interface{})
+	m, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{}
+		obj["metadata"] = m
+	}
+	m["name"] = metadata["name"]
+	js, err := json.Marshal(obj)
+	return string(js), err
+}
+
+// ownedFields copies the parts of a live value named in a managedFields
+// fieldsV1 set: "f:" fields of maps, and "k:" keyed, "v:" valued or "i:"
+// indexed items of lists. A field with nothing below it is owned whole.
+func ownedFields(live interface{}, fields map[string]interface{}) interface{} {
+	children := false
+	for key := range fields {
+		if key != "." {
+			children = true
+		}
+	}
+	if !children {
+		return live
+	}
+
+	switch l := live.(type) {
+	case map[string]interface{}:
+		obj := make(map[string]interface{})
+		for key, sub := range fields {
+			if !strings.HasPrefix(key, "f:") {
+				continue
+			}
+			name := strings.TrimPrefix(key, "f:")
+			if v, ok := l[name]; ok {
+				subFields, _ := sub.(map[string]interface{})
+				obj[name] = ownedFields(v, subFields)
+			}
+		}
+		return obj
+	case []interface{}:
+		items := make([]interface{}, 0)
+		for i, item := range l {
+			for key, sub := range fields {
+				if !ownedItem(key, item, i) {
+					continue
+				}
+				subFields, _ := sub.(map[string]interface{})
+				owned := ownedFields(item, subFields)
+				// the keys that identify an item are part of it
+				if strings.HasPrefix(key, "k:") {
+					if o, ok := owned.(map[string]interface{}); ok {
+						json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &o)
+					}
+				}
+				items = append(items, owned)
+				break
+			}
+		}
+		return items
+	}
+	return live
+}
+
+// ownedItem is whether a fieldsV1 key names the item of a list at index i
+func ownedItem(key string, item interface{}, i int) bool {
+	switch {
+	case strings.HasPrefix(key, "k:"):
+		var keys map[string]interface{}
+		o, ok := item.(map[string]interface{})
+		if !ok || json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &keys) != nil {
+			return false
+		}
+		for k, v := range keys {
+			if fmt.Sprint(o[k]) != fmt.Sprint(v) {
+				return false
+			}
+		}
+		return true
+	case strings.HasPrefix(key, "v:"):
+		var v interface{}
+		if json.Unmarshal([]byte(strings.TrimPrefix(key, "v:")), &v) != nil {
+			return false
+		}
+		return fmt.Sprint(v) == fmt.Sprint(item)
+	case strings.HasPrefix(key, "i:"):
+		return key == fmt.Sprintf("i:%d", i)
+	}
+	return false
+}
+
+// keepCreated keeps the time an object was first created for an instance
+// when it is applied again
+func keepCreated(annotations map[string]string, live map[string]interface{}) map[string]string {
+	metadata, _ := live["metadata"].(map[string]interface{})
+	created := stringMap(metadata["annotations"])[createdAnnotation]
+	if created == "" {
+		return annotations
+	}
+	kept := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		kept[k] = v
+	}
+	kept[createdAnnotation] = created
+	return kept
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// Apply renders the resources of the entry for an instance and applies
+// them: objects are patched in place or created, and those of the instance
+// no longer rendered are deleted. On failure the objects changed so far
+// are put back as they were.
+func (p ProvisionNewClusterObjects) Apply(kube Kube, instance *Instance, entry *Entry, values *TemplateValues, force bool) (*Instance, error) {
+	id := instance.InstanceID
+	namespace, err := p.targetNamespace(entry, values)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := p.render(kube, entry, values)
+	if err != nil {
+		return nil, err
+	}
+	if p.ConsumerNamespace {
+		kinds := make([]string, 0, len(wrapped))
+		for _, w := range wrapped {
+			kinds = append(kinds, w.kind)
+		}
+		if err := checkObjectAccess(kube, namespace, kinds); err != nil {
+			return nil, err
+		}
+	}
+
+	previous := make(map[string]bool)
+	if instance.ResourcesKubeObjectList != nil {
+		for _, po := range *instance.ResourcesKubeObjectList {
+			previous[objectKey(po)] = true
+		}
+	}
+
+	// how to undo each change made, in the order made
+	undo := make([]func(), 0)
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	labels := ownerLabels(kube, id, entry, values)
+	annotations := ownerAnnotations(id, entry)
+	objects := ResourcesKubeObjectList{}
+	kept := make(map[string]bool, len(wrapped))
+	for _, w := range wrapped {
+		name := documentName(w.doc)
+		po := ResourcesKubeObject{Kind: w.kind, Name: name, Namespace: namespace}
+
+		var live map[string]interface{}
+		if name != "" {
+			live, err = kube.GetObject(w.kind, namespace, name)
+			if k8serr.IsNotFound(err) {
+				live = nil
+			} else if err != nil {
+				rollback()
+				return nil, err
+			}
+		}
+		// an object the instance did not have must be left by an earlier attempt
+		if live != nil && !previous[objectKey(po)] {
+			if err := checkAdoptable(kube, id, w.kind, namespace, name); err != nil {
+				rollback()
+				return nil, err
+			}
+		}
+
+		doc, err := stampOwner(w.doc, labels, keepCreated(annotations, live))
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		applied, err := applyObject(kube, w.kind, namespace, doc, force)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if live == nil {
+			glog.Infof("Created %s for instance %s", objectKey(*applied), id)
+			undo = append(undo, func() { removeCreated(kube, *applied) })
+		} else {
+			glog.Infof("Applied %s for instance %s", objectKey(*applied), id)
+			undo = append(undo, func() { restoreApplied(kube, po, live) })
+		}
+		kept[objectKey(*applied)] = true
+		objects = append(objects, *applied)
+	}
+
+	// objects no longer rendered go once the rest have succeeded
+	if instance.ResourcesKubeObjectList != nil {
+		for _, po := range *instance.ResourcesKubeObjectList {
+			if kept[objectKey(po)] {
+				continue
+			}
+			if err := deleteObject(kube, po); err != nil && !k8serr.IsNotFound(err) {
+				glog.Errorf("Failed to delete %s, no longer part of instance %s: %s", objectKey(po), id, err)
+				continue
+			}
+			glog.Infof("Deleted %s, no longer part of instance %s", objectKey(po), id)
+		}
+	}
+
+	return &Instance{Entry: *entry, InstanceID: id, CoordinatesClusterURL: p.coordinates(kube, entry, namespace), ResourcesKubeObjectList: &objects}, nil
+}
+
+// removeCreated removes an object created by a failed apply
+func removeCreated(kube Kube, po ResourcesKubeObject) {
+	if err := deleteObject(kube, po); err != nil {
+		glog.Errorf("Failed to roll back %s, created by a failed apply: %s", objectKey(po), err)
+	}
+}
+
+// restoreApplied puts back what the broker had applied to an object
+// before a failed apply changed it
+func restoreApplied(kube Kube, po ResourcesKubeObject, live map[string]interface{}) {
+	doc, err := appliedObject(live)
+	if err == nil {
+		_, err = kube.ApplyObject(po.Kind, po.Namespace, doc, true)
+	}
+	if err != nil {
+		glog.Errorf("Failed to roll back %s, changed by a failed apply: %s", objectKey(po), err)
+	}
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestApplyError(t *testing.T) {
+	conflict := &k8serr.StatusError{ErrStatus: metav1.Status{
+		Status: metav1.StatusFailure,
+		Code:   409,
+		Reason: metav1.StatusReasonConflict,
+		Details: &metav1.StatusDetails{Causes: []metav1.StatusCause{
+			{Type: metav1.CauseTypeFieldManagerConflict, Field: ".spec.replicas", Message: `conflict with "kubectl"`},
+		}},
+	}}
+	if be, ok := applyError("deployment", "infra", "api", conflict).(*BrokerError); !ok || be.Status != 409 {
+		t.Errorf("conflict: expected a 409, got %v", be)
+	}
+
+	notFound := k8serr.NewNotFound(schema.GroupResource{Resource: "deployments"}, "api")
+	if err := applyError("deployment", "infra", "api", notFound); err != notFound {
+		t.Errorf("not found: expected the error unchanged, got %v", err)
+	}
+}
+
+func TestAppliedObject(t *testing.T) {
+	live := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"status":     map[string]interface{}{"replicas": 5},
+		"metadata": map[string]interface{}{
+			"name":            "api",
+			"resourceVersion": "12",
+			"labels":          map[string]interface{}{"app": "api", "team": "infra"},
+			"managedFields": []interface{}{
+				map[string]interface{}{"manager": "kubectl", "operation": "Update", "fieldsV1": map[string]interface{}{
+					"f:metadata": map[string]interface{}{"f:labels": map[string]interface{}{"f:team": map[string]interface{}{}}},
+					"f:spec":     map[string]interface{}{"f:replicas": map[string]interface{}{}},
+				}},
+				map[string]interface{}{"manager": "mesitis", "operation": "Apply", "fieldsV1": map[string]interface{}{
+					"f:metadata": map[string]interface{}{"f:labels": map[string]interface{}{"f:app": map[string]interface{}{}}},
+					"f:spec": map[string]interface{}{"f:template": map[string]interface{}{"f:spec": map[string]interface{}{"f:containers": map[string]interface{}{
+						`k:{"name":"api"}`: map[string]interface{}{".": map[string]interface{}{}, "f:image": map[string]interface{}{}},
+					}}}},
+				}},
+			},
+		},
+		"spec": map[string]interface{}{
+			"replicas": 5,
+			"template": map[string]interface{}{"spec": map[string]interface{}{"containers": []interface{}{
+				map[string]interface{}{"name": "proxy", "image": "proxy:1"},
+				map[string]interface{}{"name": "api", "image": "api:1", "imagePullPolicy": "IfNotPresent"},
+			}}},
+		},
+	}
+	doc, err := appliedObject(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"metadata":{"labels":{"app":"api"},"name":"api"},"spec":{"template":{"spec":{"containers":[{"image":"api:1","name":"api"}]}}}}`
+	if doc != expected {
+		t.Errorf("expected %s, got %s", expected, doc)
+	}
+
+	delete(live, "metadata")
+	if _, err := appliedObject(live); err == nil {
+		t.Errorf("expected an error without fields applied by the broker")
+	}
+}
+
+func TestKeepCreated(t *testing.T) {
+	annotations := map[string]string{instanceIDAnnotation: "a", createdAnnotation: "now"}
+	live := map[string]interface{}{"metadata": map[string]interface{}{
+		"annotations": map[string]interface{}{createdAnnotation: "then"},
+	}}
+	if kept := keepCreated(annotations, live); !reflect.DeepEqual(kept, map[string]string{instanceIDAnnotation: "a", createdAnnotation: "then"}) {
+		t.Errorf("expected the created time kept, got %v", kept)
+	}
+	if kept := keepCreated(annotations, nil); kept[createdAnnotation] != "now" {
+		t.Errorf("expected the new created time, got %v", kept)
+	}
+}
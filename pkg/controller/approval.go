@@ -0,0 +1,291 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
+	"k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Some offerings need a yes from the providing team. Provisioning such an
+// entry records a pending operation and creates an approval request, a
+// ConfigMap in the provider namespace naming the requester and parameters.
+// The provider sets the mesitis/approval annotation on it to approved or
+// rejected, with an optional mesitis/approval-reason. The platform polls
+// last_operation, which checks the request again once approved and starts
+// provisioning the instance. The request is deleted once the decision, or
+// the lack of one, is recorded.
+
+// mesitis/kind label of approval request ConfigMaps
+const approvalRequestKind = "approval-request"
+
+const (
+	approvalAnnotation       = "mesitis/approval"
+	approvalReasonAnnotation = "mesitis/approval-reason"
+	approvalApproved         = "approved"
+	approvalRejected         = "rejected"
+)
+
+// how long a request waits for a decision, unless the entry says otherwise
+const defaultApprovalTimeout = 72 * time.Hour
+
+// the operation name given to the platform for a provision awaiting approval
+const provisionOperation = "provision"
+
+// A provision request in progress, until it succeeds or fails
+type Operation struct {
+	InstanceID  string                 `json:"instanceID"`
+	Kind        string                 `json:"kind"`
+	State       string                 `json:"state"`
+	Description string                 `json:"description,omitempty"`
+	EntryUUID   string                 `json:"entryUUID"`
+	Namespace   string                 `json:"namespace"`
+	Platform    string                 `json:"platform,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Created     time.Time              `json:"created"`
+	Deadline    time.Time              `json:"deadline"`
+	// where the approval request is, the broker namespace if empty
+	RequestNamespace string `json:"requestNamespace,omitempty"`
+}
+
+func approvalRequestName(id string) string {
+	return fmt.Sprintf("approval-%s", id)
+}
+
+func approvalRequestSelector(id string) string {
+	return fmt.Sprintf("mesitis/kind=%s,mesitis/instance=%s", approvalRequestKind, id)
+}
+
+// providerNamespace is where the providing team runs the service, where
+// its approval requests go, or empty if the entry does not say
+func (e *Entry) providerNamespace() string {
+	switch {
+	case e.ProvisionNewClusterObjects != nil && !e.ProvisionNewClusterObjects.ConsumerNamespace:
+		return e.ProvisionNewClusterObjects.Namespace
+	case e.ProvisionExistingClusterService != nil:
+		return e.ProvisionExistingClusterService.Namespace
+	case e.ProvisionHelmChart != nil:
+		return e.ProvisionHelmChart.Namespace
+	}
+	return ""
+}
+
+// requestNamespace is where the approval request of the operation is
+func (c *ProductionController) requestNamespace(op *Operation) string {
+	if op.RequestNamespace != "" {
+		return op.RequestNamespace
+	}
+	return c.Kube.BrokerNamespace()
+}
+
+func (e *Entry) approvalTimeout() time.Duration {
+	if d, err := time.ParseDuration(e.ApprovalTimeout); err == nil && e.ApprovalTimeout != "" {
+		return d
+	}
+	return defaultApprovalTimeout
+}
+
+func (e *Entry) validateApproval() ValidationErrors {
+	errs := ValidationErrors{}
+	if e.ApprovalTimeout == "" {
+		return errs
+	}
+	if d, err := time.ParseDuration(e.ApprovalTimeout); err != nil {
+		errs = append(errs, ValidationError{e.Origin, "approvaltimeout", fmt.Sprintf("invalid duration: %s", err), SeverityError})
+	} else if d <= 0 {
+		errs = append(errs, ValidationError{e.Origin, "approvaltimeout", "must be positive", SeverityError})
+	}
+	if !e.RequiresApproval {
+		errs = append(errs, ValidationError{e.Origin, "approvaltimeout", "set but requiresapproval is not", SeverityWarning})
+	}
+	return errs
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// requestApproval records a pending provision and creates its approval
+// request, or returns the one already pending for the instance
+func (c *ProductionController) requestApproval(id string, entry *Entry, req *brokerapi.CreateServiceInstanceRequest) (*brokerapi.CreateServiceInstanceResponse, error) {
+	if op, err := LoadOperation(c.Storage, id); err == nil && op.State == brokerapi.StateInProgress {
+		glog.Infof("Instance %s already awaiting approval, returning", id)
+		return &brokerapi.CreateServiceInstanceResponse{Operation: provisionOperation}, nil
+	}
+	if !req.AcceptsIncomplete {
+		return nil, NewBrokerError(http.StatusUnprocessableEntity, "AsyncRequired", "Service %s requires approval by its provider, and so asynchronous provisioning.", entry.serviceName())
+	}
+
+	now := time.Now()
+	op := &Operation{
+		InstanceID:       id,
+		Kind:             provisionOperation,
+		State:            brokerapi.StateInProgress,
+		Description:      fmt.Sprintf("Awaiting approval by team %s.", entry.Team),
+		EntryUUID:        entry.UUID,
+		Namespace:        req.ContextProfile.Namespace,
+		RequestNamespace: entry.providerNamespace(),
+		Platform:         req.ContextProfile.Platform,
+		Parameters:       req.Parameters,
+		Created:          now,
+		Deadline:         now.Add(entry.approvalTimeout()),
+	}
+
+	parameters, err := json.MarshalIndent(req.Parameters, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	cm := v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: approvalRequestName(id),
+			Labels: map[string]string{
+				"mesitis/kind":     approvalRequestKind,
+				"mesitis/instance": id,
+			},
+			Annotations: map[string]string{approvalAnnotation: ""},
+		},
+		Data: map[string]string{
+			"service":    entry.serviceName(),
+			"uuid":       entry.UUID,
+			"namespace":  op.Namespace,
+			"parameters": string(parameters),
+			"deadline":   op.Deadline.Format(time.RFC3339),
+		},
+	}
+	js, err := json.Marshal(cm)
+	if err != nil {
+		return nil, err
+	}
+	namespace := c.requestNamespace(op)
+	if _, err := c.Kube.CreateConfigMapFromJSON(namespace, string(js)); k8serr.IsAlreadyExists(err) {
+		// left by a request whose operation was not saved, resumed as it is
+		glog.Infof("Approval request %s/%s for instance %s already exists, resuming", namespace, cm.Name, id)
+	} else if err != nil {
+		glog.Errorf("Failed to create approval request for instance %s: %s", id, err)
+		return nil, err
+	}
+	if err := SaveOperation(c.Storage, id, op); err != nil {
+		return nil, err
+	}
+
+	glog.Infof("Instance %s of %s for namespace %s awaits approval in ConfigMap %s/%s", id, entry.serviceName(), op.Namespace, namespace, cm.Name)
+	return &brokerapi.CreateServiceInstanceResponse{Operation: provisionOperation}, nil
+}
+
+// approvalDecision reads the provider's decision from the approval request
+func (c *ProductionController) approvalDecision(op *Operation) (string, string, error) {
+	list, err := c.Kube.ListConfigMaps(c.requestNamespace(op), approvalRequestSelector(op.InstanceID))
+	if err != nil {
+		return "", "", err
+	}
+	if len(list.Items) == 0 {
+		return approvalRejected, "approval request was deleted", nil
+	}
+	cm := list.Items[0]
+	return cm.Annotations[approvalAnnotation], cm.Annotations[approvalReasonAnnotation], nil
+}
+
+// progressApproval moves a pending provision on if the provider has
+// decided or the request has timed out
+func (c *ProductionController) progressApproval(op *Operation) error {
+	decision, reason, err := c.approvalDecision(op)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case decision == approvalRejected && reason != "":
+		failApproval(op, "Rejected by the provider: %s", reason)
+	case decision == approvalRejected:
+		failApproval(op, "Rejected by the provider.")
+	case decision == approvalApproved:
+		catalog, err := c.loadCatalog()
+		if err != nil {
+			return err
+		}
+		entry := findEntry(catalog, op.EntryUUID)
+		if entry == nil {
+			failApproval(op, "Approved, but service %s is no longer offered.", op.EntryUUID)
+			break
+		}
+		// the entry, the namespace or other instances may have changed
+		if err := c.checkProvision(op.InstanceID, entry, op.Namespace, op.Platform, op.Parameters); err != nil {
+			failApproval(op, "Approved, but not provisioned. %s", err)
+			break
+		}
+		// hooks may take long, so polls report in progress until it is done
+		glog.Infof("Instance %s approved, provisioning", op.InstanceID)
+		go c.provisionApproved(op, entry, c.markBusy(op.InstanceID))
+		return nil
+	case time.Now().After(op.Deadline):
+		failApproval(op, "Not approved by the provider before %s.", op.Deadline.Format(time.RFC3339))
+	default:
+		return nil
+	}
+	return c.finishApproval(op)
+}
+
+// provisionApproved provisions an approved instance and records the
+// outcome, then lets go of the instance
+func (c *ProductionController) provisionApproved(op *Operation, entry *Entry, release func()) {
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+	defer release()
+
+	if err := c.provision(op.InstanceID, entry, op.Namespace, op.Parameters); err != nil {
+		failApproval(op, "Approved, but provisioning failed: %s", err)
+	} else {
+		op.State = brokerapi.StateSucceeded
+		op.Description = "Approved and provisioned."
+		glog.Infof("Instance %s approved and provisioned", op.InstanceID)
+	}
+	if err := c.finishApproval(op); err != nil {
+		glog.Errorf("Failed to record provision of instance %s: %s", op.InstanceID, err)
+	}
+}
+
+func failApproval(op *Operation, format string, args ...interface{}) {
+	op.State = brokerapi.StateFailed
+	op.Description = fmt.Sprintf(format, args...)
+	glog.Errorf("Provision of instance %s failed: %s", op.InstanceID, op.Description)
+}
+
+// finishApproval saves the outcome of an operation and removes its
+// approval request
+func (c *ProductionController) finishApproval(op *Operation) error {
+	if err := SaveOperation(c.Storage, op.InstanceID, op); err != nil {
+		return err
+	}
+	c.deleteApprovalRequest(op)
+	return nil
+}
+
+// deleteApprovalRequest removes the approval request of an operation, if
+// it is still there
+func (c *ProductionController) deleteApprovalRequest(op *Operation) {
+	namespace := c.requestNamespace(op)
+	name := approvalRequestName(op.InstanceID)
+	if !c.Kube.ConfigMapExists(namespace, name) {
+		return
+	}
+	if err := c.Kube.DeleteConfigMap(namespace, name); err != nil {
+		glog.Errorf("Failed to delete approval request %s/%s: %s", namespace, name, err)
+	}
+}
+
+// cancelApproval removes any record of a provision awaiting approval
+func (c *ProductionController) cancelApproval(id string) {
+	op, err := LoadOperation(c.Storage, id)
+	if err != nil {
+		return
+	}
+	DeleteOperation(c.Storage, id)
+	c.deleteApprovalRequest(op)
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateApproval(t *testing.T) {
+	tests := []struct {
+		entry    Entry
+		timeout  time.Duration
+		severity string
+	}{
+		{Entry{RequiresApproval: true}, defaultApprovalTimeout, ""},
+		{Entry{RequiresApproval: true, ApprovalTimeout: "24h"}, 24 * time.Hour, ""},
+		{Entry{RequiresApproval: true, ApprovalTimeout: "a day"}, defaultApprovalTimeout, SeverityError},
+		{Entry{RequiresApproval: true, ApprovalTimeout: "-1h"}, -time.Hour, SeverityError},
+		{Entry{ApprovalTimeout: "1h"}, time.Hour, SeverityWarning},
+	}
+
+	for _, test := range tests {
+		if timeout := test.entry.approvalTimeout(); timeout != test.timeout {
+			t.Errorf("%q: expected timeout %s, got %s", test.entry.ApprovalTimeout, test.timeout, timeout)
+		}
+		errs := test.entry.validateApproval()
+		switch {
+		case test.severity == "" && len(errs) > 0:
+			t.Errorf("%q: unexpected %v", test.entry.ApprovalTimeout, errs)
+		case test.severity != "" && (len(errs) != 1 || errs[0].Severity != test.severity):
+			t.Errorf("%q: expected one %s, got %v", test.entry.ApprovalTimeout, test.severity, errs)
+		}
+	}
+}
+
+func TestProviderNamespace(t *testing.T) {
+	tests := []struct {
+		entry    Entry
+		expected string
+	}{
+		{Entry{ProvisionNewClusterObjects: &ProvisionNewClusterObjects{Namespace: "api-ns"}}, "api-ns"},
+		{Entry{ProvisionNewClusterObjects: &ProvisionNewClusterObjects{Namespace: "api-ns", ConsumerNamespace: true}}, ""},
+		{Entry{ProvisionExistingClusterService: &ProvisionExistingClusterService{Namespace: "infra", Name: "redis"}}, "infra"},
+		{Entry{ProvisionNonClusterURL: &ProvisionNonClusterURL{URL: "https://api.example.com"}}, ""},
+	}
+	for _, test := range tests {
+		if ns := test.entry.providerNamespace(); ns != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.entry, test.expected, ns)
+		}
+	}
+}
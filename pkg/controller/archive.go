@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/jonahbenton/mesitis/pkg"
+)
+
+// An archive is a portable dump of broker state, independent of the
+// Storage backend it was taken from. Records are kept as the raw values
+// found in storage so an archive restores exactly what was exported.
+type Archive struct {
+	Version string          `json:"version"`
+	Created time.Time       `json:"created"`
+	Records []ArchiveRecord `json:"records"`
+}
+
+type ArchiveRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// key prefixes of the records that make up broker state
+var archivePrefixes = []string{
+	"instance-",
+	"binding-",
+	"operation-",
+}
+
+// an encrypted archive is the magic, a scrypt salt, a GCM nonce,
+// and the sealed gzipped JSON
+const archiveMagic = "MESITIS-ARCHIVE-1"
+
+const (
+	archiveSaltSize = 16
+	archiveKeySize  = 32
+)
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+func ExportArchive(s Storage) (*Archive, error) {
+	archive := &Archive{Version: pkg.VERSION, Created: time.Now().UTC()}
+
+	for _, prefix := range archivePrefixes {
+		keys, err := s.Keys(prefix + "*")
+		if err != nil {
+			glog.Errorf("Failed to list keys with prefix %s: %s", prefix, err)
+			return nil, err
+		}
+		for _, key := range keys {
+			value, err := s.Get(key)
+			if err != nil {
+				glog.Errorf("Failed to read key %s for export: %s", key, err)
+				return nil, err
+			}
+			archive.Records = append(archive.Records, ArchiveRecord{Key: key, Value: value})
+		}
+	}
+
+	glog.Infof("Exported <%d> records.", len(archive.Records))
+	return archive, nil
+}
+
+// ImportArchive restores records into the given storage. Existing keys are
+// left alone unless overwrite is set. Returns the number of records written.
+func ImportArchive(s Storage, archive *Archive, overwrite bool) (int, error) {
+
+	// check everything before writing anything
+	for _, r := range archive.Records {
+		if err := validateArchiveRecord(r); err != nil {
+			return 0, err
+		}
+	}
+
+	written := 0
+	for _, r := range archive.Records {
+		if _, err := s.Get(r.Key); err == nil && !overwrite {
+			glog.Infof("Key %s exists, skipping import.", r.Key)
+			continue
+		}
+		if err := s.Set(r.Key, r.Value, 0); err != nil {
+			glog.Errorf("Failed to import key %s: %s", r.Key, err)
+			return written, err
+		}
+		written++
+	}
+
+	glog.Infof("Imported <%d> of <%d> records.", written, len(archive.Records))
+	return written, RebuildIndexes(s)
+}
+
+func validateArchiveRecord(r ArchiveRecord) error {
+	switch {
+	case strings.HasPrefix(r.Key, "instance-"):
+		var i Instance
+		if err := json.Unmarshal([]byte(r.Value), &i); err != nil {
+			return fmt.Errorf("Archive record %s is not a valid Instance: %s", r.Key, err)
+		}
+	case strings.HasPrefix(r.Key, "binding-"):
+		var b Binding
+		if err := json.Unmarshal([]byte(r.Value), &b); err != nil {
+			return fmt.Errorf("Archive record %s is not a valid Binding: %s", r.Key, err)
+		}
+	case strings.HasPrefix(r.Key, "operation-"):
+		var o Operation
+		if err := json.Unmarshal([]byte(r.Value), &o); err != nil {
+			return fmt.Errorf("Archive record %s is not a valid Operation: %s", r.Key, err)
+		}
+	default:
+		return fmt.Errorf("Archive record %s is not broker state", r.Key)
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// WriteArchive writes the archive as gzipped JSON, sealed with a key
+// derived from passphrase when passphrase is not empty.
+func WriteArchive(w io.Writer, archive *Archive, passphrase string) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(archive); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if passphrase == "" {
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	salt := make([]byte, archiveSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := archiveCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	out := []byte(archiveMagic)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, buf.Bytes(), []byte(archiveMagic))
+	_, err = w.Write(out)
+	return err
+}
+
+func ReadArchive(r io.Reader, passphrase string) (*Archive, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, []byte(archiveMagic)) {
+		if passphrase == "" {
+			return nil, errors.New("Archive is encrypted and no passphrase was given")
+		}
+		data = data[len(archiveMagic):]
+		if len(data) < archiveSaltSize {
+			return nil, errors.New("Archive is truncated")
+		}
+		salt := data[:archiveSaltSize]
+		data = data[archiveSaltSize:]
+		aead, err := archiveCipher(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, errors.New("Archive is truncated")
+		}
+		nonce := data[:aead.NonceSize()]
+		if data, err = aead.Open(nil, nonce, data[aead.NonceSize():], []byte(archiveMagic)); err != nil {
+			return nil, errors.New("Failed to decrypt archive, wrong passphrase?")
+		}
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var archive Archive
+	if err := json.NewDecoder(zr).Decode(&archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+func archiveCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, archiveKeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,533 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// A place catalog entries, and the resources they wrap, are loaded from
+type CatalogSource interface {
+	Name() string
+	// Load returns the entries found, unvalidated, and any problems reading
+	// them. A source that fails to read its entries may return those it read
+	// last with the error, to be offered meanwhile.
+	Load() ([]Entry, ValidationErrors, error)
+	// WrappedResources returns the wrapped resources matching the selector,
+	// presented as ConfigMaps
+	WrappedResources(labelSelector string) ([]v1.ConfigMap, error)
+}
+
+// A source that reports validation problems somewhere other than the log
+type CatalogReporter interface {
+	Report(errs ValidationErrors)
+}
+
+// A source that notices its own changes
+type CatalogWatcher interface {
+	OnChange(handler func(origin string))
+}
+
+// A source that needs to run in the background, until stop is closed
+type CatalogRunner interface {
+	Run(stop <-chan struct{}) error
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// the entries a source last loaded, validated
+type sourceCatalog struct {
+	entries []Entry
+	errs    ValidationErrors
+}
+
+// catalogSourceError names the sources that failed to load
+type catalogSourceError struct {
+	failed []string
+	// some of them had no entries loaded before to offer instead
+	missing bool
+}
+
+func (e *catalogSourceError) Error() string {
+	return fmt.Sprintf("failed to load catalog from %s", strings.Join(e.failed, "; "))
+}
+
+// LoadCatalogFromSources loads and validates entries from every source
+// together, then merges them in order of precedence, highest first. Returns
+// the entries offered and every problem found.
+//
+// A source that fails to load is skipped, and the entries it returns with
+// its error, or else those it last loaded into last, are offered in its
+// place. The catalog is still returned, with a catalogSourceError naming the
+// sources that failed.
+//
+// An entry with the same uuid and service name as one in a source of
+// higher precedence is overridden by it. An entry sharing only one of the
+// two conflicts, and is left out. Within a source both must be unique.
+func LoadCatalogFromSources(sources []CatalogSource, last map[string]*sourceCatalog) (*[]Entry, ValidationErrors, error) {
+	entries := make([]Entry, 0)
+	errs := ValidationErrors{}
+	var failure *catalogSourceError
+
+	for _, source := range sources {
+		loaded, err := loadSource(source)
+		if err != nil {
+			if failure == nil {
+				failure = &catalogSourceError{}
+			}
+			failure.failed = append(failure.failed, fmt.Sprintf("%s: %s", source.Name(), err))
+			if loaded == nil {
+				loaded = last[source.Name()]
+			}
+			if loaded == nil {
+				failure.missing = true
+				continue
+			}
+			glog.Warningf("Offering the <%d> entries last loaded from %s.", len(loaded.entries), source.Name())
+		} else if last != nil {
+			last[source.Name()] = loaded
+		}
+		errs = append(errs, loaded.errs...)
+		entries = append(entries, loaded.entries...)
+	}
+
+	entries, conflicts := mergeEntries(entries, errs)
+	errs = append(errs, conflicts...)
+	// dependencies may name entries of other sources
+	errs = append(errs, validateDependencies(entries, errs)...)
+
+	for _, e := range errs {
+		if e.Severity == SeverityError {
+			glog.Errorf("Catalog entry invalid: %s", e)
+		} else {
+			glog.Warningf("Catalog entry suspect: %s", e)
+		}
+	}
+	for _, source := range sources {
+		if reporter, ok := source.(CatalogReporter); ok {
+			reporter.Report(errs)
+		}
+	}
+
+	catalog := validEntries(entries, errs)
+	if failure != nil {
+		return &catalog, errs, failure
+	}
+	return &catalog, errs, nil
+}
+
+// loadSource loads and validates the entries of one source, returning the
+// entries a failing source still offers with its error
+func loadSource(source CatalogSource) (*sourceCatalog, error) {
+	found, problems, err := source.Load()
+	if err != nil {
+		glog.Errorf("Failed to load catalog from %s: %s", source.Name(), err)
+		if found == nil {
+			return nil, err
+		}
+	}
+	wrapped, wrappedErr := source.WrappedResources(wrappedResourceSelector)
+	if wrappedErr != nil {
+		glog.Errorf("Failed to find wrapped resources in %s to validate the catalog: %s", source.Name(), wrappedErr)
+		return nil, wrappedErr
+	}
+	glog.Infof("Found <%d> entries in %s.", len(found), source.Name())
+
+	// label selectors are resolved within the entry's own source
+	for i := range found {
+		found[i].Source = source.Name()
+		found[i].source = source
+		problems = append(problems, found[i].Validate(wrapped)...)
+	}
+	problems = append(problems, validateDuplicates(found)...)
+	problems = append(problems, ValidateWrappedResources(wrapped, found)...)
+	return &sourceCatalog{entries: found, errs: problems}, err
+}
+
+// mergeEntries drops entries overridden by an entry of higher precedence,
+// given entries in order of precedence. Only valid entries override, so a
+// broken override leaves the entry it meant to replace in place.
+func mergeEntries(entries []Entry, errs ValidationErrors) ([]Entry, ValidationErrors) {
+	merged := make([]Entry, 0, len(entries))
+	conflicts := ValidationErrors{}
+
+	uuids := make(map[string]*Entry, 0)
+	names := make(map[string]*Entry, 0)
+	for i := range entries {
+		e := &entries[i]
+		if errs.bySource(e.Origin).HasErrors() {
+			merged = append(merged, *e)
+			continue
+		}
+
+		byUUID, byName := uuids[e.UUID], names[e.serviceName()]
+		switch {
+		case byUUID != nil && byUUID.source == e.source, byName != nil && byName.source == e.source:
+			// duplicates within a source are reported by validateDuplicates
+			merged = append(merged, *e)
+		case byUUID != nil && byUUID == byName:
+			conflicts = append(conflicts, ValidationError{e.Origin, "uuid", fmt.Sprintf("overridden by %s", byUUID.Origin), SeverityWarning})
+		case byUUID != nil:
+			conflicts = append(conflicts, ValidationError{e.Origin, "uuid", fmt.Sprintf("uuid %s conflicts with service %s in %s", e.UUID, byUUID.serviceName(), byUUID.Origin), SeverityError})
+		case byName != nil:
+			conflicts = append(conflicts, ValidationError{e.Origin, "offering", fmt.Sprintf("service %s conflicts with uuid %s in %s", e.serviceName(), byName.UUID, byName.Origin), SeverityError})
+		default:
+			uuids[e.UUID] = e
+			names[e.serviceName()] = e
+			merged = append(merged, *e)
+		}
+	}
+	return merged, conflicts
+}
+
+// wrappedResources finds the resources an entry wraps, in the source the
+// entry was loaded from
+func (e *Entry) wrappedResources(kube Kube, labelSelector string) ([]v1.ConfigMap, error) {
+	if e.source != nil {
+		return e.source.WrappedResources(labelSelector)
+	}
+	if e.Source != "" {
+		return nil, fmt.Errorf("%s was loaded from %s, which is no longer a catalog source", e.serviceName(), e.Source)
+	}
+	// recorded before sources were, when the broker namespace was the only one
+	return listWrappedResources(kube, labelSelector)
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// The ConfigMaps and CatalogEntry and WrappedResource custom resources in
+// the broker namespace
+type KubeCatalogSource struct {
+	Kube Kube
+
+	reports validationReports
+}
+
+const catalogEntrySelector = "mesitis/kind=" + catalogEntryKind
+
+func (s *KubeCatalogSource) Name() string {
+	return fmt.Sprintf("namespace %s", s.Kube.BrokerNamespace())
+}
+
+func (s *KubeCatalogSource) Load() ([]Entry, ValidationErrors, error) {
+	k := s.Kube
+
+	list, err := k.ListConfigMaps(k.BrokerNamespace(), catalogEntrySelector)
+	if err != nil {
+		glog.Errorf("Failed to find config maps from which to load the catalog: %s", err)
+		return nil, nil, err
+	}
+	resources, err := listCustomResources(k, catalogEntries, "")
+	if err != nil {
+		glog.Errorf("Failed to find CatalogEntries from which to load the catalog: %s", err)
+		return nil, nil, err
+	}
+
+	entries, errs := ParseCatalogConfigMaps(list.Items)
+	resourceEntries, resourceErrs := ParseCatalogEntryResources(resources)
+	return append(entries, resourceEntries...), append(errs, resourceErrs...), nil
+}
+
+func (s *KubeCatalogSource) WrappedResources(labelSelector string) ([]v1.ConfigMap, error) {
+	return listWrappedResources(s.Kube, labelSelector)
+}
+
+// Report records problems as Events on the objects they were found in,
+// when they differ from those last reported
+func (s *KubeCatalogSource) Report(errs ValidationErrors) {
+	k := s.Kube
+
+	list, err := k.ListConfigMaps(k.BrokerNamespace(), cachedConfigMapSelector)
+	if err != nil {
+		return
+	}
+	resources, err := listCustomResources(k, catalogEntries, "")
+	if err != nil {
+		return
+	}
+	recordValidationEvents(k, list.Items, errs, &s.reports)
+	reportResourceValidation(k, resources, errs, &s.reports)
+}
+
+func (s *KubeCatalogSource) OnChange(handler func(origin string)) {
+	s.Kube.OnCatalogChange(handler)
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// The catalog as manifests, the same ConfigMaps, CatalogEntries and
+// WrappedResources that would be applied to the broker namespace
+type CatalogManifests struct {
+	ConfigMaps       []v1.ConfigMap
+	CatalogEntries   []unstructured.Unstructured
+	WrappedResources []unstructured.Unstructured
+}
+
+// ReadCatalogManifests decodes a stream of YAML or JSON manifests. Kinds
+// that are not part of a catalog are skipped.
+func ReadCatalogManifests(r io.Reader) (*CatalogManifests, error) {
+	m := &CatalogManifests{}
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var obj unstructured.Unstructured
+		if err := decoder.Decode(&obj.Object); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if obj.Object == nil {
+			continue
+		}
+
+		switch obj.GetKind() {
+		case "ConfigMap":
+			var cm v1.ConfigMap
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &cm); err != nil {
+				return nil, err
+			}
+			m.ConfigMaps = append(m.ConfigMaps, cm)
+		case "CatalogEntry":
+			m.CatalogEntries = append(m.CatalogEntries, obj)
+		case "WrappedResource":
+			m.WrappedResources = append(m.WrappedResources, obj)
+		}
+	}
+	return m, nil
+}
+
+// ReadCatalogDirectory reads the manifests in every .yaml, .yml and .json
+// file below dir. Origins name the file each object was read from, as its
+// path relative to dir joined to from. Hidden directories are skipped.
+func ReadCatalogDirectory(dir, from string) (*CatalogManifests, error) {
+	all := &CatalogManifests{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") && file != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		m, err := ReadCatalogManifests(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			rel = file
+		}
+		m.setOrigins(path.Join(from, filepath.ToSlash(rel)))
+		all.ConfigMaps = append(all.ConfigMaps, m.ConfigMaps...)
+		all.CatalogEntries = append(all.CatalogEntries, m.CatalogEntries...)
+		all.WrappedResources = append(all.WrappedResources, m.WrappedResources...)
+		return nil
+	})
+	return all, err
+}
+
+// setOrigins names where the objects came from, ex catalog/api.yaml, in
+// the origin reported with any problems found in them
+func (m *CatalogManifests) setOrigins(from string) {
+	annotate := func(annotations map[string]string, kind, name string) map[string]string {
+		if annotations == nil {
+			annotations = make(map[string]string, 0)
+		}
+		if _, ok := annotations[originAnnotation]; !ok {
+			annotations[originAnnotation] = fmt.Sprintf("%s:%s/%s", from, kind, name)
+		}
+		return annotations
+	}
+	for i := range m.ConfigMaps {
+		cm := &m.ConfigMaps[i]
+		cm.Annotations = annotate(cm.Annotations, "configmap", cm.Name)
+	}
+	for i := range m.CatalogEntries {
+		obj := &m.CatalogEntries[i]
+		obj.SetAnnotations(annotate(obj.GetAnnotations(), "catalogentry", obj.GetName()))
+	}
+	for i := range m.WrappedResources {
+		obj := &m.WrappedResources[i]
+		obj.SetAnnotations(annotate(obj.GetAnnotations(), "wrappedresource", obj.GetName()))
+	}
+}
+
+// Entries parses the catalog entries held in the manifests
+func (m *CatalogManifests) Entries() ([]Entry, ValidationErrors) {
+	catalog := make([]v1.ConfigMap, 0)
+	for _, cm := range m.ConfigMaps {
+		if cm.Labels["mesitis/kind"] == catalogEntryKind {
+			catalog = append(catalog, cm)
+		}
+	}
+	entries, errs := ParseCatalogConfigMaps(catalog)
+	resourceEntries, resourceErrs := ParseCatalogEntryResources(m.CatalogEntries)
+	return append(entries, resourceEntries...), append(errs, resourceErrs...)
+}
+
+// Wrapped returns the wrapped resources matching the selector
+func (m *CatalogManifests) Wrapped(labelSelector string) ([]v1.ConfigMap, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	all := append(append([]v1.ConfigMap{}, m.ConfigMaps...), wrappedResourceConfigMaps(m.WrappedResources)...)
+
+	items := make([]v1.ConfigMap, 0)
+	for _, cm := range all {
+		if _, ok := cm.Labels["mesitis/kind"]; ok && cm.Labels["mesitis/kind"] != catalogEntryKind && selector.Matches(labels.Set(cm.Labels)) {
+			items = append(items, cm)
+		}
+	}
+	return items, nil
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// polledManifests holds manifests read whole by fetch, read again every
+// interval, with handlers told when they change
+type polledManifests struct {
+	name     string
+	interval time.Duration
+	fetch    func() (*CatalogManifests, error)
+
+	fetchMutex sync.Mutex
+	mutex      sync.RWMutex
+	manifests  *CatalogManifests
+	// why the last read failed, nil if it succeeded
+	fetchErr error
+	handlers []func(origin string)
+}
+
+func (p *polledManifests) Name() string {
+	return p.name
+}
+
+// Load returns the entries last read, with the error of the last read if it
+// failed
+func (p *polledManifests) Load() ([]Entry, ValidationErrors, error) {
+	manifests, err := p.current()
+	if manifests == nil {
+		return nil, nil, err
+	}
+	entries, errs := manifests.Entries()
+	return entries, errs, err
+}
+
+// WrappedResources returns the wrapped resources last read, however the
+// last read went
+func (p *polledManifests) WrappedResources(labelSelector string) ([]v1.ConfigMap, error) {
+	manifests, err := p.current()
+	if manifests == nil {
+		return nil, err
+	}
+	return manifests.Wrapped(labelSelector)
+}
+
+func (p *polledManifests) OnChange(handler func(origin string)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handlers = append(p.handlers, handler)
+}
+
+// Run reads the manifests every interval until stop is closed
+func (p *polledManifests) Run(stop <-chan struct{}) error {
+	if p.interval <= 0 {
+		<-stop
+		return nil
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := p.refresh(); err != nil {
+				glog.Errorf("Failed to read catalog from %s: %s", p.name, err)
+			}
+		}
+	}
+}
+
+// current returns the manifests last read and why the last read failed, if
+// it did, reading them if there are none
+func (p *polledManifests) current() (*CatalogManifests, error) {
+	p.mutex.RLock()
+	manifests, err := p.manifests, p.fetchErr
+	p.mutex.RUnlock()
+	if manifests != nil {
+		return manifests, err
+	}
+
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.manifests, nil
+}
+
+// refresh reads the manifests again. Handlers are told when they change,
+// and when reads start or stop failing, so the failure is reported while
+// the manifests last read are still offered.
+func (p *polledManifests) refresh() error {
+	p.fetchMutex.Lock()
+	defer p.fetchMutex.Unlock()
+
+	manifests, err := p.fetch()
+
+	p.mutex.Lock()
+	previous := p.manifests
+	changed := previous != nil && (err == nil) != (p.fetchErr == nil)
+	p.fetchErr = err
+	// nothing to replace when the fetch failed or found nothing new
+	if err == nil && manifests != nil {
+		p.manifests = manifests
+		changed = changed || (previous != nil && !reflect.DeepEqual(previous, manifests))
+	}
+	handlers := append([]func(string){}, p.handlers...)
+	p.mutex.Unlock()
+
+	if changed {
+		for _, handler := range handlers {
+			handler(p.name)
+		}
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+// a source whose entries and wrapped resources are given, or that fails,
+// still offering any entries it is given
+type fakeSource struct {
+	name    string
+	entries []Entry
+	wrapped []v1.ConfigMap
+	err     error
+}
+
+func (s *fakeSource) Name() string { return s.name }
+
+func (s *fakeSource) Load() ([]Entry, ValidationErrors, error) {
+	return s.entries, ValidationErrors{}, s.err
+}
+
+func (s *fakeSource) WrappedResources(labelSelector string) ([]v1.ConfigMap, error) {
+	if s.entries == nil {
+		return s.wrapped, s.err
+	}
+	return s.wrapped, nil
+}
+
+func TestMergeEntries(t *testing.T) {
+	team, org := &DirectoryCatalogSource{}, &DirectoryCatalogSource{}
+	entry := func(source CatalogSource, origin, uuid, offering string) Entry {
+		return Entry{Team: "api", Offering: offering, UUID: uuid, Origin: origin, source: source}
+	}
+
+	cases := []struct {
+		name     string
+		entries  []Entry
+		offered  []string
+		problems map[string]string
+	}{
+		{"distinct", []Entry{entry(team, "a", "1", "x"), entry(org, "b", "2", "y")}, []string{"a", "b"}, nil},
+		{"override", []Entry{entry(team, "a", "1", "x"), entry(org, "b", "1", "x")}, []string{"a"}, map[string]string{"b": SeverityWarning}},
+		{"uuid conflict", []Entry{entry(team, "a", "1", "x"), entry(org, "b", "1", "y")}, []string{"a"}, map[string]string{"b": SeverityError}},
+		{"name conflict", []Entry{entry(team, "a", "1", "x"), entry(org, "b", "2", "x")}, []string{"a"}, map[string]string{"b": SeverityError}},
+		{"same source", []Entry{entry(team, "a", "1", "x"), entry(team, "b", "1", "x")}, []string{"a", "b"}, nil},
+	}
+
+	for _, c := range cases {
+		merged, conflicts := mergeEntries(c.entries, ValidationErrors{})
+		offered := make([]string, 0)
+		for _, e := range merged {
+			if !conflicts.bySource(e.Origin).HasErrors() {
+				offered = append(offered, e.Origin)
+			}
+		}
+		if len(offered) != len(c.offered) {
+			t.Errorf("%s: expected %v offered, got %v", c.name, c.offered, offered)
+			continue
+		}
+		for i := range offered {
+			if offered[i] != c.offered[i] {
+				t.Errorf("%s: expected %v offered, got %v", c.name, c.offered, offered)
+			}
+		}
+		if len(conflicts) != len(c.problems) {
+			t.Errorf("%s: expected problems %v, got %v", c.name, c.problems, conflicts)
+		}
+		for _, e := range conflicts {
+			if c.problems[e.Source] != e.Severity {
+				t.Errorf("%s: unexpected problem %v", c.name, e)
+			}
+		}
+	}
+}
+
+func TestLoadCatalogFromFailingSource(t *testing.T) {
+	entry := func(origin, uuid, offering string) Entry {
+		return Entry{Team: "api", Offering: offering, UUID: uuid, Version: "1", Origin: origin,
+			ProvisionNonClusterURL: &ProvisionNonClusterURL{URL: "https://example.com"}, CredentialNoCredential: &CredentialNoCredential{}}
+	}
+	team := &fakeSource{name: "team", entries: []Entry{entry("a", "1", "x")}}
+	org := &fakeSource{name: "org", entries: []Entry{entry("b", "2", "y")}}
+	last := make(map[string]*sourceCatalog)
+
+	if catalog, _, err := LoadCatalogFromSources([]CatalogSource{team, org}, last); err != nil || len(*catalog) != 2 {
+		t.Fatalf("expected both entries, got %v %v", catalog, err)
+	}
+
+	// a failing source offers what it still has, and the failure is reported
+	org.entries, org.err = []Entry{entry("c", "3", "z")}, errors.New("unreachable")
+	catalog, _, err := LoadCatalogFromSources([]CatalogSource{team, org}, last)
+	if se, ok := err.(*catalogSourceError); !ok || se.missing {
+		t.Errorf("expected a failure with entries to fall back on, got %v", err)
+	}
+	if len(*catalog) != 2 || (*catalog)[1].UUID != "3" {
+		t.Errorf("expected the entries the failing source still has, got %v", *catalog)
+	}
+
+	// or else what it last loaded
+	org.entries = nil
+	catalog, _, err = LoadCatalogFromSources([]CatalogSource{team, org}, last)
+	if se, ok := err.(*catalogSourceError); !ok || se.missing {
+		t.Errorf("expected a failure with entries to fall back on, got %v", err)
+	}
+	if len(*catalog) != 2 || (*catalog)[1].UUID != "2" {
+		t.Errorf("expected the last entries of the failing source, got %v", *catalog)
+	}
+
+	// with nothing loaded before, the failure says so
+	catalog, _, err = LoadCatalogFromSources([]CatalogSource{team, org}, nil)
+	if se, ok := err.(*catalogSourceError); !ok || !se.missing {
+		t.Errorf("expected a failure with nothing to fall back on, got %v", err)
+	}
+	if len(*catalog) != 1 {
+		t.Errorf("expected only the entries of the working source, got %v", *catalog)
+	}
+}
+
+func TestEntrySource(t *testing.T) {
+	source := &fakeSource{name: "team", entries: []Entry{{Team: "api", Offering: "x", UUID: "1", Version: "1"}}}
+	loaded, err := loadSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := loaded.entries[0]; e.Source != "team" || e.source != source {
+		t.Errorf("expected the entry to record its source, got %s", e.Source)
+	}
+
+	// read back from storage, the source is only known by name
+	stored := Entry{Team: "api", Offering: "x", Source: "team"}
+	c := &ProductionController{Sources: []CatalogSource{source}}
+	if c.sourceNamed(stored.Source) != source {
+		t.Errorf("expected the source found by name")
+	}
+	if _, err := stored.wrappedResources(nil, "app=x"); err == nil {
+		t.Errorf("expected an error for a source that is no longer configured")
+	}
+}
+
+func TestPolledManifestsFailingRefresh(t *testing.T) {
+	var fetchErr error
+	p := &polledManifests{name: "test", fetch: func() (*CatalogManifests, error) {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return &CatalogManifests{ConfigMaps: []v1.ConfigMap{catalogConfigMap("a", `{"team":"api","offering":"x","uuid":"1"}`)}}, nil
+	}}
+	changes := 0
+	p.OnChange(func(string) { changes++ })
+	if entries, _, err := p.Load(); err != nil || len(entries) != 1 {
+		t.Fatalf("expected the entry, got %v %v", entries, err)
+	}
+
+	// the manifests last read are still offered, with the failure to report
+	fetchErr = errors.New("unreachable")
+	p.refresh()
+	if entries, _, err := p.Load(); err == nil || len(entries) != 1 {
+		t.Errorf("expected the entry with the failure, got %v %v", entries, err)
+	}
+	fetchErr = nil
+	p.refresh()
+	if _, _, err := p.Load(); err != nil {
+		t.Errorf("expected the failure to clear, got %s", err)
+	}
+	if changes != 2 {
+		t.Errorf("expected the failure and its end to be announced, got %d changes", changes)
+	}
+}
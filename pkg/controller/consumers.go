@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Instances of ProvisionExistingClusterService entries share a Service
+// that the providing team runs. The consumers of each such Service are kept
+// in an index, so the team can see which namespaces depend on it before
+// changing or retiring it.
+
+// A Service in the cluster and the namespaces consuming it
+type SharedService struct {
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	Consumers []Consumer `json:"consumers"`
+}
+
+// A namespace consuming a shared Service, through one or more instances
+type Consumer struct {
+	Namespace string   `json:"namespace"`
+	Instances []string `json:"instances"`
+	Bindings  int      `json:"bindings"`
+}
+
+// The consumers of shared Services
+type ConsumerRegistry interface {
+	SharedServices() ([]SharedService, error)
+	SharedService(namespace, name string) (*SharedService, error)
+}
+
+// ListSharedServices lists every shared Service with instances
+func ListSharedServices(s Storage) ([]SharedService, error) {
+	members, err := s.SMembers(sharedServicesIndex)
+	if err != nil {
+		glog.Errorf("Failed to list shared services: %s", err)
+		return nil, err
+	}
+	services := make([]SharedService, 0, len(members))
+	for _, member := range members {
+		parts, err := splitIndexMember(member, 2)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ServiceConsumers(s, parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(shared.Consumers) > 0 {
+			services = append(services, *shared)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	return services, nil
+}
+
+// ServiceConsumers lists the consumers of one shared Service, with their
+// instances in order, none if it has no instances
+func ServiceConsumers(s Storage, namespace, name string) (*SharedService, error) {
+	members, err := s.SMembers(indexKey(consumersIndex, namespace, name))
+	if err != nil {
+		glog.Errorf("Failed to list consumers of %s/%s: %s", namespace, name, err)
+		return nil, err
+	}
+
+	// members are <consumer namespace>/<instance id>
+	byNamespace := make(map[string]*Consumer, 0)
+	for _, member := range members {
+		parts, err := splitIndexMember(member, 2)
+		if err != nil {
+			glog.Warningf("Ignoring consumer of %s/%s: %s", namespace, name, err)
+			continue
+		}
+		c := byNamespace[parts[0]]
+		if c == nil {
+			c = &Consumer{Namespace: parts[0], Instances: []string{}}
+			byNamespace[parts[0]] = c
+		}
+		bindings, err := CountBindings(s, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		c.Instances = append(c.Instances, parts[1])
+		c.Bindings += bindings
+	}
+
+	shared := &SharedService{Namespace: namespace, Name: name, Consumers: make([]Consumer, 0, len(byNamespace))}
+	for _, c := range byNamespace {
+		sort.Strings(c.Instances)
+		shared.Consumers = append(shared.Consumers, *c)
+	}
+	sort.Slice(shared.Consumers, func(i, j int) bool { return shared.Consumers[i].Namespace < shared.Consumers[j].Namespace })
+	return shared, nil
+}
+
+func (c *ProductionController) SharedServices() ([]SharedService, error) {
+	c.rwMutex.RLock()
+	defer c.rwMutex.RUnlock()
+	return ListSharedServices(c.Storage)
+}
+
+func (c *ProductionController) SharedService(namespace, name string) (*SharedService, error) {
+	c.rwMutex.RLock()
+	defer c.rwMutex.RUnlock()
+	return ServiceConsumers(c.Storage, namespace, name)
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSharedServices(t *testing.T) {
+	s := NewMemStorage()
+	cache := Entry{Team: "infra", Offering: "cache", UUID: "1", ProvisionExistingClusterService: &ProvisionExistingClusterService{Namespace: "infra", Name: "redis"}}
+	// another offering of the same Service
+	readonly := Entry{Team: "infra", Offering: "cache-readonly", UUID: "2", ProvisionExistingClusterService: &ProvisionExistingClusterService{Namespace: "infra", Name: "redis"}}
+	queue := Entry{Team: "infra", Offering: "queue", UUID: "3", ProvisionExistingClusterService: &ProvisionExistingClusterService{Namespace: "infra", Name: "rabbit"}}
+
+	for _, i := range []*Instance{
+		{Entry: cache, InstanceID: "a", ConsumerNamespace: "web"},
+		{Entry: readonly, InstanceID: "b", ConsumerNamespace: "web"},
+		{Entry: cache, InstanceID: "c", ConsumerNamespace: "api"},
+		{Entry: queue, InstanceID: "d", ConsumerNamespace: "api"},
+	} {
+		if err := SaveInstance(s, i.InstanceID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	instance, _ := LoadInstance(s, "a")
+	if err := SaveBinding(s, "x", &Binding{Instance: instance, BindingID: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SharedService{
+		{Namespace: "infra", Name: "rabbit", Consumers: []Consumer{{Namespace: "api", Instances: []string{"d"}}}},
+		{Namespace: "infra", Name: "redis", Consumers: []Consumer{
+			{Namespace: "api", Instances: []string{"c"}},
+			{Namespace: "web", Instances: []string{"a", "b"}, Bindings: 1},
+		}},
+	}
+	services, err := ListSharedServices(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("expected %v, got %v", expected, services)
+	}
+
+	if err := DeleteInstance(s, "c"); err != nil {
+		t.Fatal(err)
+	}
+	redis, err := ServiceConsumers(s, "infra", "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(redis.Consumers) != 1 || redis.Consumers[0].Namespace != "web" {
+		t.Errorf("expected only web to consume redis, got %v", redis.Consumers)
+	}
+
+	// a Service leaves the registry with its last consumer
+	if err := DeleteInstance(s, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := s.SMembers(sharedServicesIndex); !reflect.DeepEqual(members, []string{"infra/redis"}) {
+		t.Errorf("expected only infra/redis to have consumers, got %v", members)
+	}
+}
@@ -2,10 +2,15 @@ package controller
 
 import (
 	"errors"
+	"net/http"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
+	"k8s.io/api/core/v1"
 )
 
 type Controller interface {
@@ -19,27 +24,270 @@ type Controller interface {
 	UnBind(instanceID, bindingID, serviceID, planID string) error
 }
 
+// Update of an instance, which brokerapi does not describe
+type InstanceUpdater interface {
+	UpdateServiceInstance(instanceID string, req *UpdateServiceInstanceRequest) (*UpdateServiceInstanceResponse, error)
+}
+
+type UpdateServiceInstanceRequest struct {
+	ServiceID         string                   `json:"service_id"`
+	PlanID            string                   `json:"plan_id,omitempty"`
+	Parameters        map[string]interface{}   `json:"parameters,omitempty"`
+	AcceptsIncomplete bool                     `json:"accepts_incomplete,omitempty"`
+	ContextProfile    brokerapi.ContextProfile `json:"context,omitempty"`
+}
+
+type UpdateServiceInstanceResponse struct {
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+}
+
+// Admin operations used by providers, not by Service Catalog
+type Admin interface {
+	Export() (*Archive, error)
+	Import(archive *Archive, overwrite bool) (int, error)
+}
+
+// Readiness of the broker to serve requests
+type ReadinessChecker interface {
+	Ready() error
+}
+
 type ProductionController struct {
 	rwMutex sync.RWMutex
 	Storage Storage
 	Kube    Kube
+	Options ControllerOptions
+	Sources []CatalogSource
+
+	// parsed catalog, nil until first loaded and after any catalog change
+	catalog         *[]Entry
+	catalogProblems ValidationErrors
+	catalogMutex    sync.Mutex
+	relistTimer     *time.Timer
+	// entries each source last loaded, offered while it fails
+	sourceCatalogs map[string]*sourceCatalog
+	// set while a source fails with nothing loaded before to offer,
+	// apart from catalogMutex so readiness never waits for a load
+	catalogError      error
+	catalogErrorMutex sync.Mutex
+
+	sweeper sweeper
+	// instances in the middle of an operation, which may let go of rwMutex
+	// while hooks run, and how many operations hold each
+	busy map[string]int
+	// instances being provisioned, counted toward quota until saved
+	provisioning map[string]PendingInstance
 }
 
 type ControllerOptions struct {
-	StorageType          string
-	StorageRedisAddress  string
-	StorageRedisPassword string
-	StorageRedisDatabase string
-	BrokerName           string
-	BrokerNamespace      string
+	BrokerName      string
+	BrokerNamespace string
+	Tmpdir          string
+	// ClusterServiceBroker to ask to relist when the catalog changes, none if empty
+	ServiceBrokerName string
+	// sources of the catalog in order of precedence, highest first. A
+	// KubeCatalogSource without a Kube reads the broker namespace, which
+	// comes first when not listed
+	CatalogSources []CatalogSource
+	// limits applied to every entry, with those of the entry
+	Quota Quota
+	// finding objects left by instances the broker no longer knows
+	Sweeper SweeperOptions
+	// finding and correcting drift in provisioned objects
+	Reconciler ReconcilerOptions
+	// deprovisioning instances past their lifetime
+	Expirer ExpirerOptions
+	// running hook Jobs
+	Hooks HookOptions
 }
 
-func CreateProductionController(brokerName, brokerNamespace string, storage Storage, tmpdir string) Controller {
+// catalog changes often arrive in bursts, relist once they settle
+const relistDelay = 5 * time.Second
+
+func CreateProductionController(options ControllerOptions, storage Storage) (*ProductionController, error) {
+
+	kube, err := NewRealKube(options.BrokerNamespace, options.Tmpdir)
+	if err != nil {
+		return nil, err
+	}
 
-	return &ProductionController{
-		Kube:    &RealKube{Tmpdir: tmpdir, Namespace: brokerNamespace},
+	c := &ProductionController{
+		Kube:    kube,
 		Storage: storage,
+		Options: options,
+		Sources: catalogSources(kube, options.CatalogSources),
+	}
+	for _, source := range c.Sources {
+		if watcher, ok := source.(CatalogWatcher); ok {
+			watcher.OnChange(c.catalogChanged)
+		}
+	}
+
+	// state written before quotas were counted has no index
+	if err := RebuildIndexes(storage); err != nil {
+		glog.Errorf("Failed to rebuild storage indexes: %s", err)
+		return nil, err
+	}
+	return c, nil
+}
+
+func catalogSources(kube Kube, configured []CatalogSource) []CatalogSource {
+	sources := make([]CatalogSource, 0, len(configured)+1)
+	namespace := false
+	for _, source := range configured {
+		if k, ok := source.(*KubeCatalogSource); ok && k.Kube == nil {
+			source = &KubeCatalogSource{Kube: kube}
+			namespace = true
+		}
+		sources = append(sources, source)
+	}
+	if !namespace {
+		sources = append([]CatalogSource{&KubeCatalogSource{Kube: kube}}, sources...)
+	}
+	return sources
+}
+
+// Run starts the catalog cache and any catalog sources that poll, and
+// blocks until stop is closed
+func (c *ProductionController) Run(stop <-chan struct{}) error {
+	if k, ok := c.Kube.(*RealKube); ok {
+		if err := k.StartCache(stop); err != nil {
+			glog.Errorf("Failed to start catalog cache: %s", err)
+			return err
+		}
+	}
+	for _, source := range c.Sources {
+		if runner, ok := source.(CatalogRunner); ok {
+			go func(source CatalogSource) {
+				if err := runner.Run(stop); err != nil {
+					glog.Errorf("Catalog source %s stopped: %s", source.Name(), err)
+				}
+			}(source)
+		}
+	}
+	if c.Options.Sweeper.Interval > 0 {
+		go c.runSweeper(stop)
+	}
+	if c.Options.Reconciler.Interval > 0 {
+		go c.runReconciler(stop)
+	}
+	if c.Options.Expirer.Interval > 0 {
+		go c.runExpirer(stop)
+	}
+	<-stop
+	return nil
+}
+
+// catalogChanged reloads the catalog, asking Service Catalog to relist
+// when the offered entries differ
+func (c *ProductionController) catalogChanged(origin string) {
+	glog.Infof("Catalog source %s changed, reloading catalog", origin)
+
+	c.catalogMutex.Lock()
+	previous := c.catalog
+	c.catalog = nil
+	c.catalogMutex.Unlock()
+
+	catalog, err := c.loadCatalog()
+	if err != nil {
+		glog.Errorf("Failed to reload catalog: %s", err)
+		return
+	}
+	c.refreshCatalogStatus()
+
+	if previous != nil && reflect.DeepEqual(*previous, *catalog) {
+		return
+	}
+	c.relist()
+}
+
+func (c *ProductionController) relist() {
+	if c.Options.ServiceBrokerName == "" {
+		return
+	}
+
+	c.catalogMutex.Lock()
+	defer c.catalogMutex.Unlock()
+	if c.relistTimer != nil {
+		c.relistTimer.Stop()
+	}
+	c.relistTimer = time.AfterFunc(relistDelay, func() {
+		c.Kube.RelistServiceBroker(c.Options.ServiceBrokerName)
+	})
+}
+
+// refreshCatalogStatus updates CatalogEntry status in the background, once
+// the caller has released the controller
+func (c *ProductionController) refreshCatalogStatus() {
+	go func() {
+		c.rwMutex.RLock()
+		defer c.rwMutex.RUnlock()
+
+		c.catalogMutex.Lock()
+		problems := c.catalogProblems
+		c.catalogMutex.Unlock()
+
+		if err := UpdateCatalogEntryStatus(c.Kube, c.Storage, problems); err != nil {
+			glog.Errorf("Failed to update CatalogEntry status: %s", err)
+		}
+	}()
+}
+
+func findEntry(catalog *[]Entry, uuid string) *Entry {
+	for i := range *catalog {
+		if (*catalog)[i].UUID == uuid {
+			return &(*catalog)[i]
+		}
+	}
+	return nil
+}
+
+// loadCatalog returns the parsed catalog, loading it only when it has
+// changed since it was last loaded
+func (c *ProductionController) loadCatalog() (*[]Entry, error) {
+	c.catalogMutex.Lock()
+	defer c.catalogMutex.Unlock()
+
+	if c.catalog != nil {
+		return c.catalog, nil
+	}
+
+	if c.sourceCatalogs == nil {
+		c.sourceCatalogs = make(map[string]*sourceCatalog)
+	}
+	catalog, problems, err := LoadCatalogFromSources(c.Sources, c.sourceCatalogs)
+	var catalogError error
+	if err != nil {
+		glog.Errorf("Catalog incomplete: %s", err)
+		ref := &v1.ObjectReference{Kind: "Namespace", APIVersion: "v1", Name: c.Kube.BrokerNamespace()}
+		if err := c.Kube.RecordEvent(ref, v1.EventTypeWarning, "CatalogSourceFailed", err.Error()); err != nil {
+			glog.Errorf("Failed to record catalog event: %s", err)
+		}
+		if se, ok := err.(*catalogSourceError); ok && se.missing {
+			catalogError = err
+		}
+	}
+	c.catalogErrorMutex.Lock()
+	c.catalogError = catalogError
+	c.catalogErrorMutex.Unlock()
+	if err != nil && len(*catalog) == 0 {
+		return nil, err
+	}
+	c.catalogProblems = problems
+
+	// TODO logging each entry should be debug
+	glog.Infof("Catalog loaded: %s", catalog)
+	for i := range *catalog {
+		glog.Infof("Entry: %s", (*catalog)[i].String())
 	}
+
+	// without change notifications every call must load again, and so
+	// must every call while a source fails
+	if k, ok := c.Kube.(*RealKube); ok && k.CacheSynced() && err == nil {
+		c.catalog = catalog
+	}
+	return catalog, nil
 }
 
 func (c *ProductionController) Catalog() (*brokerapi.Catalog, error) {
@@ -51,18 +299,9 @@ func (c *ProductionController) Catalog() (*brokerapi.Catalog, error) {
 	var catalog *[]Entry
 	var err error
 
-	if catalog, err = LoadCatalogFromConfigMaps(c.Kube); err != nil {
+	if catalog, err = c.loadCatalog(); err != nil {
 		glog.Errorf("Failed to load catalog: %s", err)
-		return &brokerapi.Catalog{}, nil
-	}
-
-	glog.Infof("Catalog loaded: %s", catalog)
-	// TODO logging each entry should be debug
-	// TODO is it unnecessary to point to the entry
-	var entry *Entry
-	for i := len(*catalog) - 1; i >= 0; i-- {
-		entry = &(*catalog)[i]
-		glog.Infof("Entry: %s", entry.String())
+		return nil, NewBrokerError(http.StatusServiceUnavailable, "", "The catalog could not be loaded: %s", err)
 	}
 
 	services := make([]*brokerapi.Service, 0)
@@ -76,11 +315,18 @@ func (c *ProductionController) Catalog() (*brokerapi.Catalog, error) {
 				ID:          s.UUID,
 				Description: s.planDescription(),
 				Free:        true,
+				Schemas:     s.planSchemas(),
 			},
 			},
 			Bindable:       true,
 			PlanUpdateable: true,
 		}
+		if s.Revision != "" {
+			service.Metadata = map[string]interface{}{
+				"origin":   s.Origin,
+				"revision": s.Revision,
+			}
+		}
 		services = append(services, service)
 	}
 	bc := &brokerapi.Catalog{Services: services}
@@ -107,6 +353,10 @@ func (c *ProductionController) CreateServiceInstance(id string, req *brokerapi.C
 	c.rwMutex.Lock()
 	defer c.rwMutex.Unlock()
 
+	if err := c.checkNotBusy(id); err != nil {
+		return nil, err
+	}
+
 	if InstanceExists(c.Storage, id) {
 		glog.Infof("Instance %s already exists, returning\n", id)
 		return &brokerapi.CreateServiceInstanceResponse{}, nil
@@ -115,29 +365,14 @@ func (c *ProductionController) CreateServiceInstance(id string, req *brokerapi.C
 	var catalog *[]Entry
 	var err error
 
-	if catalog, err = LoadCatalogFromConfigMaps(c.Kube); err != nil {
+	if catalog, err = c.loadCatalog(); err != nil {
 		glog.Errorf("Failed to load catalog: %s", err)
 		return nil, err
 	}
 
-	// TODO make debug
-	// TODO use range?
-	glog.Infof("Catalog loaded: %s", catalog)
-	var entry *Entry
-	for i := len(*catalog) - 1; i >= 0; i-- {
-		entry = &(*catalog)[i]
-		glog.Infof("Entry: %s", entry.String())
-	}
-
-	// TODO use range?
 	// check on the plan and service. do those exist? if not exist, return error
-	for i := len(*catalog) - 1; i >= 0; i-- {
-		entry = &(*catalog)[i]
-		if entry.UUID == req.PlanID {
-			break
-		}
-	}
-	if entry.UUID != req.PlanID {
+	entry := findEntry(catalog, req.PlanID)
+	if entry == nil {
 		glog.Errorf("CreateServiceInstance %s for plan %s rejected, no matching plan.", id, req.PlanID)
 		return nil, errors.New("No matching plan.")
 	}
@@ -145,44 +380,149 @@ func (c *ProductionController) CreateServiceInstance(id string, req *brokerapi.C
 	// TODO debug
 	glog.Infof("Found matching catalog entry: %s", entry.String())
 
-	// does the calling namespace exist in the whitelist for the given service and plan.
-	// if no, return error
+	// is the calling namespace allowed the given service and plan
 	callerNamespace := req.ContextProfile.Namespace
-	allowed := false
-	for _, n := range entry.Whitelist {
-		if n == callerNamespace {
-			allowed = true
-		}
+	if err := c.checkProvision(id, entry, callerNamespace, req.ContextProfile.Platform, req.Parameters); err != nil {
+		glog.Errorf("CreateServiceInstance %s for plan %s rejected: %s", id, req.PlanID, err)
+		return nil, err
 	}
-	// TODO make the same error message
-	if !allowed {
-		glog.Errorf("CreateServiceInstance %s for plan %s rejected, namespace %s not in whitelist %s", id, req.PlanID, req.ContextProfile.Namespace, entry.Whitelist)
-		return nil, errors.New("Namespace not in whitelist.")
+
+	if entry.RequiresApproval {
+		return c.requestApproval(id, entry, req)
 	}
-	glog.Infof("Provisioning Service Instance from: %s", entry.String())
 
-	var instance *Instance
+	if err := c.provision(id, entry, callerNamespace, req.Parameters); err != nil {
+		return nil, err
+	}
+	return &brokerapi.CreateServiceInstanceResponse{}, nil
+}
 
-	instance, err = entry.Provision(c.Kube, id)
+// checkProvision checks a provision of the entry against its schemas,
+// access rules, policies and quota
+func (c *ProductionController) checkProvision(id string, entry *Entry, namespace, platform string, parameters map[string]interface{}) error {
+	if err := entry.CheckParameters(OperationProvision, parameters); err != nil {
+		return err
+	}
+	if err := entry.CheckAccess(c.Kube, namespace); err != nil {
+		return err
+	}
+	if err := entry.CheckPolicies(c.Kube, c.Storage, &PolicyRequest{
+		Operation:  OperationProvision,
+		Namespace:  namespace,
+		Platform:   platform,
+		Parameters: parameters,
+	}); err != nil {
+		return err
+	}
+	return c.checkProvisionQuota(entry, namespace, id)
+}
+
+// provision creates and saves an instance of the entry
+func (c *ProductionController) provision(id string, entry *Entry, namespace string, parameters map[string]interface{}) error {
+	// hooks let go of the lock, so until it is saved the instance is
+	// marked busy and counted toward quota
+	defer c.markBusy(id)()
+	defer c.reserveQuota(id, entry, namespace)()
+
+	prerequisites, release, err := c.provisionPrerequisites(id, entry, namespace)
+	if err != nil {
+		glog.Errorf("Provisioning prerequisites of %s failed: %s", id, err)
+		return err
+	}
+	defer release()
+	// the prerequisites are let go before those created are torn down
+	rollback := func() {
+		release()
+		c.deprovisionPrerequisites(id, prerequisites)
+	}
+	dependencies, err := c.dependencyValues(prerequisites)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	values := &TemplateValues{
+		InstanceID:   id,
+		Namespace:    namespace,
+		Parameters:   parameters,
+		Dependencies: dependencies,
+	}
+	if err := c.runHook(HookPreProvision, entry, values); err != nil {
+		rollback()
+		return err
+	}
+	// others were served while hooks ran
+	if err := c.recheckProvision(id, entry, namespace); err != nil {
+		glog.Errorf("Provisioning %s rejected: %s", id, err)
+		rollback()
+		return err
+	}
+
+	glog.Infof("Provisioning Service Instance from: %s", entry.String())
 
+	instance, err := entry.Provision(c.Kube, id, values)
 	if err != nil {
 		glog.Errorf("Provisioning failed %s: %s", id, err)
-		return nil, err
+		rollback()
+		return err
+	}
+	if err := c.runHook(HookPostProvision, entry, values); err != nil {
+		glog.Errorf("Rolling back provisioning of %s: %s", id, err)
+		instance.Deprovision(c.Kube)
+		rollback()
+		return err
 	}
+	instance.ConsumerNamespace = namespace
+	instance.Parameters = parameters
+	instance.Prerequisites = prerequisites
+	instance.Created = time.Now()
 
 	// TODO better to save the instance first, then update after provisioning
-	err = SaveInstance(c.Storage, id, instance)
-	if err != nil {
+	if err := SaveInstance(c.Storage, id, instance); err != nil {
 		glog.Errorf("Failed to save instance %s: %s", id, err)
-		return nil, err
+		return err
 	}
 
-	return &brokerapi.CreateServiceInstanceResponse{}, nil
+	c.refreshCatalogStatus()
+	return nil
+}
+
+// recheckProvision repeats, for an instance being provisioned, the checks
+// made before the lock was let go
+func (c *ProductionController) recheckProvision(id string, entry *Entry, namespace string) error {
+	if InstanceExists(c.Storage, id) {
+		return NewBrokerError(http.StatusConflict, "", "Instance %s was created by another request.", id)
+	}
+	return c.checkProvisionQuota(entry, namespace, id)
 }
 
-// unclear under what circumstances this gets called
+// GetServiceInstanceLastOperation reports on a provision awaiting approval,
+// moving it on when the provider has decided
 func (c *ProductionController) GetServiceInstanceLastOperation(instanceID, serviceID, planID, operation string) (*brokerapi.LastOperationResponse, error) {
-	return nil, errors.New("Unimplemented")
+	// GetServiceInstanceLastOperation() may be called concurrently
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+
+	// an approved provision may be waiting on its hooks
+	if c.busy[instanceID] > 0 {
+		return &brokerapi.LastOperationResponse{State: brokerapi.StateInProgress}, nil
+	}
+
+	op, err := LoadOperation(c.Storage, instanceID)
+	if err != nil {
+		if InstanceExists(c.Storage, instanceID) {
+			return &brokerapi.LastOperationResponse{State: brokerapi.StateSucceeded}, nil
+		}
+		return nil, NewBrokerError(http.StatusGone, "", "No operation on instance %s.", instanceID)
+	}
+
+	if op.State == brokerapi.StateInProgress {
+		if err := c.progressApproval(op); err != nil {
+			glog.Errorf("Failed to check approval of instance %s: %s", instanceID, err)
+			return nil, err
+		}
+	}
+	return &brokerapi.LastOperationResponse{State: op.State, Description: op.Description}, nil
 }
 
 func (c *ProductionController) RemoveServiceInstance(instanceID, serviceID, planID string, acceptsIncomplete bool) (*brokerapi.DeleteServiceInstanceResponse, error) {
@@ -190,22 +530,61 @@ func (c *ProductionController) RemoveServiceInstance(instanceID, serviceID, plan
 	c.rwMutex.Lock()
 	defer c.rwMutex.Unlock()
 
+	if err := c.checkNotBusy(instanceID); err != nil {
+		return nil, err
+	}
+	defer c.markBusy(instanceID)()
+
+	// instances other instances depend on go after them
+	if dependents, err := Dependents(c.Storage, instanceID); err == nil && len(dependents) > 0 {
+		glog.Errorf("RemoveServiceInstance %s rejected, required by %s", instanceID, strings.Join(dependents, ", "))
+		return nil, NewBrokerError(http.StatusUnprocessableEntity, "", "Instance %s is required by instances %s, deprovision them first.", instanceID, strings.Join(dependents, ", "))
+	}
+
 	// if the instance exists, delete any provisioned resources
 	instance, err := LoadInstance(c.Storage, instanceID)
 	if err == nil {
-		instance.Deprovision(c.Kube)
+		var values *TemplateValues
+		entry := c.currentEntry(instance)
+		if instance.Expired == nil {
+			if values, err = c.instanceValues(instance); err != nil {
+				return nil, err
+			}
+			if err := c.runHook(HookPreDeprovision, entry, values); err != nil {
+				return nil, err
+			}
+		}
+		c.deprovision(instance)
+		if values != nil {
+			c.runHook(HookPostDeprovision, entry, values)
+		}
 	} else {
 		glog.Errorf("Unable to find provisioned objects!")
+		if err := DeleteInstance(c.Storage, instanceID); err != nil {
+			glog.Errorf("Failed to delete instance %s in storage: %s", instanceID, err)
+		}
 	}
+	c.cancelApproval(instanceID)
 
-	err = DeleteInstance(c.Storage, instanceID)
-	if err != nil {
-		glog.Errorf("Failed to delete instance %s in storage: %s", instanceID, err)
-	}
-
+	c.refreshCatalogStatus()
 	return &brokerapi.DeleteServiceInstanceResponse{}, nil
 }
 
+// deprovision deletes the resources and record of an instance, then the
+// prerequisites created for it
+func (c *ProductionController) deprovision(instance *Instance) {
+	// the resources of an expired instance are already gone
+	if instance.Expired == nil {
+		instance.Deprovision(c.Kube)
+	}
+	if err := DeleteInstance(c.Storage, instance.InstanceID); err != nil {
+		glog.Errorf("Failed to delete instance %s in storage: %s", instance.InstanceID, err)
+	}
+	if instance.Expired == nil {
+		c.deprovisionPrerequisites(instance.InstanceID, instance.Prerequisites)
+	}
+}
+
 /*
 Bind gets called with the instanceID, bindingID and
 
@@ -227,6 +606,11 @@ func (c *ProductionController) Bind(instanceID, bindingID string, req *brokerapi
 	c.rwMutex.Lock()
 	defer c.rwMutex.Unlock()
 
+	if err := c.checkNotBusy(instanceID); err != nil {
+		return nil, err
+	}
+	defer c.markBusy(instanceID)()
+
 	// if bindingID exists, return prior binding data
 	// TODO do a BindingExists
 	if BindingExists(c.Storage, bindingID) {
@@ -248,15 +632,36 @@ func (c *ProductionController) Bind(instanceID, bindingID string, req *brokerapi
 	glog.Infof("Retrieved instance to bind:", instance.String())
 	glog.Infof("Retrieved entry from instance:", instance.Entry.String())
 
+	if err := instance.checkNotExpired(); err != nil {
+		glog.Errorf("Bind %s to instance %s rejected: %s", bindingID, instanceID, err)
+		return nil, err
+	}
+	if err := c.checkBindAccess(instance, req); err != nil {
+		glog.Errorf("Bind %s to instance %s rejected: %s", bindingID, instanceID, err)
+		return nil, err
+	}
+
+	values, err := c.instanceValues(instance)
+	if err != nil {
+		glog.Errorf("Failed to read prerequisites, binding %s failed: %s", bindingID, err)
+		return nil, err
+	}
+	values.BindingID = bindingID
+	values.BindParameters = req.Parameters
+	entry := c.currentEntry(instance)
+	if err := c.runHook(HookPreBind, entry, values); err != nil {
+		return nil, err
+	}
+
 	// retrieve credentials as specified in catalog entry
-	creds, err := instance.Entry.Credential(c.Kube)
+	creds, err := instance.Entry.Credential(c.Kube, values)
 	if err != nil {
 		glog.Errorf("Failed to properly retrieve credential, binding %s failed: %s", bindingID, err)
 		return nil, err
 	}
 
 	// retrieve provisioned coordinates
-	coords, err := instance.Coordinates()
+	coords, err := c.instanceCoordinates(instance)
 	if err != nil {
 		glog.Errorf("Failed to properly retrieve coordinates, binding %s failed: %s", bindingID, err)
 		return nil, err
@@ -264,7 +669,7 @@ func (c *ProductionController) Bind(instanceID, bindingID string, req *brokerapi
 
 	// merge credentials and coordinates into the brokerapi.Credential map
 	// TODO notice if there is overlap of keys
-	var cred brokerapi.Credential
+	cred := brokerapi.Credential{}
 	for k, v := range creds {
 		cred[k] = v
 	}
@@ -272,30 +677,271 @@ func (c *ProductionController) Bind(instanceID, bindingID string, req *brokerapi
 		cred[k] = v
 	}
 
+	// a failed postbind hook leaves no binding behind, so the unbind hooks
+	// undo what the bind hooks did
+	if err := c.runHook(HookPostBind, entry, values); err != nil {
+		c.unbind(bindingID, entry, values)
+		return nil, err
+	}
+
+	// a bind is a use, for instances that expire when idle
+	instance.LastUsed = time.Now()
+	if err := SaveInstance(c.Storage, instanceID, instance); err != nil {
+		glog.Errorf("Failed to save instance %s: %s", instanceID, err)
+	}
+
 	glog.Infof("Creating Binding: %s", bindingID)
 	binding := &Binding{instance, bindingID, cred}
 	if err := SaveBinding(c.Storage, bindingID, binding); err != nil {
 		glog.Errorf("Failed to save Binding %s: %s", bindingID, err)
 	}
 
+	c.refreshCatalogStatus()
 	return &brokerapi.CreateServiceBindingResponse{Credentials: cred}, nil
 }
 
+// currentEntry is the entry of the instance as it is now, or as it was
+// when provisioned if it has left the catalog
+func (c *ProductionController) currentEntry(instance *Instance) *Entry {
+	if catalog, err := c.loadCatalog(); err == nil {
+		if current := findEntry(catalog, instance.UUID); current != nil {
+			return current
+		}
+	}
+	entry := &instance.Entry
+	if entry.source == nil {
+		entry.source = c.sourceNamed(entry.Source)
+	}
+	return entry
+}
+
+// sourceNamed is the catalog source of a name, nil if none is configured
+func (c *ProductionController) sourceNamed(name string) CatalogSource {
+	for _, source := range c.Sources {
+		if source.Name() == name {
+			return source
+		}
+	}
+	return nil
+}
+
+// instanceValues are what templates and hooks of an instance see
+func (c *ProductionController) instanceValues(instance *Instance) (*TemplateValues, error) {
+	dependencies, err := c.dependencyValues(instance.Prerequisites)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateValues{
+		InstanceID:   instance.InstanceID,
+		Namespace:    instance.ConsumerNamespace,
+		Parameters:   instance.Parameters,
+		Dependencies: dependencies,
+	}, nil
+}
+
+// checkBindAccess applies the bind schema, access rules, policies and quota
+// of the current entry to the namespace of the instance. Instances provisioned before
+// namespaces were recorded are not checked for access.
+func (c *ProductionController) checkBindAccess(instance *Instance, req *brokerapi.BindingRequest) error {
+	entry := c.currentEntry(instance)
+	if err := entry.CheckParameters(OperationBind, req.Parameters); err != nil {
+		return err
+	}
+	if instance.ConsumerNamespace == "" {
+		glog.Warningf("Instance %s has no consumer namespace, not checking access", instance.InstanceID)
+	} else if err := entry.CheckAccess(c.Kube, instance.ConsumerNamespace); err != nil {
+		return err
+	}
+
+	if err := entry.CheckPolicies(c.Kube, c.Storage, &PolicyRequest{
+		Operation:  OperationBind,
+		Namespace:  instance.ConsumerNamespace,
+		Parameters: req.Parameters,
+		InstanceID: instance.InstanceID,
+	}); err != nil {
+		return err
+	}
+	return entry.CheckBindQuota(c.Storage, c.Options.Quota, instance.InstanceID)
+}
+
+/*
+UpdateServiceInstance changes the parameters of an instance. Entries offer
+a single plan, so the plan may not change. The instance is not provisioned
+again, the parameters are recorded for later operations.
+*/
+func (c *ProductionController) UpdateServiceInstance(instanceID string, req *UpdateServiceInstanceRequest) (*UpdateServiceInstanceResponse, error) {
+	// UpdateServiceInstance() may be called concurrently
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+
+	if err := c.checkNotBusy(instanceID); err != nil {
+		return nil, err
+	}
+
+	instance, err := LoadInstance(c.Storage, instanceID)
+	if err != nil {
+		glog.Errorf("No instance %s to update: %s", instanceID, err)
+		return nil, NewBrokerError(http.StatusBadRequest, "", "No instance %s.", instanceID)
+	}
+	if req.PlanID != "" && req.PlanID != instance.UUID {
+		glog.Errorf("UpdateServiceInstance %s to plan %s rejected, plan cannot change.", instanceID, req.PlanID)
+		return nil, NewBrokerError(http.StatusBadRequest, "", "Plan of service %s cannot change.", instance.serviceName())
+	}
+	if err := instance.checkNotExpired(); err != nil {
+		glog.Errorf("UpdateServiceInstance %s rejected: %s", instanceID, err)
+		return nil, err
+	}
+
+	namespace := instance.ConsumerNamespace
+	if namespace == "" {
+		namespace = req.ContextProfile.Namespace
+	}
+	entry := c.currentEntry(instance)
+	if err := entry.CheckParameters(OperationUpdate, req.Parameters); err != nil {
+		glog.Errorf("UpdateServiceInstance %s rejected: %s", instanceID, err)
+		return nil, err
+	}
+	if err := entry.CheckAccess(c.Kube, namespace); err != nil {
+		glog.Errorf("UpdateServiceInstance %s rejected: %s", instanceID, err)
+		return nil, err
+	}
+
+	// policies see the parameters the instance would have
+	parameters := make(map[string]interface{}, 0)
+	for k, v := range instance.Parameters {
+		parameters[k] = v
+	}
+	for k, v := range req.Parameters {
+		parameters[k] = v
+	}
+	if err := entry.CheckPolicies(c.Kube, c.Storage, &PolicyRequest{
+		Operation:  OperationUpdate,
+		Namespace:  namespace,
+		Platform:   req.ContextProfile.Platform,
+		Parameters: parameters,
+		InstanceID: instanceID,
+	}); err != nil {
+		glog.Errorf("UpdateServiceInstance %s rejected: %s", instanceID, err)
+		return nil, err
+	}
+
+	instance.ConsumerNamespace = namespace
+	instance.Parameters = parameters
+
+	// objects rendered from the parameters are patched to match
+	if p := instance.Entry.ProvisionNewClusterObjects; p != nil && instance.ResourcesKubeObjectList != nil {
+		values, err := c.instanceValues(instance)
+		if err != nil {
+			return nil, err
+		}
+		applied, err := p.Apply(c.Kube, instance, &instance.Entry, values, false)
+		if err != nil {
+			glog.Errorf("UpdateServiceInstance %s failed to apply objects: %s", instanceID, err)
+			return nil, err
+		}
+		instance.CoordinatesClusterURL = applied.CoordinatesClusterURL
+		instance.ResourcesKubeObjectList = applied.ResourcesKubeObjectList
+	}
+
+	instance.LastUsed = time.Now()
+	if err := SaveInstance(c.Storage, instanceID, instance); err != nil {
+		glog.Errorf("Failed to save instance %s: %s", instanceID, err)
+		return nil, err
+	}
+	return &UpdateServiceInstanceResponse{}, nil
+}
+
 func (c *ProductionController) UnBind(instanceID, bindingID, serviceID, planID string) error {
 	// Unbind() may be called concurrently
 	c.rwMutex.Lock()
 	defer c.rwMutex.Unlock()
 
-	if _, err := LoadBinding(c.Storage, bindingID); err == nil {
+	if err := c.checkNotBusy(instanceID); err != nil {
+		return err
+	}
+	defer c.markBusy(instanceID)()
+
+	if binding, err := LoadBinding(c.Storage, bindingID); err == nil {
 		glog.Infof("Binding %s exists, attempt to delete.", bindingID)
-		if err := DeleteBinding(c.Storage, bindingID); err == nil {
-			glog.Infof("Binding %s deleted.", bindingID)
-		} else {
-			glog.Errorf("Error deleting Binding %s: %s", bindingID, err)
+		var entry *Entry
+		var values *TemplateValues
+		if binding.Instance != nil {
+			entry = c.currentEntry(binding.Instance)
+			if values, err = c.instanceValues(binding.Instance); err != nil {
+				return err
+			}
+			values.BindingID = bindingID
 		}
+		if err := c.unbind(bindingID, entry, values); err != nil {
+			return err
+		}
+		c.touchInstance(instanceID)
 	} else {
 		glog.Infof("Binding %s not found, assume already deleted.", bindingID)
 	}
 
+	c.refreshCatalogStatus()
+	return nil
+}
+
+// unbind deletes a binding between the unbind hooks of its instance, which
+// are not run without values. A failed required preunbind hook keeps the
+// binding.
+func (c *ProductionController) unbind(bindingID string, entry *Entry, values *TemplateValues) error {
+	if values != nil {
+		if err := c.runHook(HookPreUnbind, entry, values); err != nil {
+			return err
+		}
+	}
+	if err := DeleteBinding(c.Storage, bindingID); err == nil {
+		glog.Infof("Binding %s deleted.", bindingID)
+	} else {
+		glog.Errorf("Error deleting Binding %s: %s", bindingID, err)
+	}
+	if values != nil {
+		c.runHook(HookPostUnbind, entry, values)
+	}
 	return nil
 }
+
+// touchInstance starts the idle timeout of an instance again
+func (c *ProductionController) touchInstance(instanceID string) {
+	instance, err := LoadInstance(c.Storage, instanceID)
+	if err != nil || instance.Expired != nil {
+		return
+	}
+	instance.LastUsed = time.Now()
+	if err := SaveInstance(c.Storage, instanceID, instance); err != nil {
+		glog.Errorf("Failed to save instance %s: %s", instanceID, err)
+	}
+}
+
+func (c *ProductionController) Export() (*Archive, error) {
+	c.rwMutex.RLock()
+	defer c.rwMutex.RUnlock()
+
+	return ExportArchive(c.Storage)
+}
+
+func (c *ProductionController) Import(archive *Archive, overwrite bool) (int, error) {
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+
+	if len(c.busy) > 0 {
+		return 0, NewBrokerError(http.StatusConflict, "", "Hooks are running, try again once they have finished.")
+	}
+
+	return ImportArchive(c.Storage, archive, overwrite)
+}
+
+func (c *ProductionController) Ready() error {
+	if h, ok := c.Storage.(HealthChecker); ok {
+		if err := h.Healthy(); err != nil {
+			glog.Errorf("Storage is not healthy: %s", err)
+			return err
+		}
+	}
+	c.catalogErrorMutex.Lock()
+	defer c.catalogErrorMutex.Unlock()
+	return c.catalogError
+}
@@ -1,10 +1,11 @@
 package controller
 
 import (
-	"mesitis/pkg/controller"
 	"testing"
 )
 
+var _ Controller = &ProductionController{}
+
 //var _ controller.Controller = &ProductionController{
 //	Namespace: "",
 //	LabelSelector: "",
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// How consumers connect to an entry's instances. Coordinates are derived
+// from the Service provisioned or referenced: URL and Host name the host,
+// Port the chosen port, Port_<name> each named port, Scheme the protocol
+// and URI joins them, ex redis://cache.infra.svc.cluster.local:6379.
+// Templates add coordinates of the provider's own, ex
+// {"JDBC_URL": "jdbc:postgresql://{{ .Host }}:{{ .Port }}/{{ .Parameters.database }}"}
+type Connection struct {
+	// protocol of the service, guessed from the port name or number if empty
+	Scheme string `json:"scheme,omitempty"`
+	// name of the port consumers connect to, the first if empty
+	Port string `json:"port,omitempty"`
+	// further coordinates, as Go templates
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+// schemes of well known port names and numbers
+var portSchemes = map[string]string{
+	"http": "http", "https": "https", "grpc": "grpc", "redis": "redis",
+	"postgres": "postgresql", "postgresql": "postgresql", "mysql": "mysql",
+	"mongodb": "mongodb", "amqp": "amqp", "kafka": "kafka", "nats": "nats",
+	"80": "http", "8080": "http", "443": "https", "8443": "https",
+	"6379": "redis", "5432": "postgresql", "3306": "mysql",
+	"27017": "mongodb", "5672": "amqp", "9092": "kafka", "4222": "nats",
+}
+
+// What coordinate templates can refer to
+type coordinateValues struct {
+	*TemplateValues
+	Host   string
+	Port   string
+	Scheme string
+	URI    string
+	Ports  map[string]string
+}
+
+type Coordinates interface {
+	Coordinates() (map[string]string, error)
+}
+
+func (i *Instance) Coordinates() (map[string]string, error) {
+	var m map[string]string
+	if i.CoordinatesClusterURL != nil {
+		m = i.CoordinatesClusterURL.coordinates(i.Connection)
+	} else if i.CoordinatesExternalURL != nil {
+		m = i.CoordinatesExternalURL.coordinates(i.Connection)
+	} else {
+		glog.Errorln("Unknown coordinates type")
+		return nil, errors.New("Failed to generate coordinates")
+	}
+
+	if i.Connection == nil || len(i.Connection.Templates) == 0 {
+		return m, nil
+	}
+	values := &coordinateValues{
+		TemplateValues: &TemplateValues{InstanceID: i.InstanceID, Namespace: i.ConsumerNamespace, Parameters: i.Parameters},
+		Host:           m["Host"],
+		Port:           m["Port"],
+		Scheme:         m["Scheme"],
+		URI:            m["URI"],
+		Ports:          map[string]string{},
+	}
+	for _, p := range i.portsOf() {
+		if p.Name != "" {
+			values.Ports[p.Name] = strconv.Itoa(int(p.Port))
+		}
+	}
+	// in order, so errors are reported the same way each time
+	keys := make([]string, 0, len(i.Connection.Templates))
+	for k := range i.Connection.Templates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rendered, err := renderTemplate(k, i.Connection.Templates[k], values)
+		if err != nil {
+			glog.Errorf("Failed to render coordinate %s of %s: %s", k, i.serviceName(), err)
+			return nil, err
+		}
+		m[k] = rendered
+	}
+	return m, nil
+}
+
+// instanceCoordinates are the coordinates of an instance as it is now: the
+// connection of its current entry, and the ports its Service has, which may
+// have changed since it was provisioned
+func (c *ProductionController) instanceCoordinates(instance *Instance) (map[string]string, error) {
+	current := *instance
+	current.Connection = c.currentEntry(instance).Connection
+	if cluster := instance.CoordinatesClusterURL; cluster != nil {
+		if namespace, name, ok := cluster.service(); ok {
+			if service, err := c.Kube.GetService(namespace, name); err == nil {
+				current.CoordinatesClusterURL = &CoordinatesClusterURL{URL: cluster.URL, Ports: servicePorts(service)}
+			} else {
+				glog.Warningf("Service %s/%s of instance %s not found, using the ports it had: %s", namespace, name, instance.InstanceID, err)
+			}
+		}
+	}
+	return current.Coordinates()
+}
+
+// service is the namespace and name of the Service the URL names
+func (c *CoordinatesClusterURL) service() (string, string, bool) {
+	parts := strings.Split(strings.TrimSuffix(c.URL, ".svc.cluster.local"), ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || !strings.HasSuffix(c.URL, ".svc.cluster.local") {
+		return "", "", false
+	}
+	return parts[1], parts[0], true
+}
+
+func (i *Instance) portsOf() []CoordinatesPort {
+	if i.CoordinatesClusterURL != nil {
+		return i.CoordinatesClusterURL.Ports
+	}
+	return nil
+}
+
+// choosePort finds the named port, or the first
+func choosePort(ports []CoordinatesPort, name string) *CoordinatesPort {
+	for i := range ports {
+		if name == "" || ports[i].Name == name {
+			return &ports[i]
+		}
+	}
+	return nil
+}
+
+func guessScheme(port *CoordinatesPort) string {
+	if port == nil {
+		return ""
+	}
+	if scheme, ok := portSchemes[port.Name]; ok {
+		return scheme
+	}
+	if scheme, ok := portSchemes[strconv.Itoa(int(port.Port))]; ok {
+		return scheme
+	}
+	if port.Protocol == "UDP" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (c *CoordinatesClusterURL) coordinates(connection *Connection) map[string]string {
+	// URL has always held the bare host
+	m := map[string]string{"URL": c.URL, "Host": c.URL}
+	if connection == nil {
+		connection = &Connection{}
+	}
+
+	for _, p := range c.Ports {
+		if p.Name != "" {
+			m["Port_"+p.Name] = strconv.Itoa(int(p.Port))
+		}
+	}
+	port := choosePort(c.Ports, connection.Port)
+	scheme := connection.Scheme
+	if scheme == "" {
+		scheme = guessScheme(port)
+	}
+	if scheme != "" {
+		m["Scheme"] = scheme
+	}
+	switch {
+	case port != nil:
+		m["Port"] = strconv.Itoa(int(port.Port))
+		m["URI"] = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(c.URL, m["Port"]))
+	case scheme != "":
+		m["URI"] = fmt.Sprintf("%s://%s", scheme, c.URL)
+	}
+	return m
+}
+
+func (c *CoordinatesExternalURL) coordinates(connection *Connection) map[string]string {
+	m := map[string]string{"URL": c.URL}
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		// not a URL, a bare host
+		m["Host"] = c.URL
+		if connection != nil && connection.Scheme != "" {
+			m["Scheme"] = connection.Scheme
+			m["URI"] = fmt.Sprintf("%s://%s", connection.Scheme, c.URL)
+		}
+		return m
+	}
+
+	m["Host"] = u.Hostname()
+	m["Scheme"] = u.Scheme
+	m["URI"] = c.URL
+	if port := u.Port(); port != "" {
+		m["Port"] = port
+	} else if port, ok := map[string]string{"http": "80", "https": "443"}[u.Scheme]; ok {
+		m["Port"] = port
+	}
+	return m
+}
+
+// validateConnection checks the coordinate templates parse
+func (e *Entry) validateConnection() ValidationErrors {
+	errs := ValidationErrors{}
+	if e.Connection == nil {
+		return errs
+	}
+	keys := make([]string, 0, len(e.Connection.Templates))
+	for k := range e.Connection.Templates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := parseTemplate(k, e.Connection.Templates[k]); err != nil {
+			errs = append(errs, ValidationError{e.Origin, "connection.templates." + k, fmt.Sprintf("invalid template: %s", err), SeverityError})
+		}
+	}
+	if e.Connection.Port != "" && e.ProvisionExistingClusterService == nil && e.ProvisionNewClusterObjects == nil {
+		errs = append(errs, ValidationError{e.Origin, "connection.port", "only Services have named ports", SeverityWarning})
+	}
+	return errs
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestCoordinates(t *testing.T) {
+	host := "cache.infra.svc.cluster.local"
+	redis := []CoordinatesPort{{Name: "redis", Port: 6379, Protocol: "TCP"}, {Name: "metrics", Port: 9121, Protocol: "TCP"}}
+
+	tests := []struct {
+		name     string
+		instance Instance
+		expected map[string]string
+	}{
+		{"no ports", Instance{CoordinatesClusterURL: &CoordinatesClusterURL{URL: host}},
+			map[string]string{"URL": host, "Host": host}},
+		{"named ports", Instance{CoordinatesClusterURL: &CoordinatesClusterURL{URL: host, Ports: redis}},
+			map[string]string{"URL": host, "Host": host, "Port": "6379", "Port_redis": "6379", "Port_metrics": "9121",
+				"Scheme": "redis", "URI": "redis://" + host + ":6379"}},
+		{"chosen port", Instance{
+			Entry:                 Entry{Connection: &Connection{Port: "metrics", Scheme: "http"}},
+			CoordinatesClusterURL: &CoordinatesClusterURL{URL: host, Ports: redis}},
+			map[string]string{"URL": host, "Host": host, "Port": "9121", "Port_redis": "6379", "Port_metrics": "9121",
+				"Scheme": "http", "URI": "http://" + host + ":9121"}},
+		{"templates", Instance{
+			Entry:                 Entry{Connection: &Connection{Templates: map[string]string{"DSN": "{{ .Scheme }}://{{ .Host }}:{{ .Ports.redis }}/{{ .Parameters.db }}"}}},
+			Parameters:            map[string]interface{}{"db": "0"},
+			CoordinatesClusterURL: &CoordinatesClusterURL{URL: host, Ports: redis[:1]}},
+			map[string]string{"URL": host, "Host": host, "Port": "6379", "Port_redis": "6379",
+				"Scheme": "redis", "URI": "redis://" + host + ":6379", "DSN": "redis://" + host + ":6379/0"}},
+		{"external", Instance{CoordinatesExternalURL: &CoordinatesExternalURL{URL: "https://api.example.com/v1"}},
+			map[string]string{"URL": "https://api.example.com/v1", "Host": "api.example.com", "Port": "443",
+				"Scheme": "https", "URI": "https://api.example.com/v1"}},
+	}
+
+	for _, test := range tests {
+		coords, err := test.instance.Coordinates()
+		if err != nil {
+			t.Errorf("%s: unexpected %s", test.name, err)
+		} else if !reflect.DeepEqual(coords, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, coords)
+		}
+	}
+}
+
+// serves the Services given, by namespace/name
+type serviceKube struct {
+	Kube
+	services map[string]*v1.Service
+}
+
+func (k *serviceKube) GetService(namespace, name string) (*v1.Service, error) {
+	if s, ok := k.services[namespace+"/"+name]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("service %s/%s not found", namespace, name)
+}
+
+func TestInstanceCoordinates(t *testing.T) {
+	host := "cache.infra.svc.cluster.local"
+	// the Service has moved to another port since the instance was provisioned
+	kube := &serviceKube{services: map[string]*v1.Service{
+		"infra/cache": {Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "redis", Port: 6380, Protocol: "TCP"}}}},
+	}}
+	c := &ProductionController{Kube: kube, catalog: &[]Entry{
+		{UUID: "1", Connection: &Connection{Scheme: "rediss"}},
+	}}
+	instance := &Instance{
+		Entry:                 Entry{UUID: "1"},
+		CoordinatesClusterURL: &CoordinatesClusterURL{URL: host, Ports: []CoordinatesPort{{Name: "redis", Port: 6379, Protocol: "TCP"}}},
+	}
+
+	coords, err := c.instanceCoordinates(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coords["Port"] != "6380" || coords["URI"] != "rediss://"+host+":6380" {
+		t.Errorf("expected the current port and scheme, got %v", coords)
+	}
+
+	// the recorded ports are used if the Service cannot be found
+	kube.services = nil
+	if coords, _ := c.instanceCoordinates(instance); coords["Port"] != "6379" {
+		t.Errorf("expected the recorded port, got %v", coords)
+	}
+}
@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Catalog entries and wrapped resources may also be defined as custom
+// resources, read alongside the ConfigMaps when the CRDs are installed.
+//
+// A CatalogEntry spec holds the same fields as the JSON in a catalog entry
+// ConfigMap. A WrappedResource spec holds a manifest, JSON or YAML, with
+// enabled and order in place of the mesitis/enabled and mesitis/order
+// labels. Its metadata labels are matched by an entry's labelselector.
+
+var catalogEntries = schema.GroupVersionResource{
+	Group:    "mesitis.io",
+	Version:  "v1alpha1",
+	Resource: "catalogentries",
+}
+
+var wrappedResources = schema.GroupVersionResource{
+	Group:    "mesitis.io",
+	Version:  "v1alpha1",
+	Resource: "wrappedresources",
+}
+
+// mesitis/kind label given to WrappedResources converted to ConfigMaps
+const wrappedResourceKind = "wrapped-resource"
+
+// names the real source of a ConfigMap converted from another kind
+const originAnnotation = "mesitis/origin"
+
+// Status the broker reports on each CatalogEntry
+type CatalogEntryStatus struct {
+	ObservedGeneration int64            `json:"observedGeneration"`
+	Valid              bool             `json:"valid"`
+	Problems           ValidationErrors `json:"problems,omitempty"`
+	Instances          int              `json:"instances"`
+	Bindings           int              `json:"bindings"`
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// resourceOrigin names a custom resource, or where it was read from when
+// it did not come from the cluster
+func resourceOrigin(kind string, obj *unstructured.Unstructured) string {
+	if origin, ok := obj.GetAnnotations()[originAnnotation]; ok {
+		return origin
+	}
+	return fmt.Sprintf("%s/%s", kind, obj.GetName())
+}
+
+// listCustomResources treats CRDs that are not installed as empty
+func listCustomResources(k Kube, gvr schema.GroupVersionResource, labelSelector string) ([]unstructured.Unstructured, error) {
+	items, err := k.ListCustomResources(gvr, k.BrokerNamespace(), labelSelector)
+	if k8serr.IsNotFound(err) {
+		return []unstructured.Unstructured{}, nil
+	}
+	return items, err
+}
+
+// ParseCatalogEntryResources converts CatalogEntry custom resources to entries
+func ParseCatalogEntryResources(items []unstructured.Unstructured) ([]Entry, ValidationErrors) {
+	entries := make([]Entry, 0)
+	errs := ValidationErrors{}
+
+	for i := range items {
+		origin := resourceOrigin("catalogentry", &items[i])
+		spec, ok := items[i].Object["spec"]
+		if !ok {
+			errs = append(errs, ValidationError{origin, "spec", "missing", SeverityError})
+			continue
+		}
+		js, err := json.Marshal(spec)
+		if err != nil {
+			errs = append(errs, ValidationError{origin, "spec", fmt.Sprintf("invalid entry: %s", err), SeverityError})
+			continue
+		}
+
+		entry, problems := parseEntry(origin, js)
+		errs = append(errs, problems...)
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Origin < entries[j].Origin })
+	return entries, errs
+}
+
+// wrappedResourceConfigMaps presents WrappedResources as the equivalent
+// ConfigMaps so they provision and validate the same way
+func wrappedResourceConfigMaps(items []unstructured.Unstructured) []v1.ConfigMap {
+	cms := make([]v1.ConfigMap, 0, len(items))
+	for i := range items {
+		obj := &items[i]
+		manifest, _, _ := unstructured.NestedString(obj.Object, "spec", "manifest")
+		enabled, found, _ := unstructured.NestedBool(obj.Object, "spec", "enabled")
+		order, _, _ := unstructured.NestedInt64(obj.Object, "spec", "order")
+
+		converted := make(map[string]string, 0)
+		for k, v := range obj.GetLabels() {
+			converted[k] = v
+		}
+		converted["mesitis/kind"] = wrappedResourceKind
+		converted["mesitis/enabled"] = strconv.FormatBool(enabled || !found)
+		converted["mesitis/order"] = strconv.FormatInt(order, 10)
+
+		cms = append(cms, v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "wrappedresource-" + obj.GetName(),
+				Namespace:   obj.GetNamespace(),
+				Labels:      converted,
+				Annotations: map[string]string{originAnnotation: resourceOrigin("wrappedresource", obj)},
+			},
+			Data: map[string]string{wrappedDataKey: manifest},
+		})
+	}
+	return cms
+}
+
+// listWrappedResources finds wrapped resources matching the selector in
+// both ConfigMaps and WrappedResources
+func listWrappedResources(k Kube, labelSelector string) ([]v1.ConfigMap, error) {
+	list, err := k.ListConfigMaps(k.BrokerNamespace(), labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	// select on the converted labels, which include mesitis/kind and friends
+	resources, err := listCustomResources(k, wrappedResources, "")
+	if err != nil {
+		glog.Errorf("Failed to list WrappedResources: %s", err)
+		return nil, err
+	}
+	items := list.Items
+	for _, cm := range wrappedResourceConfigMaps(resources) {
+		if selector.Matches(labels.Set(cm.Labels)) {
+			items = append(items, cm)
+		}
+	}
+	return items, nil
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+func reportResourceValidation(k Kube, items []unstructured.Unstructured, errs ValidationErrors, reports *validationReports) {
+	for i := range items {
+		obj := &items[i]
+		recordValidation(k, customResourceReference(obj), errs.bySource(resourceOrigin("catalogentry", obj)), reports)
+	}
+}
+
+func customResourceReference(obj *unstructured.Unstructured) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:            obj.GetKind(),
+		APIVersion:      obj.GetAPIVersion(),
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+}
+
+// UpdateCatalogEntryStatus writes validation results and usage counts to
+// each CatalogEntry, skipping those whose status is unchanged
+func UpdateCatalogEntryStatus(k Kube, s Storage, errs ValidationErrors) error {
+	resources, err := listCustomResources(k, catalogEntries, "")
+	if err != nil || len(resources) == 0 {
+		return err
+	}
+
+	instances, err := ListInstances(s)
+	if err != nil {
+		return err
+	}
+	bindings, err := ListBindings(s)
+	if err != nil {
+		return err
+	}
+
+	instanceCounts := make(map[string]int, 0)
+	for _, i := range instances {
+		instanceCounts[i.UUID]++
+	}
+	bindingCounts := make(map[string]int, 0)
+	for _, b := range bindings {
+		if b.Instance != nil {
+			bindingCounts[b.UUID]++
+		}
+	}
+
+	for i := range resources {
+		obj := &resources[i]
+		problems := errs.bySource(resourceOrigin("catalogentry", obj))
+		uuid, _, _ := unstructured.NestedString(obj.Object, "spec", "uuid")
+
+		status := CatalogEntryStatus{
+			ObservedGeneration: obj.GetGeneration(),
+			Valid:              !problems.HasErrors(),
+			Problems:           problems,
+			Instances:          instanceCounts[uuid],
+			Bindings:           bindingCounts[uuid],
+		}
+
+		// compare in the unstructured form the api server returns
+		js, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		var desired map[string]interface{}
+		if err := json.Unmarshal(js, &desired); err != nil {
+			return err
+		}
+		if current, ok := obj.Object["status"]; ok {
+			var normalized map[string]interface{}
+			if js, err := json.Marshal(current); err == nil && json.Unmarshal(js, &normalized) == nil &&
+				reflect.DeepEqual(normalized, desired) {
+				continue
+			}
+		}
+
+		obj.Object["status"] = desired
+		if err := k.UpdateCustomResourceStatus(catalogEntries, obj); err != nil {
+			glog.Errorf("Failed to update status of CatalogEntry %s: %s", obj.GetName(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// An offering can need instances of other offerings, ex an API service
+// needing its own cache. Provisioning an entry first provisions an instance
+// of each dependency in the consumer namespace, or reuses one already
+// there, and its templates see their coordinates and credentials.
+// Deprovisioning tears down in reverse order the prerequisites it created,
+// once nothing else depends on them.
+type Dependency struct {
+	// how templates refer to the prerequisite, ex {{ .Dependencies.cache.Coordinates.URL }}
+	Name string `json:"name"`
+	// the entry to provision
+	UUID string `json:"uuid"`
+	// given to the prerequisite when it is created
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	// always create a prerequisite for this instance, rather than reuse one
+	// already in the consumer namespace
+	Dedicated bool `json:"dedicated,omitempty"`
+}
+
+// An instance provisioned before, and for, the instance recording it
+type Prerequisite struct {
+	Name       string `json:"name"`
+	InstanceID string `json:"instanceID"`
+	// created for the dependent instance, rather than reused
+	Created bool `json:"created,omitempty"`
+}
+
+// What templates see of a prerequisite
+type DependencyValues struct {
+	InstanceID  string
+	Coordinates map[string]string
+	Credentials map[string]string
+}
+
+// ids of prerequisites created for an instance are derived from its id, so
+// a retried provision finds them
+func prerequisiteID(id string, d *Dependency) string {
+	return fmt.Sprintf("%s-%s", id, d.Name)
+}
+
+// validateDependencies checks that the dependencies of every entry name entries
+// in the catalog, and that none depends on itself however indirectly. An
+// entry depending on an invalid entry is invalid too.
+func validateDependencies(entries []Entry, errs ValidationErrors) ValidationErrors {
+	found := ValidationErrors{}
+	invalid := func(e *Entry) bool {
+		return errs.bySource(e.Origin).HasErrors() || found.bySource(e.Origin).HasErrors()
+	}
+
+	byUUID := make(map[string]*Entry, 0)
+	for i := range entries {
+		byUUID[entries[i].UUID] = &entries[i]
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		names := make(map[string]bool, 0)
+		for j, d := range e.Dependencies {
+			field := fmt.Sprintf("dependencies[%d]", j)
+			problem := func(format string, args ...interface{}) {
+				found = append(found, ValidationError{e.Origin, field, fmt.Sprintf(format, args...), SeverityError})
+			}
+			switch {
+			case d.Name == "":
+				problem("name required")
+			case names[d.Name]:
+				problem("duplicate name %s", d.Name)
+			}
+			names[d.Name] = true
+
+			prerequisite := byUUID[d.UUID]
+			switch {
+			case d.UUID == e.UUID:
+				problem("depends on itself")
+			case prerequisite == nil:
+				problem("no entry with uuid %s", d.UUID)
+			case prerequisite.RequiresApproval:
+				problem("%s requires approval, so cannot be provisioned as a prerequisite", prerequisite.serviceName())
+			}
+		}
+	}
+
+	// depth first, reporting each entry that can reach itself
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, 0)
+	var visit func(e *Entry, path []string)
+	visit = func(e *Entry, path []string) {
+		state[e.UUID] = visiting
+		path = append(path, e.serviceName())
+		for _, d := range e.Dependencies {
+			next := byUUID[d.UUID]
+			if next == nil || next == e {
+				continue
+			}
+			switch state[next.UUID] {
+			case visiting:
+				cycle := append(path, next.serviceName())
+				found = append(found, ValidationError{e.Origin, "dependencies", fmt.Sprintf("dependency cycle %s", strings.Join(cycle, " -> ")), SeverityError})
+			case unvisited:
+				visit(next, path)
+			}
+		}
+		state[e.UUID] = done
+	}
+	for i := range entries {
+		if state[entries[i].UUID] == unvisited {
+			visit(&entries[i], nil)
+		}
+	}
+
+	// an invalid prerequisite leaves its dependents unprovisionable
+	for changed := true; changed; {
+		changed = false
+		for i := range entries {
+			e := &entries[i]
+			if invalid(e) {
+				continue
+			}
+			for _, d := range e.Dependencies {
+				if prerequisite := byUUID[d.UUID]; prerequisite != nil && invalid(prerequisite) {
+					found = append(found, ValidationError{e.Origin, "dependencies", fmt.Sprintf("depends on invalid %s", prerequisite.serviceName()), SeverityError})
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return found
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// provisionPrerequisites provisions, or finds, an instance of each
+// dependency of the entry in the namespace. The prerequisites are marked
+// busy until the returned func is called, so none is deprovisioned before
+// the dependent instance is saved. On failure the prerequisites created so
+// far are torn down.
+func (c *ProductionController) provisionPrerequisites(id string, entry *Entry, namespace string) ([]Prerequisite, func(), error) {
+	prerequisites := make([]Prerequisite, 0, len(entry.Dependencies))
+	held := make([]func(), 0, len(entry.Dependencies))
+	release := func() {
+		for _, r := range held {
+			r()
+		}
+		held = nil
+	}
+	if len(entry.Dependencies) == 0 {
+		return prerequisites, release, nil
+	}
+
+	catalog, err := c.loadCatalog()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fail := func(err error) ([]Prerequisite, func(), error) {
+		release()
+		c.deprovisionPrerequisites(id, prerequisites)
+		return nil, nil, err
+	}
+	// a prerequisite in the middle of another operation, ex being
+	// deprovisioned, is not to be reused
+	hold := func(pid string) error {
+		if err := c.checkNotBusy(pid); err != nil {
+			return err
+		}
+		held = append(held, c.markBusy(pid))
+		return nil
+	}
+
+	for i := range entry.Dependencies {
+		d := &entry.Dependencies[i]
+		dependency := findEntry(catalog, d.UUID)
+		if dependency == nil {
+			return fail(NewBrokerError(http.StatusBadRequest, "", "Service %s depends on %s, which is not offered.", entry.serviceName(), d.UUID))
+		}
+
+		pid := prerequisiteID(id, d)
+		if InstanceExists(c.Storage, pid) {
+			if err := hold(pid); err != nil {
+				return fail(err)
+			}
+			glog.Infof("Prerequisite %s of instance %s exists, reusing", pid, id)
+			prerequisites = append(prerequisites, Prerequisite{Name: d.Name, InstanceID: pid, Created: true})
+			continue
+		}
+		if !d.Dedicated {
+			existing, err := NamespaceInstances(c.Storage, d.UUID, namespace)
+			if err != nil {
+				return fail(err)
+			}
+			if len(existing) > 0 {
+				if err := hold(existing[0]); err != nil {
+					return fail(err)
+				}
+				glog.Infof("Instance %s reuses instance %s of %s in namespace %s", id, existing[0], dependency.serviceName(), namespace)
+				prerequisites = append(prerequisites, Prerequisite{Name: d.Name, InstanceID: existing[0]})
+				continue
+			}
+		}
+
+		if err := dependency.CheckAccess(c.Kube, namespace); err != nil {
+			return fail(err)
+		}
+		if err := c.checkProvisionQuota(dependency, namespace, pid); err != nil {
+			return fail(err)
+		}
+		if err := dependency.CheckParameters(OperationProvision, d.Parameters); err != nil {
+			return fail(err)
+		}
+		if err := hold(pid); err != nil {
+			return fail(err)
+		}
+		glog.Infof("Provisioning prerequisite %s of instance %s from %s", pid, id, dependency.serviceName())
+		if err := c.provision(pid, dependency, namespace, d.Parameters); err != nil {
+			return fail(err)
+		}
+		prerequisites = append(prerequisites, Prerequisite{Name: d.Name, InstanceID: pid, Created: true})
+	}
+	return prerequisites, release, nil
+}
+
+// deprovisionPrerequisites tears down, last first, the prerequisites
+// created for an instance that nothing else depends on or is provisioned with
+func (c *ProductionController) deprovisionPrerequisites(id string, prerequisites []Prerequisite) {
+	for i := len(prerequisites) - 1; i >= 0; i-- {
+		p := prerequisites[i]
+		if !p.Created {
+			continue
+		}
+		if c.busy[p.InstanceID] > 0 {
+			glog.Infof("Prerequisite %s of instance %s is in the middle of another operation, keeping it", p.InstanceID, id)
+			continue
+		}
+		dependents, err := Dependents(c.Storage, p.InstanceID)
+		if err != nil {
+			glog.Errorf("Failed to find dependents of prerequisite %s, keeping it: %s", p.InstanceID, err)
+			continue
+		}
+		if others := without(dependents, id); len(others) > 0 {
+			glog.Infof("Prerequisite %s of instance %s is also required by %s, keeping it", p.InstanceID, id, strings.Join(others, ", "))
+			continue
+		}
+		instance, err := LoadInstance(c.Storage, p.InstanceID)
+		if err != nil {
+			glog.Errorf("Unable to find prerequisite %s of instance %s: %s", p.InstanceID, id, err)
+			continue
+		}
+		glog.Infof("Deprovisioning prerequisite %s of instance %s", p.InstanceID, id)
+		c.deprovision(instance)
+	}
+}
+
+// dependencyValues reads the coordinates and credentials of the
+// prerequisites for templates
+func (c *ProductionController) dependencyValues(prerequisites []Prerequisite) (map[string]*DependencyValues, error) {
+	values := make(map[string]*DependencyValues, len(prerequisites))
+	for _, p := range prerequisites {
+		instance, err := LoadInstance(c.Storage, p.InstanceID)
+		if err != nil {
+			glog.Errorf("Unable to find prerequisite %s: %s", p.InstanceID, err)
+			return nil, err
+		}
+		coords, err := c.instanceCoordinates(instance)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := instance.Entry.Credential(c.Kube, &TemplateValues{
+			InstanceID: instance.InstanceID,
+			Namespace:  instance.ConsumerNamespace,
+			Parameters: instance.Parameters,
+		})
+		if err != nil {
+			return nil, err
+		}
+		values[p.Name] = &DependencyValues{InstanceID: p.InstanceID, Coordinates: coords, Credentials: creds}
+	}
+	return values, nil
+}
+
+func without(ids []string, id string) []string {
+	others := make([]string, 0, len(ids))
+	for _, other := range ids {
+		if other != id {
+			others = append(others, other)
+		}
+	}
+	return others
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestValidateDependencies(t *testing.T) {
+	entry := func(name, uuid string, dependencies ...string) Entry {
+		e := Entry{Team: "team", Offering: name, UUID: uuid, Origin: "configmap/" + name}
+		for _, d := range dependencies {
+			e.Dependencies = append(e.Dependencies, Dependency{Name: "dep-" + d, UUID: d})
+		}
+		return e
+	}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		invalid []string
+	}{
+		{"chain", []Entry{entry("api", "1", "2"), entry("cache", "2", "3"), entry("disk", "3")}, nil},
+		{"shared", []Entry{entry("api", "1", "3"), entry("web", "2", "3"), entry("cache", "3")}, nil},
+		{"missing", []Entry{entry("api", "1", "9")}, []string{"api"}},
+		{"self", []Entry{entry("api", "1", "1")}, []string{"api"}},
+		{"cycle", []Entry{entry("api", "1", "2"), entry("cache", "2", "3"), entry("disk", "3", "1"), entry("web", "4", "2")},
+			[]string{"api", "cache", "disk", "web"}},
+		{"cascade", []Entry{entry("web", "4", "1"), entry("api", "1", "2"), entry("cache", "2", "9")}, []string{"web", "api", "cache"}},
+	}
+
+	for _, test := range tests {
+		errs := validateDependencies(test.entries, ValidationErrors{})
+		invalid := map[string]bool{}
+		for _, name := range test.invalid {
+			invalid[name] = true
+		}
+		for _, e := range test.entries {
+			if got := errs.bySource(e.Origin).HasErrors(); got != invalid[e.Offering] {
+				t.Errorf("%s: %s expected invalid %t, got %t: %v", test.name, e.Offering, invalid[e.Offering], got, errs)
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+)
+
+// Catalog entries and wrapped resources kept as manifests in a directory,
+// such as a mounted volume or a checkout maintained by a sidecar. The
+// directory is read again every interval.
+type DirectoryCatalogSource struct {
+	*polledManifests
+	Directory string
+}
+
+func NewDirectoryCatalogSource(directory string, interval time.Duration) *DirectoryCatalogSource {
+	return &DirectoryCatalogSource{
+		polledManifests: &polledManifests{
+			name:     fmt.Sprintf("directory %s", directory),
+			interval: interval,
+			fetch:    func() (*CatalogManifests, error) { return ReadCatalogDirectory(directory, directory) },
+		},
+		Directory: directory,
+	}
+}
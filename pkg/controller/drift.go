@@ -0,0 +1,349 @@
+package controller
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// After provisioning, the objects of an instance can be deleted or edited
+// behind the broker's back. The reconciler compares each instance's
+// ResourcesKubeObjectList with its wrapped resources, rendered again, and
+// reports objects that are missing or whose fields differ as events. Entries
+// choose with drift whether it also enforces the rendered state: missing
+// objects are recreated, and drifted ones patched back in place. Fields
+// another manager has taken are only taken back when forced.
+const (
+	DriftReport  = "report"
+	DriftEnforce = "enforce"
+	DriftForce   = "force"
+	DriftIgnore  = "ignore"
+)
+
+type ReconcilerOptions struct {
+	// how often to reconcile, never if zero
+	Interval time.Duration
+}
+
+// counts of drift found and corrected, published at /debug/vars on the admin listener
+var driftMetrics = expvar.NewMap("drift")
+
+// fields the api server keeps for itself, which a dry run changes
+// without the object having drifted
+var driftIgnoredFields = map[string]bool{
+	"apiVersion":                 true,
+	"status":                     true,
+	"metadata.managedFields":     true,
+	"metadata.resourceVersion":   true,
+	"metadata.generation":        true,
+	"metadata.creationTimestamp": true,
+}
+
+// driftedFields lists the fields of desired, the object as a dry run of
+// the broker's apply leaves it, whose values live does not share. Fields
+// only in live are not drift.
+func driftedFields(desired, live interface{}, path string) []string {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return []string{path}
+		}
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, 0)
+		for _, k := range keys {
+			field := k
+			if path != "" {
+				field = path + "." + k
+			}
+			if driftIgnoredFields[field] {
+				continue
+			}
+			fields = append(fields, driftedFields(d[k], l[k], field)...)
+		}
+		return fields
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) < len(d) {
+			return []string{path}
+		}
+		fields := make([]string, 0)
+		for i := range d {
+			fields = append(fields, driftedFields(d[i], l[i], fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return fields
+	case nil:
+		return nil
+	default:
+		// numbers decode as float64 from manifests, int64 from the api server
+		if live == nil || fmt.Sprint(d) != fmt.Sprint(live) {
+			return []string{path}
+		}
+		return nil
+	}
+}
+
+func (e *Entry) driftMode() string {
+	if e.Drift == "" {
+		return DriftReport
+	}
+	return e.Drift
+}
+
+func (e *Entry) validateDrift() ValidationErrors {
+	errs := ValidationErrors{}
+	switch e.Drift {
+	case "", DriftReport, DriftEnforce, DriftForce, DriftIgnore:
+	default:
+		errs = append(errs, ValidationError{e.Origin, "drift", fmt.Sprintf("unknown mode %s, expected one of %s, %s, %s, %s", e.Drift, DriftReport, DriftEnforce, DriftForce, DriftIgnore), SeverityError})
+	}
+	if e.Drift != "" && e.ProvisionNewClusterObjects == nil {
+		errs = append(errs, ValidationError{e.Origin, "drift", "only objects provisioned by ProvisionNewClusterObjects are reconciled", SeverityWarning})
+	}
+	return errs
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// Reconcile checks every instance with provisioned objects for drift
+func (c *ProductionController) Reconcile() error {
+	c.rwMutex.RLock()
+	instances, err := ListInstances(c.Storage)
+	c.rwMutex.RUnlock()
+	if err != nil {
+		glog.Errorf("Failed to list instances to reconcile: %s", err)
+		return err
+	}
+
+	drifted := 0
+	for _, instance := range instances {
+		if instance.ResourcesKubeObjectList == nil || len(*instance.ResourcesKubeObjectList) == 0 {
+			continue
+		}
+		n, err := c.reconcileInstance(instance.InstanceID)
+		if err != nil {
+			glog.Errorf("Failed to reconcile instance %s: %s", instance.InstanceID, err)
+			driftMetrics.Add("failed", 1)
+		}
+		drifted += n
+	}
+	driftMetrics.Add("passes", 1)
+	glog.Infof("Reconciled <%d> instances, <%d> objects drifted.", len(instances), drifted)
+	return nil
+}
+
+// an object of an instance found missing or drifted
+type driftFinding struct {
+	po   ResourcesKubeObject
+	doc  string
+	live map[string]interface{}
+	// fields that differ, none when the object is missing
+	fields []string
+}
+
+// reconcileInstance compares the objects of one instance with their
+// rendered state, returning how many have drifted. The objects are read
+// without holding the lock; only enforcement takes it.
+func (c *ProductionController) reconcileInstance(id string) (int, error) {
+	c.rwMutex.RLock()
+	instance, err := LoadInstance(c.Storage, id)
+	if err != nil || instance.Expired != nil || c.busy[id] > 0 {
+		// removed or expired since listed, or in the middle of an operation
+		c.rwMutex.RUnlock()
+		return 0, nil
+	}
+	entry := c.currentEntry(instance)
+	mode := entry.driftMode()
+	if mode == DriftIgnore || entry.ProvisionNewClusterObjects == nil {
+		c.rwMutex.RUnlock()
+		return 0, nil
+	}
+	values, err := c.instanceValues(instance)
+	if err != nil {
+		c.rwMutex.RUnlock()
+		return 0, err
+	}
+	wrapped, err := entry.ProvisionNewClusterObjects.render(c.Kube, entry, values)
+	c.rwMutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	desired := make(map[string]string, len(wrapped))
+	for _, w := range wrapped {
+		if name := documentName(w.doc); name != "" {
+			desired[w.kind+"/"+name] = w.doc
+		}
+	}
+
+	findings := make([]driftFinding, 0)
+	for _, po := range *instance.ResourcesKubeObjectList {
+		driftMetrics.Add("checked", 1)
+		finding, err := c.checkObject(instance, entry, values, po, desired)
+		if err != nil {
+			glog.Errorf("Failed to check %s of instance %s for drift: %s", objectKey(po), id, err)
+			driftMetrics.Add("failed", 1)
+			continue
+		}
+		if finding != nil {
+			findings = append(findings, *finding)
+		}
+	}
+	if len(findings) == 0 {
+		return 0, nil
+	}
+
+	enforce := mode == DriftEnforce || mode == DriftForce
+	force := mode == DriftForce
+	if enforce {
+		// a provision or removal of the instance waits for the corrections
+		c.rwMutex.Lock()
+		defer c.rwMutex.Unlock()
+		current, err := LoadInstance(c.Storage, id)
+		if err != nil || current.Expired != nil || c.busy[id] > 0 || changedSince(instance, current) {
+			glog.Infof("Instance %s changed while it was checked for drift, not enforcing", id)
+			enforce = false
+		}
+	}
+
+	for _, f := range findings {
+		key := objectKey(f.po)
+		if f.fields == nil {
+			driftMetrics.Add("missing", 1)
+			message := fmt.Sprintf("%s of instance %s is missing", key, id)
+			if enforce && f.doc != "" {
+				message, err = c.recreateObject(instance, entry, values, f.po, f.doc, force)
+				if err != nil {
+					driftMetrics.Add("failed", 1)
+				} else {
+					driftMetrics.Add("recreated", 1)
+				}
+			} else if enforce {
+				message += ", and is no longer in the wrapped resources to recreate"
+			}
+			glog.Warningf("Drift: %s", message)
+			c.recordInstanceEvent(instance, v1.EventTypeWarning, "Missing", message)
+			continue
+		}
+
+		driftMetrics.Add("modified", 1)
+		message := fmt.Sprintf("%s of instance %s differs in %s", key, id, strings.Join(f.fields, ", "))
+		if enforce {
+			if err := c.applyRendered(instance, entry, values, f.po, f.doc, f.live, force); err != nil {
+				glog.Errorf("Failed to correct drifted %s: %s", key, err)
+				message += fmt.Sprintf(", and could not be patched back: %s", err)
+				if be, ok := err.(*BrokerError); ok && be.Status == http.StatusConflict {
+					driftMetrics.Add("conflicts", 1)
+				} else {
+					driftMetrics.Add("failed", 1)
+				}
+			} else {
+				message += ", patched back"
+				driftMetrics.Add("corrected", 1)
+			}
+		}
+		glog.Warningf("Drift: %s", message)
+		c.recordInstanceEvent(instance, v1.EventTypeWarning, "Drifted", message)
+		kind := objectReferenceKinds[f.po.Kind]
+		ref := &v1.ObjectReference{Kind: kind[0], APIVersion: kind[1], Namespace: f.po.Namespace, Name: f.po.Name}
+		if err := c.Kube.RecordEvent(ref, v1.EventTypeWarning, "Drifted", message); err != nil {
+			glog.Errorf("Failed to record drift event on %s: %s", key, err)
+		}
+	}
+	return len(findings), nil
+}
+
+// checkObject reads an object of an instance, and has the api server apply
+// its rendered document in a dry run. Only the fields the apply would
+// change are drift: defaults, fields set by other managers and values
+// written in another form compare equal.
+func (c *ProductionController) checkObject(instance *Instance, entry *Entry, values *TemplateValues, po ResourcesKubeObject, desired map[string]string) (*driftFinding, error) {
+	doc, known := desired[po.Kind+"/"+po.Name]
+	live, err := c.Kube.GetObject(po.Kind, po.Namespace, po.Name)
+	if k8serr.IsNotFound(err) {
+		return &driftFinding{po: po, doc: doc}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, nil
+	}
+
+	stamped, err := c.stampRendered(instance, entry, values, doc, live)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := c.Kube.DryRunApply(po.Kind, po.Namespace, stamped)
+	if err != nil {
+		return nil, err
+	}
+	fields := driftedFields(applied, live, "")
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return &driftFinding{po: po, doc: doc, live: live, fields: fields}, nil
+}
+
+// changedSince is whether an instance was updated, upgraded or had its
+// objects replaced after it was loaded
+func changedSince(instance, current *Instance) bool {
+	return len(current.History) != len(instance.History) ||
+		!reflect.DeepEqual(current.Parameters, instance.Parameters) ||
+		!reflect.DeepEqual(current.ResourcesKubeObjectList, instance.ResourcesKubeObjectList)
+}
+
+// recreateObject creates a missing object again from its rendered document
+func (c *ProductionController) recreateObject(instance *Instance, entry *Entry, values *TemplateValues, po ResourcesKubeObject, doc string, force bool) (string, error) {
+	key := objectKey(po)
+	if err := c.applyRendered(instance, entry, values, po, doc, nil, force); err != nil {
+		glog.Errorf("Failed to recreate %s of instance %s: %s", key, instance.InstanceID, err)
+		return fmt.Sprintf("%s of instance %s is missing, and could not be recreated: %s", key, instance.InstanceID, err), err
+	}
+	return fmt.Sprintf("%s of instance %s was missing, recreated", key, instance.InstanceID), nil
+}
+
+// applyRendered applies the rendered document of an object. Unless
+// forced, fields other managers have changed are conflicts, and the object
+// is left as it is.
+func (c *ProductionController) applyRendered(instance *Instance, entry *Entry, values *TemplateValues, po ResourcesKubeObject, doc string, live map[string]interface{}, force bool) error {
+	stamped, err := c.stampRendered(instance, entry, values, doc, live)
+	if err != nil {
+		return err
+	}
+	_, err = applyObject(c.Kube, po.Kind, po.Namespace, stamped, force)
+	return err
+}
+
+// stampRendered stamps a rendered document with the owner labels and
+// annotations it was provisioned with
+func (c *ProductionController) stampRendered(instance *Instance, entry *Entry, values *TemplateValues, doc string, live map[string]interface{}) (string, error) {
+	annotations := keepCreated(ownerAnnotations(instance.InstanceID, entry), live)
+	return stampOwner(doc, ownerLabels(c.Kube, instance.InstanceID, entry, values), annotations)
+}
+
+// runReconciler reconciles every interval until stop is closed
+func (c *ProductionController) runReconciler(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.Options.Reconciler.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Reconcile()
+		}
+	}
+}
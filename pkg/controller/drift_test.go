@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDriftedFields(t *testing.T) {
+	desired := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"api","labels":{"app":"api"},
+		"resourceVersion":"8","generation":3,"managedFields":[{"manager":"mesitis","operation":"Apply"}]},
+		"spec":{"replicas":2,"template":{"spec":{"containers":[{"name":"api","image":"api:1"}]}}}}`
+	tests := []struct {
+		name     string
+		live     string
+		expected []string
+	}{
+		{"same, with defaults", `{"apiVersion":"apps/v1beta1","kind":"Deployment","metadata":{"name":"api","uid":"x","labels":{"app":"api","mesitis/instance":"a"}},
+			"spec":{"replicas":2,"strategy":{},"template":{"spec":{"containers":[{"name":"api","image":"api:1","imagePullPolicy":"IfNotPresent"}]}}},"status":{}}`,
+			[]string{}},
+		{"scaled", `{"kind":"Deployment","metadata":{"name":"api","labels":{"app":"api"}},
+			"spec":{"replicas":5,"template":{"spec":{"containers":[{"name":"api","image":"api:1"}]}}}}`,
+			[]string{"spec.replicas"}},
+		{"relabeled and image changed", `{"kind":"Deployment","metadata":{"name":"api","labels":{}},
+			"spec":{"replicas":2,"template":{"spec":{"containers":[{"name":"api","image":"api:2"}]}}}}`,
+			[]string{"metadata.labels.app", "spec.template.spec.containers[0].image"}},
+		{"container removed", `{"kind":"Deployment","metadata":{"name":"api","labels":{"app":"api"}},
+			"spec":{"replicas":2,"template":{"spec":{"containers":[]}}}}`,
+			[]string{"spec.template.spec.containers"}},
+	}
+
+	var d map[string]interface{}
+	if err := json.Unmarshal([]byte(desired), &d); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		var live map[string]interface{}
+		if err := json.Unmarshal([]byte(test.live), &live); err != nil {
+			t.Fatal(err)
+		}
+		if fields := driftedFields(d, live, ""); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, fields)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// An error the platform should show the consumer, sent as the body of the
+// response with the given status, as the Open Service Broker API describes
+type BrokerError struct {
+	Status      int    `json:"-"`
+	ErrorCode   string `json:"error,omitempty"`
+	Description string `json:"description"`
+}
+
+func (e *BrokerError) Error() string {
+	return e.Description
+}
+
+func NewBrokerError(status int, errorCode string, format string, args ...interface{}) *BrokerError {
+	return &BrokerError{Status: status, ErrorCode: errorCode, Description: fmt.Sprintf(format, args...)}
+}
+
+// a request refused by the provider's rules, not because it was malformed
+func forbidden(format string, args ...interface{}) *BrokerError {
+	return NewBrokerError(http.StatusForbidden, "Forbidden", format, args...)
+}
@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// Entries for ephemeral environments can limit how long their instances
+// live: maxlifetime from provisioning, idletimeout from the last bind,
+// unbind or update, and not while bound. The expirer deprovisions an instance's resources when either
+// passes and keeps its record, marked expired, for the retention period,
+// so binds fail with a clear error and deprovisioning still succeeds. The
+// bindings of an expired instance are unbound, hooks included, before its
+// resources are removed.
+// expirywarning records an event that long before.
+
+type ExpirerOptions struct {
+	// how often to look for expired instances, never if zero
+	Interval time.Duration
+	// how long the record of an expired instance is kept
+	Retention time.Duration
+}
+
+// parseLifetime reads an optional duration, zero if unset or invalid
+func parseLifetime(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// expiresAt is when the instance expires under the limits of the entry,
+// false if it never does. A bound instance is in use, and never idle.
+func (i *Instance) expiresAt(entry *Entry, bound bool) (time.Time, bool) {
+	var at time.Time
+	if d := parseLifetime(entry.MaxLifetime); d > 0 {
+		at = i.Created.Add(d)
+	}
+	if d := parseLifetime(entry.IdleTimeout); d > 0 && !bound {
+		lastUsed := i.Created
+		if i.LastUsed.After(lastUsed) {
+			lastUsed = i.LastUsed
+		}
+		if idle := lastUsed.Add(d); at.IsZero() || idle.Before(at) {
+			at = idle
+		}
+	}
+	return at, !at.IsZero()
+}
+
+// checkNotExpired refuses operations on an expired instance
+func (i *Instance) checkNotExpired() error {
+	if i.Expired == nil {
+		return nil
+	}
+	return NewBrokerError(http.StatusUnprocessableEntity, "", "Instance %s of %s expired at %s and its resources were removed, deprovision it.",
+		i.InstanceID, i.serviceName(), i.Expired.Format(time.RFC3339))
+}
+
+func (e *Entry) validateExpiry() ValidationErrors {
+	errs := ValidationErrors{}
+	for _, f := range []struct{ field, value string }{
+		{"maxlifetime", e.MaxLifetime},
+		{"idletimeout", e.IdleTimeout},
+		{"expirywarning", e.ExpiryWarning},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(f.value); err != nil {
+			errs = append(errs, ValidationError{e.Origin, f.field, fmt.Sprintf("invalid duration: %s", err), SeverityError})
+		} else if d <= 0 {
+			errs = append(errs, ValidationError{e.Origin, f.field, "must be positive", SeverityError})
+		}
+	}
+	if e.ExpiryWarning != "" && e.MaxLifetime == "" && e.IdleTimeout == "" {
+		errs = append(errs, ValidationError{e.Origin, "expirywarning", "set but neither maxlifetime nor idletimeout is", SeverityWarning})
+	}
+	return errs
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// Expire expires every instance past its lifetime, and warns of those near it
+func (c *ProductionController) Expire() error {
+	c.rwMutex.RLock()
+	instances, err := ListInstances(c.Storage)
+	c.rwMutex.RUnlock()
+	if err != nil {
+		glog.Errorf("Failed to list instances to expire: %s", err)
+		return err
+	}
+
+	now := time.Now()
+	for _, instance := range instances {
+		if instance.Expired != nil {
+			continue
+		}
+		if err := c.expireInstance(instance.InstanceID, now); err != nil {
+			glog.Errorf("Failed to expire instance %s: %s", instance.InstanceID, err)
+		}
+	}
+	return nil
+}
+
+func (c *ProductionController) expireInstance(id string, now time.Time) error {
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+
+	instance, err := LoadInstance(c.Storage, id)
+	if err != nil || instance.Expired != nil || c.busy[id] > 0 {
+		// removed or expired since listed, or in the middle of an operation
+		return nil
+	}
+	defer c.markBusy(id)()
+	entry := c.currentEntry(instance)
+	bindings, err := InstanceBindings(c.Storage, id)
+	if err != nil {
+		return err
+	}
+	at, ok := instance.expiresAt(entry, len(bindings) > 0)
+	if !ok {
+		return nil
+	}
+	// instances provisioned before lifetimes were recorded start now
+	if instance.Created.IsZero() {
+		instance.Created = now
+		return SaveInstance(c.Storage, id, instance)
+	}
+
+	if now.Before(at) {
+		warning := parseLifetime(entry.ExpiryWarning)
+		if warning > 0 && !instance.ExpiryWarned && now.After(at.Add(-warning)) {
+			message := fmt.Sprintf("Instance %s of %s expires at %s", id, entry.serviceName(), at.Format(time.RFC3339))
+			glog.Infof("%s", message)
+			c.recordInstanceEvent(instance, v1.EventTypeWarning, "ExpiringSoon", message)
+			instance.ExpiryWarned = true
+			return SaveInstance(c.Storage, id, instance)
+		}
+		return nil
+	}
+
+	if dependents, err := Dependents(c.Storage, id); err == nil && len(dependents) > 0 {
+		glog.Warningf("Instance %s is past its lifetime, but required by instances %v", id, dependents)
+		return nil
+	}
+
+	glog.Infof("Instance %s of %s expired at %s, deprovisioning", id, entry.serviceName(), at.Format(time.RFC3339))
+	values, err := c.instanceValues(instance)
+	if err != nil {
+		return err
+	}
+	// bindings are unbound first, hooks included; a failed required hook
+	// is tried again on the next pass
+	for _, bindingID := range bindings {
+		bound := *values
+		bound.BindingID = bindingID
+		if err := c.unbind(bindingID, entry, &bound); err != nil {
+			return err
+		}
+	}
+	if err := c.runHook(HookPreDeprovision, entry, values); err != nil {
+		return err
+	}
+	if err := instance.Deprovision(c.Kube); err != nil {
+		return err
+	}
+	c.deprovisionPrerequisites(id, instance.Prerequisites)
+	c.runHook(HookPostDeprovision, entry, values)
+	instance.Expired = &now
+	if err := SaveExpiredInstance(c.Storage, id, instance, c.Options.Expirer.Retention); err != nil {
+		return err
+	}
+	c.recordInstanceEvent(instance, v1.EventTypeWarning, "Expired",
+		fmt.Sprintf("Instance %s of %s expired and its resources were removed", id, entry.serviceName()))
+	c.refreshCatalogStatus()
+	return nil
+}
+
+// recordInstanceEvent records an event on the namespace of the instance,
+// where its consumers will see it
+func (c *ProductionController) recordInstanceEvent(instance *Instance, eventType, reason, message string) {
+	if instance.ConsumerNamespace == "" {
+		return
+	}
+	ref := &v1.ObjectReference{Kind: "Namespace", APIVersion: "v1", Name: instance.ConsumerNamespace}
+	if err := c.Kube.RecordEvent(ref, eventType, reason, message); err != nil {
+		glog.Errorf("Failed to record %s event on namespace %s: %s", reason, instance.ConsumerNamespace, err)
+	}
+}
+
+// runExpirer expires instances every interval until stop is closed
+func (c *ProductionController) runExpirer(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.Options.Expirer.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Expire()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiresAt(t *testing.T) {
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		entry    Entry
+		lastUsed time.Time
+		bound    bool
+		expected time.Time
+	}{
+		{"no limits", Entry{}, time.Time{}, false, time.Time{}},
+		{"lifetime", Entry{MaxLifetime: "72h"}, created.Add(time.Hour), false, created.Add(72 * time.Hour)},
+		{"idle, never used", Entry{IdleTimeout: "8h"}, time.Time{}, false, created.Add(8 * time.Hour)},
+		{"idle, used", Entry{IdleTimeout: "8h"}, created.Add(time.Hour), false, created.Add(9 * time.Hour)},
+		{"idle, bound", Entry{IdleTimeout: "8h"}, created.Add(time.Hour), true, time.Time{}},
+		{"lifetime first", Entry{MaxLifetime: "4h", IdleTimeout: "8h"}, created.Add(time.Hour), false, created.Add(4 * time.Hour)},
+		{"lifetime, bound", Entry{MaxLifetime: "12h", IdleTimeout: "8h"}, created.Add(time.Hour), true, created.Add(12 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		i := Instance{Created: created, LastUsed: test.lastUsed}
+		at, ok := i.expiresAt(&test.entry, test.bound)
+		if ok != !test.expected.IsZero() || !at.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, at)
+		}
+	}
+}
+
+func TestExpiredInstance(t *testing.T) {
+	s := NewMemStorage()
+	entry := Entry{Team: "qa", Offering: "stack", UUID: "1"}
+	if err := SaveInstance(s, "a", &Instance{Entry: entry, InstanceID: "a", ConsumerNamespace: "pr-1"}); err != nil {
+		t.Fatal(err)
+	}
+	instance, _ := LoadInstance(s, "a")
+	if err := instance.checkNotExpired(); err != nil {
+		t.Errorf("unexpected %s", err)
+	}
+
+	now := time.Now()
+	instance.Expired = &now
+	if err := SaveExpiredInstance(s, "a", instance, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := CountNamespaceInstances(s, "1", "pr-1"); n != 0 {
+		t.Errorf("expected an expired instance not to count, got %d", n)
+	}
+	instance, _ = LoadInstance(s, "a")
+	if be, ok := instance.checkNotExpired().(*BrokerError); !ok || be.Status != 422 {
+		t.Errorf("expected a 422, got %v", be)
+	}
+
+	// the record is dropped after retention
+	if err := SaveExpiredInstance(s, "a", instance, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if InstanceExists(s, "a") {
+		t.Errorf("expected the expired instance to be gone after retention")
+	}
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// Catalog entries and wrapped resources kept in a git repository, as the
+// same manifests that would otherwise be applied to the broker namespace.
+// The repository is cloned into a working directory and the configured
+// ref checked out, then polled for new commits. The git binary must be on
+// the PATH.
+type GitCatalogSource struct {
+	// url or path of the repository, ex https://github.com/org/catalog.git or file:///srv/catalog
+	Repository string
+	// branch, tag or commit to check out, master if empty
+	Ref string
+	// directory within the repository holding the manifests, the root if empty
+	Directory string
+	// how often to look for new commits, never if zero
+	Interval time.Duration
+	// where the repository is cloned
+	Workdir string
+
+	syncMutex sync.Mutex
+	mutex     sync.RWMutex
+	revision  string
+	manifests *CatalogManifests
+	// why the last sync failed, nil if it succeeded
+	syncErr  error
+	handlers []func(origin string)
+}
+
+func NewGitCatalogSource(repository, ref, directory, workdir string, interval time.Duration) *GitCatalogSource {
+	if ref == "" {
+		ref = "master"
+	}
+	return &GitCatalogSource{
+		Repository: repository,
+		Ref:        ref,
+		Directory:  directory,
+		Interval:   interval,
+		Workdir:    workdir,
+	}
+}
+
+func (s *GitCatalogSource) Name() string {
+	return fmt.Sprintf("git %s@%s", s.Repository, s.Ref)
+}
+
+// Revision is the commit the catalog was last loaded from, empty until
+// first synced
+func (s *GitCatalogSource) Revision() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.revision
+}
+
+// Load returns the entries of the commit last checked out, with the error
+// of the last sync if it failed
+func (s *GitCatalogSource) Load() ([]Entry, ValidationErrors, error) {
+	manifests, revision, err := s.current()
+	if manifests == nil {
+		return nil, nil, err
+	}
+
+	entries, errs := manifests.Entries()
+	for i := range entries {
+		entries[i].Revision = revision
+	}
+	return entries, errs, err
+}
+
+// WrappedResources returns the wrapped resources of the commit last checked
+// out, however the last sync went
+func (s *GitCatalogSource) WrappedResources(labelSelector string) ([]v1.ConfigMap, error) {
+	manifests, _, err := s.current()
+	if manifests == nil {
+		return nil, err
+	}
+	return manifests.Wrapped(labelSelector)
+}
+
+func (s *GitCatalogSource) OnChange(handler func(origin string)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Run polls the repository for new commits until stop is closed
+func (s *GitCatalogSource) Run(stop <-chan struct{}) error {
+	if _, _, err := s.current(); err != nil {
+		glog.Errorf("Failed initial sync of %s: %s", s.Name(), err)
+	}
+	if s.Interval <= 0 {
+		<-stop
+		return nil
+	}
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := s.Sync(); err != nil {
+				glog.Errorf("Failed to sync %s: %s", s.Name(), err)
+			}
+		}
+	}
+}
+
+// current returns the loaded manifests and why the last sync failed, if it
+// did, syncing first if there are none
+func (s *GitCatalogSource) current() (*CatalogManifests, string, error) {
+	s.mutex.RLock()
+	manifests, revision, err := s.manifests, s.revision, s.syncErr
+	s.mutex.RUnlock()
+	if manifests != nil {
+		return manifests, revision, err
+	}
+
+	if err := s.Sync(); err != nil {
+		return nil, "", err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.manifests, s.revision, nil
+}
+
+// Sync fetches the repository and, when the ref has moved, checks out the
+// new commit and reads its manifests. Change handlers are told of the new
+// commit, and when syncs start or stop failing, so the failure is reported
+// while the last commit is still offered.
+func (s *GitCatalogSource) Sync() error {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	moved, err := s.syncRevision()
+	s.mutex.Lock()
+	changed := moved || (err == nil) != (s.syncErr == nil)
+	s.syncErr = err
+	revision := s.revision
+	handlers := append([]func(string){}, s.handlers...)
+	s.mutex.Unlock()
+
+	if changed && revision != "" {
+		for _, handler := range handlers {
+			handler(fmt.Sprintf("git/%s", revision))
+		}
+	}
+	return err
+}
+
+// syncRevision checks out and reads the commit the ref names, reporting
+// whether it replaced one checked out before
+func (s *GitCatalogSource) syncRevision() (bool, error) {
+	if _, err := os.Stat(filepath.Join(s.Workdir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(s.Workdir, 0700); err != nil {
+			return false, err
+		}
+		if _, err := s.git("clone", "--no-checkout", s.Repository, "."); err != nil {
+			return false, err
+		}
+	}
+	if _, err := s.git("fetch", "--prune", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+		return false, err
+	}
+
+	revision, err := s.resolve()
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.RLock()
+	unchanged := revision == s.revision && s.manifests != nil
+	s.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	if _, err := s.git("checkout", "--force", "--detach", revision); err != nil {
+		return false, err
+	}
+	manifests, err := ReadCatalogDirectory(filepath.Join(s.Workdir, s.Directory), path.Join("git", s.Directory))
+	if err != nil {
+		return false, err
+	}
+	glog.Infof("Loaded catalog from %s at commit %s", s.Name(), revision)
+
+	s.mutex.Lock()
+	moved := s.revision != ""
+	s.revision = revision
+	s.manifests = manifests
+	s.mutex.Unlock()
+	return moved, nil
+}
+
+// resolve finds the commit the ref names, preferring the remote branch
+func (s *GitCatalogSource) resolve() (string, error) {
+	var err error
+	for _, candidate := range []string{"origin/" + s.Ref, s.Ref} {
+		var out string
+		if out, err = s.git("rev-parse", "--verify", "--quiet", candidate+"^{commit}"); err == nil {
+			return out, nil
+		}
+	}
+	return "", fmt.Errorf("ref %s not found in %s", s.Ref, s.Repository)
+}
+
+func (s *GitCatalogSource) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.Workdir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
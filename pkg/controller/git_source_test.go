@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const gitCatalogEntry = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: entry
+  labels:
+    mesitis/kind: catalog-entry
+data:
+  wrapped-resource: |
+    {"team": "api", "offering": "api-service", "uuid": "3", "version": "1", "whitelist": ["client-ns"],
+     "ProvisionNonClusterURL": {"url": "https://example.com"}, "CredentialNoCredential": {}}
+`
+
+func TestGitSourceFailingSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not on the PATH")
+	}
+	dir, err := ioutil.TempDir("", "mesitis-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(repo, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, "entry.yaml"), []byte(gitCatalogEntry), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"symbolic-ref", "HEAD", "refs/heads/master"},
+		{"add", "entry.yaml"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "catalog"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+
+	source := NewGitCatalogSource("file://"+repo, "", "", filepath.Join(dir, "work"), 0)
+	changes := 0
+	source.OnChange(func(string) { changes++ })
+	if entries, _, err := source.Load(); err != nil || len(entries) != 1 {
+		t.Fatalf("expected the entry, got %v %v", entries, err)
+	}
+
+	// the last commit is still offered, with the failure to report
+	os.RemoveAll(repo)
+	if err := source.Sync(); err == nil {
+		t.Fatalf("expected the sync to fail without the repository")
+	}
+	entries, _, err := source.Load()
+	if err == nil || len(entries) != 1 {
+		t.Errorf("expected the entry with the failure, got %v %v", entries, err)
+	}
+	if changes != 1 {
+		t.Errorf("expected the failure to be announced once, got %d", changes)
+	}
+}
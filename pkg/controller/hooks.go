@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Providers run Jobs at points in an instance's life, to migrate, seed or
+// register consumers. Each hook selects Jobs wrapped like other resources,
+// labeled mesitis/kind=job. The broker creates them with the instance,
+// binding and consumer injected, waits for them to finish and deletes them.
+// A required hook that fails fails the operation, and a failed
+// postprovision or postbind hook rolls it back; others are reported only.
+// The broker does not hold its lock while waiting for Jobs, so other
+// instances are served meanwhile; operations on the instance itself, and
+// on the prerequisites it is provisioned with, are refused until its
+// operation has finished.
+const (
+	HookPreProvision    = "preprovision"
+	HookPostProvision   = "postprovision"
+	HookPreBind         = "prebind"
+	HookPostBind        = "postbind"
+	HookPreUnbind       = "preunbind"
+	HookPostUnbind      = "postunbind"
+	HookPreDeprovision  = "predeprovision"
+	HookPostDeprovision = "postdeprovision"
+)
+
+var hookPoints = map[string]bool{
+	HookPreProvision: true, HookPostProvision: true,
+	HookPreBind: true, HookPostBind: true,
+	HookPreUnbind: true, HookPostUnbind: true,
+	HookPreDeprovision: true, HookPostDeprovision: true,
+}
+
+const (
+	hookJobKind      = "job"
+	hookLabel        = "mesitis/hook"
+	hookPollInterval = 2 * time.Second
+)
+
+type HookOptions struct {
+	// how long to wait for the Jobs of hooks that do not say
+	Timeout time.Duration
+}
+
+// Jobs run at one point
+type Hook struct {
+	LabelSelector string `json:"labelselector"`
+	// fail the operation if a Job fails
+	Required bool `json:"required,omitempty"`
+	// how long to wait for the Jobs, the broker's hook timeout if empty
+	Timeout string `json:"timeout,omitempty"`
+	// where the Jobs run, the broker namespace if empty
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func (h *Hook) timeout(def time.Duration) time.Duration {
+	if d := parseLifetime(h.Timeout); d > 0 {
+		return d
+	}
+	return def
+}
+
+// hookEnv is the context every container of a hook Job is given
+func hookEnv(point string, entry *Entry, values *TemplateValues) []v1.EnvVar {
+	env := []v1.EnvVar{
+		{Name: "MESITIS_HOOK", Value: point},
+		{Name: "MESITIS_OFFERING", Value: entry.serviceName()},
+		{Name: "MESITIS_INSTANCE_ID", Value: values.InstanceID},
+		{Name: "MESITIS_CONSUMER_NAMESPACE", Value: values.Namespace},
+	}
+	if values.BindingID != "" {
+		env = append(env, v1.EnvVar{Name: "MESITIS_BINDING_ID", Value: values.BindingID})
+	}
+	if len(values.Parameters) > 0 {
+		if js, err := json.Marshal(values.Parameters); err == nil {
+			env = append(env, v1.EnvVar{Name: "MESITIS_PARAMETERS", Value: string(js)})
+		}
+	}
+	return env
+}
+
+// prepareHookJob reads a rendered Job, names it uniquely, labels it with its
+// owner and hook, and injects the context into its containers
+func prepareHookJob(doc, point string, owner, annotations map[string]string, env []v1.EnvVar) (*batchv1.Job, error) {
+	stamped, err := stampOwner(doc, owner, annotations)
+	if err != nil {
+		return nil, err
+	}
+	var job batchv1.Job
+	if err := unmarshalManifest(stamped, &job); err != nil {
+		return nil, err
+	}
+	job.ObjectMeta.Labels[hookLabel] = point
+
+	// a hook runs once per operation, so its Jobs cannot share a name
+	prefix := job.ObjectMeta.Name
+	if prefix == "" {
+		prefix = "mesitis-" + point
+	}
+	job.ObjectMeta.Name = ""
+	job.ObjectMeta.GenerateName = prefix + "-"
+
+	spec := &job.Spec.Template.Spec
+	for _, containers := range [][]v1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			containers[i].Env = append(containers[i].Env, env...)
+		}
+	}
+	if spec.RestartPolicy == "" {
+		spec.RestartPolicy = v1.RestartPolicyNever
+	}
+	return &job, nil
+}
+
+// jobFinished reports whether a Job has finished, and why it failed if so
+func jobFinished(job *batchv1.Job) (bool, error) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != v1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, nil
+		case batchv1.JobFailed:
+			return true, fmt.Errorf("%s: %s", c.Reason, c.Message)
+		}
+	}
+	return false, nil
+}
+
+// runHook runs the Jobs of the entry's hook at a point, if it has one
+func (c *ProductionController) runHook(point string, entry *Entry, values *TemplateValues) error {
+	hook := entry.Hooks[point]
+	if hook == nil {
+		return nil
+	}
+	if err := c.runHookJobs(point, hook, entry, values); err != nil {
+		message := fmt.Sprintf("Hook %s of %s failed for instance %s: %s", point, entry.serviceName(), values.InstanceID, err)
+		c.recordInstanceEvent(&Instance{ConsumerNamespace: values.Namespace}, v1.EventTypeWarning, "HookFailed", message)
+		if hook.Required {
+			glog.Errorf("%s", message)
+			return NewBrokerError(http.StatusInternalServerError, "", "%s", message)
+		}
+		glog.Warningf("%s, continuing as the hook is not required", message)
+	}
+	return nil
+}
+
+func (c *ProductionController) runHookJobs(point string, hook *Hook, entry *Entry, values *TemplateValues) error {
+	wrapped, err := ProvisionNewClusterObjects{LabelSelector: hook.LabelSelector}.render(c.Kube, entry, values)
+	if err != nil {
+		return err
+	}
+	namespace := hook.Namespace
+	if namespace == "" {
+		namespace = c.Kube.BrokerNamespace()
+	}
+	owner := ownerLabels(c.Kube, values.InstanceID, entry, values)
+	annotations := ownerAnnotations(values.InstanceID, entry)
+	env := hookEnv(point, entry, values)
+
+	// Jobs run one after another, in the order of their ConfigMaps
+	for _, w := range wrapped {
+		if w.kind != hookJobKind {
+			continue
+		}
+		job, err := prepareHookJob(w.doc, point, owner, annotations, env)
+		if err != nil {
+			glog.Errorf("Failed to read hook %s Job of %s: %s", point, entry.serviceName(), err)
+			return err
+		}
+		if err := c.runJob(namespace, job, hook.timeout(c.Options.Hooks.Timeout)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runJob creates a Job, waits for it to finish and deletes it. It is called
+// holding the write lock, and lets go of it while waiting, so callers mark
+// the instance busy for their whole operation.
+func (c *ProductionController) runJob(namespace string, job *batchv1.Job, timeout time.Duration) error {
+	created, err := c.Kube.CreateJob(namespace, job)
+	if err != nil {
+		return err
+	}
+	name := created.ObjectMeta.Name
+	glog.Infof("Created hook Job %s/%s", namespace, name)
+	defer func() {
+		if err := c.Kube.DeleteJob(namespace, name); err != nil {
+			glog.Errorf("Failed to delete hook Job %s/%s: %s", namespace, name, err)
+		}
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := c.Kube.GetJob(namespace, name)
+		if err != nil {
+			return err
+		}
+		if done, failed := jobFinished(current); done {
+			if failed != nil {
+				return fmt.Errorf("Job %s/%s failed: %s", namespace, name, failed)
+			}
+			glog.Infof("Hook Job %s/%s completed", namespace, name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Job %s/%s did not finish within %s", namespace, name, timeout)
+		}
+		c.rwMutex.Unlock()
+		time.Sleep(hookPollInterval)
+		c.rwMutex.Lock()
+	}
+}
+
+// markBusy marks an instance in the middle of an operation, which may let
+// go of the lock while its hooks run, until the returned func is called.
+// Marks nest, as provisioning an instance provisions its prerequisites.
+func (c *ProductionController) markBusy(id string) func() {
+	if c.busy == nil {
+		c.busy = make(map[string]int)
+	}
+	c.busy[id]++
+	return func() {
+		if c.busy[id]--; c.busy[id] == 0 {
+			delete(c.busy, id)
+		}
+	}
+}
+
+// checkNotBusy refuses an operation on an instance in the middle of another
+func (c *ProductionController) checkNotBusy(id string) error {
+	if c.busy[id] > 0 {
+		return NewBrokerError(http.StatusUnprocessableEntity, "ConcurrencyError", "Instance %s is in the middle of an operation, try again once it has finished.", id)
+	}
+	return nil
+}
+
+func (e *Entry) validateHooks(wrapped []v1.ConfigMap) ValidationErrors {
+	errs := ValidationErrors{}
+	points := make([]string, 0, len(e.Hooks))
+	for point := range e.Hooks {
+		points = append(points, point)
+	}
+	sort.Strings(points)
+	for _, point := range points {
+		hook := e.Hooks[point]
+		field := "hooks." + point
+		if !hookPoints[point] {
+			errs = append(errs, ValidationError{e.Origin, field, fmt.Sprintf("unknown hook, expected one of %s", strings.Join(sortedKeys(hookPoints), ", ")), SeverityError})
+			continue
+		}
+		if hook == nil {
+			continue
+		}
+		selectorErrs := e.validateLabelSelector(field+".labelselector", hook.LabelSelector, wrapped)
+		errs = append(errs, selectorErrs...)
+		if hook.Timeout != "" {
+			if d, err := time.ParseDuration(hook.Timeout); err != nil {
+				errs = append(errs, ValidationError{e.Origin, field + ".timeout", fmt.Sprintf("invalid duration: %s", err), SeverityError})
+			} else if d <= 0 {
+				errs = append(errs, ValidationError{e.Origin, field + ".timeout", "must be positive", SeverityError})
+			}
+		}
+		if selector, err := labels.Parse(hook.LabelSelector); err == nil && len(selectorErrs) == 0 && !selectsJob(selector, wrapped) {
+			errs = append(errs, ValidationError{e.Origin, field + ".labelselector", "selects no Jobs", SeverityWarning})
+		}
+	}
+	return errs
+}
+
+// hookSelected reports whether a hook of any of the entries selects the
+// wrapped resource
+func hookSelected(cm *v1.ConfigMap, entries []Entry) bool {
+	for i := range entries {
+		for _, hook := range entries[i].Hooks {
+			if hook == nil || hook.LabelSelector == "" {
+				continue
+			}
+			if selector, err := labels.Parse(hook.LabelSelector); err == nil && selector.Matches(labels.Set(cm.Labels)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectsJob reports whether any enabled wrapped resource the selector
+// matches holds a Job
+func selectsJob(selector labels.Selector, wrapped []v1.ConfigMap) bool {
+	for _, cm := range wrapped {
+		if cm.Labels["mesitis/enabled"] != "true" || !selector.Matches(labels.Set(cm.Labels)) {
+			continue
+		}
+		docs, err := splitManifests(cm.Data[wrappedDataKey])
+		if err != nil {
+			if cm.Labels["mesitis/template"] == "true" && templateMayHoldJob(&cm) {
+				return true
+			}
+			continue
+		}
+		for _, doc := range docs {
+			if manifestKind(doc, cm.Labels["mesitis/kind"]) == hookJobKind {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// a kind of Job in the text of a template
+var templateJobKind = regexp.MustCompile(`"?kind"?\s*:\s*"?Job\b`)
+
+// templateMayHoldJob reports whether a templated wrapped resource, which
+// cannot be read until rendered, is labeled as or names a Job
+func templateMayHoldJob(cm *v1.ConfigMap) bool {
+	return cm.Labels["mesitis/kind"] == hookJobKind || templateJobKind.MatchString(cm.Data[wrappedDataKey])
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestPrepareHookJob(t *testing.T) {
+	doc := `{"apiVersion":"batch/v1","kind":"Job","metadata":{"name":"migrate"},
+		"spec":{"template":{"spec":{"containers":[{"name":"migrate","image":"api-db-migrate:1","env":[{"name":"LEVEL","value":"info"}]}]}}}}`
+	env := hookEnv(HookPostBind, &Entry{Team: "infra", Offering: "api-db"}, &TemplateValues{InstanceID: "a", Namespace: "web", BindingID: "x"})
+
+	job, err := prepareHookJob(doc, HookPostBind, map[string]string{instanceLabel: "a"}, map[string]string{}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != "" || job.GenerateName != "migrate-" {
+		t.Errorf("expected a generated name, got %s and %s", job.Name, job.GenerateName)
+	}
+	if job.Labels[hookLabel] != HookPostBind || job.Labels[instanceLabel] != "a" {
+		t.Errorf("unexpected labels %v", job.Labels)
+	}
+	if job.Spec.Template.Spec.RestartPolicy != v1.RestartPolicyNever {
+		t.Errorf("expected restart policy Never, got %s", job.Spec.Template.Spec.RestartPolicy)
+	}
+	found := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		found[e.Name] = e.Value
+	}
+	for name, value := range map[string]string{"LEVEL": "info", "MESITIS_HOOK": "postbind", "MESITIS_OFFERING": "infra-api-db",
+		"MESITIS_INSTANCE_ID": "a", "MESITIS_CONSUMER_NAMESPACE": "web", "MESITIS_BINDING_ID": "x"} {
+		if found[name] != value {
+			t.Errorf("expected %s=%s, got %s", name, value, found[name])
+		}
+	}
+}
+
+func TestJobFinished(t *testing.T) {
+	condition := func(kind batchv1.JobConditionType, s v1.ConditionStatus) *batchv1.Job {
+		return &batchv1.Job{Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: kind, Status: s, Reason: "BackoffLimitExceeded"}}}}
+	}
+	tests := []struct {
+		name   string
+		job    *batchv1.Job
+		done   bool
+		failed bool
+	}{
+		{"running", &batchv1.Job{}, false, false},
+		{"complete", condition(batchv1.JobComplete, v1.ConditionTrue), true, false},
+		{"failed", condition(batchv1.JobFailed, v1.ConditionTrue), true, true},
+		{"not yet failed", condition(batchv1.JobFailed, v1.ConditionFalse), false, false},
+	}
+	for _, test := range tests {
+		done, err := jobFinished(test.job)
+		if done != test.done || (err != nil) != test.failed {
+			t.Errorf("%s: expected %v and failed %v, got %v and %v", test.name, test.done, test.failed, done, err)
+		}
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	if d := (&Hook{Timeout: "10m"}).timeout(time.Minute); d != 10*time.Minute {
+		t.Errorf("expected the hook's own timeout, got %s", d)
+	}
+	if d := (&Hook{}).timeout(time.Minute); d != time.Minute {
+		t.Errorf("expected the broker's timeout, got %s", d)
+	}
+}
+
+func TestCheckNotBusy(t *testing.T) {
+	c := &ProductionController{}
+	release := c.markBusy("a")
+	err := c.checkNotBusy("a")
+	if be, ok := err.(*BrokerError); !ok || be.ErrorCode != "ConcurrencyError" {
+		t.Errorf("expected a ConcurrencyError, got %v", err)
+	}
+	if err := c.checkNotBusy("b"); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	// an operation nested in another leaves it marked
+	c.markBusy("a")()
+	if err := c.checkNotBusy("a"); err == nil {
+		t.Errorf("expected the outer operation to keep its mark")
+	}
+	release()
+	if err := c.checkNotBusy("a"); err != nil {
+		t.Errorf("expected no error once released, got %s", err)
+	}
+}
+
+// runs hook Jobs, which finish once released
+type jobKube struct {
+	Kube
+	created chan string
+	release chan struct{}
+}
+
+func (k *jobKube) BrokerNamespace() string { return "mesitis" }
+
+func (k *jobKube) CreateJob(namespace string, job *batchv1.Job) (*batchv1.Job, error) {
+	created := job.DeepCopy()
+	created.Name = job.GenerateName + "1"
+	k.created <- created.Name
+	return created, nil
+}
+
+func (k *jobKube) GetJob(namespace, name string) (*batchv1.Job, error) {
+	select {
+	case <-k.release:
+		return &batchv1.Job{Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: v1.ConditionTrue}}}}, nil
+	default:
+		return &batchv1.Job{}, nil
+	}
+}
+
+func (k *jobKube) DeleteJob(namespace, name string) error { return nil }
+
+func (k *jobKube) RecordEvent(ref *v1.ObjectReference, eventType, reason, message string) error {
+	return nil
+}
+
+func (k *jobKube) ListCustomResources(gvr schema.GroupVersionResource, namespace, labelSelector string) ([]unstructured.Unstructured, error) {
+	return nil, nil
+}
+
+func TestProvisionDuringHook(t *testing.T) {
+	kube := &jobKube{created: make(chan string, 1), release: make(chan struct{})}
+	job := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "migrate", Labels: map[string]string{"mesitis/enabled": "true", "mesitis/kind": hookJobKind}},
+		Data: map[string]string{wrappedDataKey: `{"apiVersion":"batch/v1","kind":"Job","metadata":{"name":"migrate"},
+			"spec":{"template":{"spec":{"containers":[{"name":"migrate","image":"api-db-migrate:1"}]}}}}`},
+	}
+	entry := Entry{
+		Team: "api", Offering: "db", UUID: "1", Whitelist: []string{"web"},
+		Quota:                  &Quota{InstancesPerNamespace: 1},
+		Hooks:                  map[string]*Hook{HookPreProvision: {LabelSelector: "mesitis/kind=job", Required: true}},
+		ProvisionNonClusterURL: &ProvisionNonClusterURL{URL: "https://db.example.com"},
+		CredentialNoCredential: &CredentialNoCredential{},
+		source:                 &fakeSource{name: "test", wrapped: []v1.ConfigMap{job}},
+	}
+	c := &ProductionController{Kube: kube, Storage: NewMemStorage(), catalog: &[]Entry{entry}, Options: ControllerOptions{Hooks: HookOptions{Timeout: time.Minute}}}
+	req := &brokerapi.CreateServiceInstanceRequest{PlanID: "1", ContextProfile: brokerapi.ContextProfile{Platform: "kubernetes", Namespace: "web"}}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.CreateServiceInstance("a", req)
+		done <- err
+	}()
+	<-kube.created
+
+	// while its hook runs the first provision holds its id and its quota
+	_, err := c.CreateServiceInstance("a", req)
+	if be, ok := err.(*BrokerError); !ok || be.ErrorCode != "ConcurrencyError" {
+		t.Errorf("expected a retried provision to be refused, got %v", err)
+	}
+	_, err = c.CreateServiceInstance("b", req)
+	if be, ok := err.(*BrokerError); !ok || be.ErrorCode != quotaExceeded {
+		t.Errorf("expected another provision to exceed the quota, got %v", err)
+	}
+
+	close(kube.release)
+	if err := <-done; err != nil {
+		t.Fatalf("expected the first provision to succeed, got %s", err)
+	}
+	if !InstanceExists(c.Storage, "a") || InstanceExists(c.Storage, "b") {
+		t.Errorf("expected only instance a to be provisioned")
+	}
+	if err := c.checkNotBusy("a"); err != nil {
+		t.Errorf("expected instance a no longer busy, got %s", err)
+	}
+}
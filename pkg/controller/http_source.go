@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Catalog entries and wrapped resources served as a stream of manifests
+// from a URL, such as a file published by a CI pipeline. The URL is
+// fetched again every interval, and the ETag honored when the server
+// provides one.
+type HTTPCatalogSource struct {
+	*polledManifests
+	URL string
+	// added to every request, ex Authorization
+	Header http.Header
+
+	client *http.Client
+	etag   string
+}
+
+func NewHTTPCatalogSource(url string, header http.Header, interval time.Duration) *HTTPCatalogSource {
+	s := &HTTPCatalogSource{
+		URL:    url,
+		Header: header,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	s.polledManifests = &polledManifests{
+		name:     fmt.Sprintf("url %s", url),
+		interval: interval,
+		fetch:    s.fetch,
+	}
+	return s
+}
+
+// fetch returns nil manifests when they are unchanged since the last fetch
+func (s *HTTPCatalogSource) fetch() (*CatalogManifests, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("GET %s: %s", s.URL, resp.Status)
+	}
+
+	manifests, err := ReadCatalogManifests(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %s", s.URL, err)
+	}
+	manifests.setOrigins(s.URL)
+	s.etag = resp.Header.Get("ETag")
+	glog.Infof("Read catalog from %s", s.URL)
+	return manifests, nil
+}
@@ -0,0 +1,268 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
+)
+
+// Index sets let instances and bindings be counted and found without
+// loading them or scanning keys. Each set holds the ids sharing one fact,
+// ex index/instances/<uuid> holds the ids of the instances of an entry.
+// Sets are kept by SaveInstance, DeleteInstance, SaveBinding,
+// DeleteBinding, SaveOperation and DeleteOperation, and can be rebuilt from
+// the records.
+
+const (
+	instancesIndex          = "index/instances"
+	namespaceInstancesIndex = "index/namespace-instances"
+	bindingsIndex           = "index/bindings"
+	dependentsIndex         = "index/dependents"
+	consumersIndex          = "index/consumers"
+	// the shared Services with consumers, as <namespace>/<name>
+	sharedServicesIndex = "index/shared-services"
+	// the provisions of an entry awaiting approval, as <instance id>/<namespace>
+	pendingProvisionsIndex = "index/pending-provisions"
+)
+
+// escaped so ids cannot add a level
+func indexKey(index string, parts ...string) string {
+	key := index
+	for _, p := range parts {
+		key = fmt.Sprintf("%s/%s", key, url.QueryEscape(p))
+	}
+	return key
+}
+
+// a member of escaped parts, ex <namespace>/<name>
+func indexMember(parts ...string) string {
+	escaped := make([]string, 0, len(parts))
+	for _, p := range parts {
+		escaped = append(escaped, url.QueryEscape(p))
+	}
+	return strings.Join(escaped, "/")
+}
+
+// A member of an index set
+type indexEntry struct {
+	set    string
+	member string
+}
+
+func instanceIndexEntries(i *Instance) []indexEntry {
+	// expired instances hold no quota and consume nothing
+	if i.Expired != nil {
+		return []indexEntry{}
+	}
+	entries := []indexEntry{{indexKey(instancesIndex, i.UUID), i.InstanceID}}
+	if i.ConsumerNamespace != "" {
+		entries = append(entries, indexEntry{indexKey(namespaceInstancesIndex, i.UUID, i.ConsumerNamespace), i.InstanceID})
+	}
+	for _, p := range i.Prerequisites {
+		entries = append(entries, indexEntry{indexKey(dependentsIndex, p.InstanceID), i.InstanceID})
+	}
+	// consumers of a shared Service, whichever entry offered it
+	if p := i.ProvisionExistingClusterService; p != nil {
+		entries = append(entries, indexEntry{indexKey(consumersIndex, p.Namespace, p.Name), indexMember(i.ConsumerNamespace, i.InstanceID)})
+	}
+	return entries
+}
+
+func bindingIndexEntries(b *Binding) []indexEntry {
+	if b.Instance == nil {
+		return []indexEntry{}
+	}
+	return []indexEntry{{indexKey(bindingsIndex, b.InstanceID), b.BindingID}}
+}
+
+func operationIndexEntries(op *Operation) []indexEntry {
+	// only a provision awaiting approval holds quota
+	if op.Kind != provisionOperation || op.State != brokerapi.StateInProgress {
+		return []indexEntry{}
+	}
+	return []indexEntry{{indexKey(pendingProvisionsIndex, op.EntryUUID), indexMember(op.InstanceID, op.Namespace)}}
+}
+
+func addIndexEntries(s Storage, entries []indexEntry) error {
+	for _, e := range entries {
+		if err := s.SAdd(e.set, e.member); err != nil {
+			glog.Errorf("Failed to add %s to index %s: %s", e.member, e.set, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func remIndexEntries(s Storage, entries []indexEntry) error {
+	for _, e := range entries {
+		if err := s.SRem(e.set, e.member); err != nil {
+			glog.Errorf("Failed to remove %s from index %s: %s", e.member, e.set, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func indexInstance(s Storage, i *Instance) error {
+	if err := addIndexEntries(s, instanceIndexEntries(i)); err != nil {
+		return err
+	}
+	if p := i.ProvisionExistingClusterService; p != nil && i.Expired == nil {
+		return s.SAdd(sharedServicesIndex, indexMember(p.Namespace, p.Name))
+	}
+	return nil
+}
+
+// unindexInstance removes an instance from the indexes, and its shared
+// Service from those with consumers once it has none
+func unindexInstance(s Storage, i *Instance) error {
+	if err := remIndexEntries(s, instanceIndexEntries(i)); err != nil {
+		return err
+	}
+	if p := i.ProvisionExistingClusterService; p != nil {
+		n, err := s.SCard(indexKey(consumersIndex, p.Namespace, p.Name))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return s.SRem(sharedServicesIndex, indexMember(p.Namespace, p.Name))
+		}
+	}
+	return nil
+}
+
+func countIndex(s Storage, index string, parts ...string) (int, error) {
+	n, err := s.SCard(indexKey(index, parts...))
+	if err != nil {
+		glog.Errorf("Failed to count %s: %s", index, err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// the ids in an index set, in order
+func listIndex(s Storage, index string, parts ...string) ([]string, error) {
+	ids, err := s.SMembers(indexKey(index, parts...))
+	if err != nil {
+		glog.Errorf("Failed to list %s: %s", index, err)
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// splitIndexMember reads the n parts of a member
+func splitIndexMember(member string, n int) ([]string, error) {
+	parts := strings.Split(member, "/")
+	if len(parts) != n {
+		return nil, fmt.Errorf("malformed index member %s", member)
+	}
+	for i := range parts {
+		var err error
+		if parts[i], err = url.QueryUnescape(parts[i]); err != nil {
+			return nil, fmt.Errorf("malformed index member %s: %s", member, err)
+		}
+	}
+	return parts, nil
+}
+
+// CountInstances counts the instances of an entry
+func CountInstances(s Storage, uuid string) (int, error) {
+	return countIndex(s, instancesIndex, uuid)
+}
+
+// CountNamespaceInstances counts the instances of an entry provisioned for
+// a consumer namespace
+func CountNamespaceInstances(s Storage, uuid, namespace string) (int, error) {
+	return countIndex(s, namespaceInstancesIndex, uuid, namespace)
+}
+
+// CountBindings counts the bindings of an instance
+func CountBindings(s Storage, instanceID string) (int, error) {
+	return countIndex(s, bindingsIndex, instanceID)
+}
+
+// InstanceBindings lists the ids of the bindings of an instance
+func InstanceBindings(s Storage, instanceID string) ([]string, error) {
+	return listIndex(s, bindingsIndex, instanceID)
+}
+
+// NamespaceInstances lists the ids of the instances of an entry
+// provisioned for a consumer namespace
+func NamespaceInstances(s Storage, uuid, namespace string) ([]string, error) {
+	return listIndex(s, namespaceInstancesIndex, uuid, namespace)
+}
+
+// PendingProvisions finds the provisions of an entry awaiting approval, by
+// instance id
+func PendingProvisions(s Storage, uuid string) (map[string]PendingInstance, error) {
+	members, err := listIndex(s, pendingProvisionsIndex, uuid)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]PendingInstance, len(members))
+	for _, member := range members {
+		parts, err := splitIndexMember(member, 2)
+		if err != nil {
+			return nil, err
+		}
+		pending[parts[0]] = PendingInstance{UUID: uuid, Namespace: parts[1]}
+	}
+	return pending, nil
+}
+
+// Dependents lists the ids of the instances depending on an instance
+func Dependents(s Storage, instanceID string) ([]string, error) {
+	return listIndex(s, dependentsIndex, instanceID)
+}
+
+// RebuildIndexes replaces every index set with those derived from the
+// stored instances, bindings and operations, as after an import. It scans keys, and is
+// only run when the broker starts and after an import.
+func RebuildIndexes(s Storage) error {
+	keys, err := s.Keys("index/*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Del(key); err != nil {
+			glog.Errorf("Failed to delete index %s: %s", key, err)
+			return err
+		}
+	}
+
+	instances, err := ListInstances(s)
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if err := indexInstance(s, i); err != nil {
+			return err
+		}
+	}
+	bindings, err := ListBindings(s)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		if err := addIndexEntries(s, bindingIndexEntries(b)); err != nil {
+			return err
+		}
+	}
+	operations, err := ListOperations(s)
+	if err != nil {
+		return err
+	}
+	for _, op := range operations {
+		if err := addIndexEntries(s, operationIndexEntries(op)); err != nil {
+			return err
+		}
+	}
+
+	glog.Infof("Rebuilt indexes of <%d> instances, <%d> bindings and <%d> operations.", len(instances), len(bindings), len(operations))
+	return nil
+}
@@ -1,19 +1,34 @@
 package controller
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	v1beta1 "k8s.io/api/apps/v1beta1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
-	k8serr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 // TODO is it necessary to have these distinct create functions?
-// TODO can't it be just CreateObjectFromJSON?
+// TODO can't it be just CreateObjectFromJSON? see createObject
 type Kube interface {
 	BrokerNamespace() string
 	ListConfigMaps(namespace, labelSelector string) (*v1.ConfigMapList, error)
@@ -33,46 +48,186 @@ type Kube interface {
 	ConfigMapExists(string, string) bool
 	SecretExists(string, string) bool
 	GetSecret(namespace, name string) (*v1.Secret, error)
+	GetNamespace(name string) (*v1.Namespace, error)
+	GetService(namespace, name string) (*v1.Service, error)
+	GetEndpoints(namespace, name string) (*v1.Endpoints, error)
+	CanI(namespace, verb, group, resource string) (bool, string, error)
+	ListLabeledObjects(labelSelector string) ([]LabeledObject, error)
+	GetObject(kind, namespace, name string) (map[string]interface{}, error)
+	DryRunCreate(kind, namespace, JSON string) (map[string]interface{}, error)
+	ApplyObject(kind, namespace, JSON string, force bool) (map[string]interface{}, error)
+	DryRunApply(kind, namespace, JSON string) (map[string]interface{}, error)
+	CreateJob(namespace string, job *batchv1.Job) (*batchv1.Job, error)
+	GetJob(namespace, name string) (*batchv1.Job, error)
+	DeleteJob(namespace, name string) error
+	OnCatalogChange(handler func(origin string))
+	ListCustomResources(gvr schema.GroupVersionResource, namespace, labelSelector string) ([]unstructured.Unstructured, error)
+	UpdateCustomResourceStatus(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error
+	RecordEvent(ref *v1.ObjectReference, eventType, reason, message string) error
+	RelistServiceBroker(name string) error
 }
 
 type RealKube struct {
 	Namespace string
 	Tmpdir    string
+	Clientset kubernetes.Interface
+	Dynamic   dynamic.Interface
+
+	// cache of the mesitis ConfigMaps in the broker namespace
+	configMaps cache.SharedIndexInformer
+	handlers   []func(string)
+	synced     bool
+	mutex      sync.RWMutex
 }
 
+// only ConfigMaps carrying a mesitis/kind label are cached- catalog
+// entries and wrapped resources
+const cachedConfigMapSelector = "mesitis/kind"
+
+// how often the cache is resynced with the api server
+const configMapResync = 10 * time.Minute
+
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
 
-// TODO don't panic
-func kubeapi() *kubernetes.Clientset {
-	// creates the in-cluster config
+// NewRealKube builds the clients shared by all requests. The in-cluster
+// config is preferred, falling back to $KUBECONFIG for use outside a cluster.
+func NewRealKube(namespace, tmpdir string) (*RealKube, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		panic(err.Error())
+		glog.Infof("Not running in cluster (%s), using KUBECONFIG", err)
+		if config, err = clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG")); err != nil {
+			glog.Errorf("Failed to configure kubernetes client: %s", err)
+			return nil, err
+		}
 	}
-	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		glog.Errorf("Failed to create kubernetes client: %s", err)
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		glog.Errorf("Failed to create kubernetes dynamic client: %s", err)
+		return nil, err
 	}
-	return clientset
+	return &RealKube{Namespace: namespace, Tmpdir: tmpdir, Clientset: clientset, Dynamic: dynamicClient}, nil
 }
 
-// TODO is this necessary?
-func kubeError(err error) {
-	if k8serr.IsNotFound(err) {
-		glog.Errorf("Object not found: %s", err)
-	} else if statusError, isStatus := err.(*k8serr.StatusError); isStatus {
-		glog.Errorf("Error creating object %s\n", statusError.ErrStatus.Message)
-	} else if err != nil {
-		glog.Errorf(err.Error())
+// StartCache starts watching ConfigMaps in the broker namespace and blocks
+// until the cache has synced. Until then, and if never started, ConfigMaps
+// are listed from the api server. CatalogEntries and WrappedResources are
+// watched too when their CRDs are installed, and are always listed from
+// the api server.
+func (k *RealKube) StartCache(stop <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.Clientset, configMapResync,
+		informers.WithNamespace(k.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = cachedConfigMapSelector
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			k.changed(obj)
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			if old.(*v1.ConfigMap).ResourceVersion != obj.(*v1.ConfigMap).ResourceVersion {
+				k.changed(obj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			k.changed(obj)
+		},
+	})
+	synced := []cache.InformerSynced{informer.HasSynced}
+
+	dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(k.Dynamic, configMapResync, k.Namespace, nil)
+	for _, gvr := range []schema.GroupVersionResource{catalogEntries, wrappedResources} {
+		if _, err := k.ListCustomResources(gvr, k.Namespace, ""); err != nil {
+			glog.Infof("Not watching %s: %s", gvr.Resource, err)
+			continue
+		}
+		resourceInformer := dynamicFactory.ForResource(gvr).Informer()
+		resourceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				k.changed(obj)
+			},
+			// status updates leave the generation alone
+			UpdateFunc: func(old, obj interface{}) {
+				if old.(*unstructured.Unstructured).GetGeneration() != obj.(*unstructured.Unstructured).GetGeneration() {
+					k.changed(obj)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				k.changed(obj)
+			},
+		})
+		synced = append(synced, resourceInformer.HasSynced)
+	}
+
+	factory.Start(stop)
+	dynamicFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, synced...) {
+		return errors.New("Failed to sync catalog cache")
 	}
+
+	k.mutex.Lock()
+	k.configMaps = informer
+	k.synced = true
+	k.mutex.Unlock()
+	glog.Infof("Catalog cache synced for namespace %s", k.Namespace)
+	return nil
 }
 
-/////////////////////////////////////////////////////////////////
-/////////////////////////////////////////////////////////////////
-/////////////////////////////////////////////////////////////////
+func (k *RealKube) CacheSynced() bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.synced
+}
+
+// OnCatalogChange registers a handler called with the origin of any catalog
+// entry or wrapped resource that is added, updated or deleted. The initial
+// sync is not reported.
+func (k *RealKube) OnCatalogChange(handler func(origin string)) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.handlers = append(k.handlers, handler)
+}
+
+func (k *RealKube) changed(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	var origin string
+	switch o := obj.(type) {
+	case *v1.ConfigMap:
+		// approval requests are not part of the catalog
+		if o.Labels["mesitis/kind"] == approvalRequestKind {
+			return
+		}
+		origin = configMapOrigin(o)
+	case *unstructured.Unstructured:
+		origin = resourceOrigin(strings.ToLower(o.GetKind()), o)
+	default:
+		return
+	}
+
+	k.mutex.RLock()
+	synced := k.synced
+	handlers := k.handlers
+	k.mutex.RUnlock()
+	if !synced {
+		return
+	}
+
+	glog.Infof("%s changed", origin)
+	for _, handler := range handlers {
+		handler(origin)
+	}
+}
 
 func (k *RealKube) BrokerNamespace() string {
 	return k.Namespace
@@ -80,7 +235,7 @@ func (k *RealKube) BrokerNamespace() string {
 
 func (k *RealKube) GetSecret(namespace, name string) (*v1.Secret, error) {
 
-	secret, err := kubeapi().CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	secret, err := k.Clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
 	if err != nil {
 		glog.Errorf("Failed to load secret: %s", err)
 		return nil, err
@@ -88,9 +243,208 @@ func (k *RealKube) GetSecret(namespace, name string) (*v1.Secret, error) {
 	return secret, nil
 }
 
+func (k *RealKube) GetNamespace(name string) (*v1.Namespace, error) {
+
+	ns, err := k.Clientset.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to load namespace: %s", err)
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (k *RealKube) GetService(namespace, name string) (*v1.Service, error) {
+
+	service, err := k.Clientset.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to load service: %s", err)
+		return nil, err
+	}
+	return service, nil
+}
+
+func (k *RealKube) GetEndpoints(namespace, name string) (*v1.Endpoints, error) {
+
+	endpoints, err := k.Clientset.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to load endpoints: %s", err)
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// CanI asks the api server whether the broker may act on a resource in a
+// namespace, returning the reason when it may not
+func (k *RealKube) CanI(namespace, verb, group, resource string) (bool, string, error) {
+
+	review, err := k.Clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     group,
+				Resource:  resource,
+			},
+		},
+	})
+	if err != nil {
+		glog.Errorf("Failed to review access to %s in %s: %s", resource, namespace, err)
+		return false, "", err
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// ListLabeledObjects lists the objects of each kind the broker provisions,
+// in every namespace, matching the selector
+func (k *RealKube) ListLabeledObjects(labelSelector string) ([]LabeledObject, error) {
+	opts := metav1.ListOptions{LabelSelector: labelSelector}
+	objects := make([]LabeledObject, 0)
+	add := func(kind string, meta metav1.ObjectMeta) {
+		objects = append(objects, LabeledObject{
+			ResourcesKubeObject: ResourcesKubeObject{Kind: kind, Name: meta.Name, Namespace: meta.Namespace},
+			Labels:              meta.Labels,
+			Annotations:         meta.Annotations,
+			Created:             meta.CreationTimestamp.Time,
+		})
+	}
+
+	pods, err := k.Clientset.CoreV1().Pods(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range pods.Items {
+		add("pod", o.ObjectMeta)
+	}
+	deployments, err := k.Clientset.AppsV1beta1().Deployments(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range deployments.Items {
+		add("deployment", o.ObjectMeta)
+	}
+	services, err := k.Clientset.CoreV1().Services(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range services.Items {
+		add("service", o.ObjectMeta)
+	}
+	configMaps, err := k.Clientset.CoreV1().ConfigMaps(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range configMaps.Items {
+		add("configmap", o.ObjectMeta)
+	}
+	secrets, err := k.Clientset.CoreV1().Secrets(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range secrets.Items {
+		add("secret", o.ObjectMeta)
+	}
+	return objects, nil
+}
+
+// GetObject gets a provisioned object as it is in the cluster, in the
+// form it would be written in a manifest
+func (k *RealKube) GetObject(kind, namespace, name string) (map[string]interface{}, error) {
+	r, ok := objectResources[kind]
+	if !ok {
+		return nil, fmt.Errorf("Don't know how to get object: %s", kind)
+	}
+	gv, err := schema.ParseGroupVersion(objectReferenceKinds[kind][1])
+	if err != nil {
+		return nil, err
+	}
+	obj, err := k.Dynamic.Resource(gv.WithResource(r.resource)).Namespace(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return obj.Object, nil
+}
+
+// DryRunCreate has the api server validate, default and admit an object
+// without persisting it, returning the object it would have created
+func (k *RealKube) DryRunCreate(kind, namespace, JSON string) (map[string]interface{}, error) {
+	r, ok := objectResources[kind]
+	if !ok {
+		return nil, fmt.Errorf("Don't know how to create object: %s", kind)
+	}
+	gv, err := schema.ParseGroupVersion(objectReferenceKinds[kind][1])
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(JSON)); err != nil {
+		return nil, err
+	}
+	// created through the version the broker uses, whatever the document says
+	obj.SetAPIVersion(gv.String())
+	obj.SetNamespace(namespace)
+
+	created, err := k.Dynamic.Resource(gv.WithResource(r.resource)).Namespace(namespace).Create(obj, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err != nil {
+		glog.Errorf("Dry run of %s in %s failed: %s", kind, namespace, err)
+		return nil, err
+	}
+	return created.Object, nil
+}
+
+// ApplyObject applies a provisioned object in a JSON document with
+// server-side apply, as the broker's field manager, creating it if it does
+// not exist. Unless forced, fields another manager has set to other values
+// are conflicts, and nothing is changed.
+func (k *RealKube) ApplyObject(kind, namespace, JSON string, force bool) (map[string]interface{}, error) {
+	return k.applyObject(kind, namespace, JSON, force, false)
+}
+
+// DryRunApply has the api server force an apply of a provisioned object
+// without persisting it, returning the object as it would then be
+func (k *RealKube) DryRunApply(kind, namespace, JSON string) (map[string]interface{}, error) {
+	return k.applyObject(kind, namespace, JSON, true, true)
+}
+
+func (k *RealKube) applyObject(kind, namespace, JSON string, force, dryRun bool) (map[string]interface{}, error) {
+	r, ok := objectResources[kind]
+	if !ok {
+		return nil, fmt.Errorf("Don't know how to apply object: %s", kind)
+	}
+	gv, err := schema.ParseGroupVersion(objectReferenceKinds[kind][1])
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(JSON)); err != nil {
+		return nil, err
+	}
+	obj.SetAPIVersion(gv.String())
+	obj.SetKind(objectReferenceKinds[kind][0])
+	obj.SetNamespace(namespace)
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	options := metav1.PatchOptions{FieldManager: fieldManager, Force: &force}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	applied, err := k.Dynamic.Resource(gv.WithResource(r.resource)).Namespace(namespace).Patch(obj.GetName(), types.ApplyPatchType, data, options)
+	if err != nil {
+		glog.Errorf("Failed to apply %s %s/%s: %s", kind, namespace, obj.GetName(), err)
+		return nil, err
+	}
+	return applied.Object, nil
+}
+
 func (k *RealKube) ListConfigMaps(namespace, labelSelector string) (*v1.ConfigMapList, error) {
 
-	list, err := kubeapi().CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
+	if list, ok, err := k.listCachedConfigMaps(namespace, labelSelector); ok {
+		return list, err
+	}
+
+	list, err := k.Clientset.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
 	if err != nil {
 		// TODO use in catalog is not guaranteed
 		glog.Errorf("Failed to find config maps from which to load the catalog: %s", err)
@@ -99,15 +453,44 @@ func (k *RealKube) ListConfigMaps(namespace, labelSelector string) (*v1.ConfigMa
 	return list, nil
 }
 
+// listCachedConfigMaps serves the list from the cache when the cache covers
+// the request. ok is false when the api server must be asked instead.
+func (k *RealKube) listCachedConfigMaps(namespace, labelSelector string) (list *v1.ConfigMapList, ok bool, err error) {
+	k.mutex.RLock()
+	informer := k.configMaps
+	k.mutex.RUnlock()
+
+	if informer == nil || namespace != k.Namespace {
+		return nil, false, nil
+	}
+
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		glog.Errorf("Invalid label selector %s: %s", labelSelector, err)
+		return nil, true, err
+	}
+
+	list = &v1.ConfigMapList{}
+	for _, obj := range informer.GetStore().List() {
+		cm := obj.(*v1.ConfigMap)
+		if selector.Matches(labels.Set(cm.Labels)) {
+			list.Items = append(list.Items, *cm.DeepCopy())
+		}
+	}
+	return list, true, nil
+}
+
+// The Create*FromJSON functions accept a single JSON or YAML document
+
 func (k *RealKube) CreatePodFromJSON(namespace string, JSON string) (*v1.Pod, error) {
 
 	var p v1.Pod
-	if err := json.Unmarshal([]byte(JSON), &p); err != nil {
+	if err := unmarshalManifest(JSON, &p); err != nil {
 		glog.Errorf("Failed to unmarshal a valid pod from JSON: %s\n%s\n", err, JSON)
 		return nil, err
 	}
 
-	if pod, err := kubeapi().CoreV1().Pods(namespace).Create(&p); err == nil {
+	if pod, err := k.Clientset.CoreV1().Pods(namespace).Create(&p); err == nil {
 		return pod, nil
 	} else {
 		glog.Errorf("Failed to create pod: %s", err)
@@ -118,12 +501,12 @@ func (k *RealKube) CreatePodFromJSON(namespace string, JSON string) (*v1.Pod, er
 func (k *RealKube) CreateServiceFromJSON(namespace string, JSON string) (*v1.Service, error) {
 
 	var s v1.Service
-	if err := json.Unmarshal([]byte(JSON), &s); err != nil {
+	if err := unmarshalManifest(JSON, &s); err != nil {
 		glog.Errorf("Failed to unmarshal a valid service from configmap: %s\n%s\n", err, JSON)
 		return nil, err
 	}
 
-	if service, err := kubeapi().CoreV1().Services(namespace).Create(&s); err == nil {
+	if service, err := k.Clientset.CoreV1().Services(namespace).Create(&s); err == nil {
 		return service, nil
 	} else {
 		glog.Errorf("Failed to create service: %s", err)
@@ -134,12 +517,12 @@ func (k *RealKube) CreateServiceFromJSON(namespace string, JSON string) (*v1.Ser
 func (k *RealKube) CreateDeploymentFromJSON(namespace string, JSON string) (*v1beta1.Deployment, error) {
 
 	var d v1beta1.Deployment
-	if err := json.Unmarshal([]byte(JSON), &d); err != nil {
+	if err := unmarshalManifest(JSON, &d); err != nil {
 		glog.Errorf("Failed to unmarshal a valid deployment from ConfigMap: %s\n%s\n", err, JSON)
 		return nil, err
 	}
 
-	if deployment, err := kubeapi().AppsV1beta1().Deployments(namespace).Create(&d); err == nil {
+	if deployment, err := k.Clientset.AppsV1beta1().Deployments(namespace).Create(&d); err == nil {
 		return deployment, nil
 	} else {
 		glog.Errorf("Failed to create deployment: %s", err)
@@ -150,12 +533,12 @@ func (k *RealKube) CreateDeploymentFromJSON(namespace string, JSON string) (*v1b
 func (k *RealKube) CreateConfigMapFromJSON(namespace string, JSON string) (*v1.ConfigMap, error) {
 
 	var c v1.ConfigMap
-	if err := json.Unmarshal([]byte(JSON), &c); err != nil {
+	if err := unmarshalManifest(JSON, &c); err != nil {
 		glog.Errorf("Failed to unmarshal a valid ConfigMap from configmap: %s\n%s\n", err, JSON)
 		return nil, err
 	}
 
-	if configMap, err := kubeapi().CoreV1().ConfigMaps(namespace).Create(&c); err == nil {
+	if configMap, err := k.Clientset.CoreV1().ConfigMaps(namespace).Create(&c); err == nil {
 		return configMap, nil
 	} else {
 		glog.Errorf("Failed to create ConfigMap: %s", err)
@@ -166,12 +549,12 @@ func (k *RealKube) CreateConfigMapFromJSON(namespace string, JSON string) (*v1.C
 func (k *RealKube) CreateSecretFromJSON(namespace string, JSON string) (*v1.Secret, error) {
 
 	var s v1.Secret
-	if err := json.Unmarshal([]byte(JSON), &s); err != nil {
+	if err := unmarshalManifest(JSON, &s); err != nil {
 		glog.Errorf("Failed to unmarshal a valid secret from configmap: %s\n%s\n", err, JSON)
 		return nil, err
 	}
 
-	if secret, err := kubeapi().CoreV1().Secrets(namespace).Create(&s); err == nil {
+	if secret, err := k.Clientset.CoreV1().Secrets(namespace).Create(&s); err == nil {
 		return secret, nil
 	} else {
 		glog.Errorf("Failed to create secret: %s", err)
@@ -182,7 +565,7 @@ func (k *RealKube) CreateSecretFromJSON(namespace string, JSON string) (*v1.Secr
 func (k *RealKube) DeletePod(namespace, name string) error {
 
 	fg := metav1.DeletePropagationForeground
-	err := kubeapi().CoreV1().Pods(namespace).Delete(name, &metav1.DeleteOptions{
+	err := k.Clientset.CoreV1().Pods(namespace).Delete(name, &metav1.DeleteOptions{
 		GracePeriodSeconds: &[]int64{0}[0],
 		PropagationPolicy:  &fg})
 
@@ -196,7 +579,7 @@ func (k *RealKube) DeletePod(namespace, name string) error {
 func (k *RealKube) DeleteDeployment(namespace, name string) error {
 
 	fg := metav1.DeletePropagationForeground
-	err := kubeapi().AppsV1beta1().Deployments(namespace).Delete(name, &metav1.DeleteOptions{
+	err := k.Clientset.AppsV1beta1().Deployments(namespace).Delete(name, &metav1.DeleteOptions{
 		GracePeriodSeconds: &[]int64{0}[0],
 		PropagationPolicy:  &fg})
 
@@ -207,10 +590,41 @@ func (k *RealKube) DeleteDeployment(namespace, name string) error {
 	return err
 }
 
+func (k *RealKube) CreateJob(namespace string, job *batchv1.Job) (*batchv1.Job, error) {
+
+	created, err := k.Clientset.BatchV1().Jobs(namespace).Create(job)
+	if err != nil {
+		glog.Errorf("Failed to create job: %s", err)
+		return nil, err
+	}
+	return created, nil
+}
+
+func (k *RealKube) GetJob(namespace, name string) (*batchv1.Job, error) {
+
+	job, err := k.Clientset.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to load job: %s", err)
+		return nil, err
+	}
+	return job, nil
+}
+
+// DeleteJob deletes a Job and its pods
+func (k *RealKube) DeleteJob(namespace, name string) error {
+
+	bg := metav1.DeletePropagationBackground
+	err := k.Clientset.BatchV1().Jobs(namespace).Delete(name, &metav1.DeleteOptions{PropagationPolicy: &bg})
+	if err != nil {
+		glog.Errorf("Failed to delete job: %s", err)
+	}
+	return err
+}
+
 func (k *RealKube) DeleteService(namespace, name string) error {
 
 	fg := metav1.DeletePropagationForeground
-	err := kubeapi().CoreV1().Services(namespace).Delete(name, &metav1.DeleteOptions{
+	err := k.Clientset.CoreV1().Services(namespace).Delete(name, &metav1.DeleteOptions{
 		GracePeriodSeconds: &[]int64{0}[0],
 		PropagationPolicy:  &fg})
 
@@ -224,7 +638,7 @@ func (k *RealKube) DeleteService(namespace, name string) error {
 func (k *RealKube) DeleteConfigMap(namespace, name string) error {
 
 	fg := metav1.DeletePropagationForeground
-	err := kubeapi().CoreV1().ConfigMaps(namespace).Delete(name, &metav1.DeleteOptions{
+	err := k.Clientset.CoreV1().ConfigMaps(namespace).Delete(name, &metav1.DeleteOptions{
 		GracePeriodSeconds: &[]int64{0}[0],
 		PropagationPolicy:  &fg})
 
@@ -238,7 +652,7 @@ func (k *RealKube) DeleteConfigMap(namespace, name string) error {
 func (k *RealKube) DeleteSecret(namespace, name string) error {
 
 	fg := metav1.DeletePropagationForeground
-	err := kubeapi().CoreV1().Secrets(namespace).Delete(name, &metav1.DeleteOptions{
+	err := k.Clientset.CoreV1().Secrets(namespace).Delete(name, &metav1.DeleteOptions{
 		GracePeriodSeconds: &[]int64{0}[0],
 		PropagationPolicy:  &fg})
 
@@ -255,7 +669,7 @@ func (k *RealKube) DeleteSecret(namespace, name string) error {
 
 func (k *RealKube) PodExists(namespace, name string) bool {
 
-	pod, err := kubeapi().CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+	pod, err := k.Clientset.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
 	if pod != nil && err == nil {
 		return true
 	}
@@ -264,7 +678,7 @@ func (k *RealKube) PodExists(namespace, name string) bool {
 
 func (k *RealKube) DeploymentExists(namespace, name string) bool {
 
-	deployment, err := kubeapi().AppsV1beta1().Deployments(namespace).Get(name, metav1.GetOptions{})
+	deployment, err := k.Clientset.AppsV1beta1().Deployments(namespace).Get(name, metav1.GetOptions{})
 	if deployment != nil && err == nil {
 		return true
 	}
@@ -273,7 +687,7 @@ func (k *RealKube) DeploymentExists(namespace, name string) bool {
 
 func (k *RealKube) ServiceExists(namespace, name string) bool {
 
-	service, err := kubeapi().CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	service, err := k.Clientset.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
 	if service != nil && err == nil {
 		return true
 	}
@@ -282,7 +696,7 @@ func (k *RealKube) ServiceExists(namespace, name string) bool {
 
 func (k *RealKube) ConfigMapExists(namespace, name string) bool {
 
-	configMap, err := kubeapi().CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	configMap, err := k.Clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
 	if configMap != nil && err == nil {
 		return true
 	}
@@ -291,7 +705,7 @@ func (k *RealKube) ConfigMapExists(namespace, name string) bool {
 
 func (k *RealKube) SecretExists(namespace, name string) bool {
 
-	secret, err := kubeapi().CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	secret, err := k.Clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
 	if secret != nil && err == nil {
 		return true
 	}
@@ -302,30 +716,88 @@ func (k *RealKube) SecretExists(namespace, name string) bool {
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
 
-func LoadCatalogFromConfigMaps(k Kube) (*[]Entry, error) {
-	var catalog []Entry
-	var err error
-
-	const labelSelector = "mesitis/kind=catalog-entry"
-	const dataKey = "wrapped-resource"
-
-	list, err := k.ListConfigMaps(k.BrokerNamespace(), labelSelector)
+func (k *RealKube) ListCustomResources(gvr schema.GroupVersionResource, namespace, labelSelector string) ([]unstructured.Unstructured, error) {
+	list, err := k.Dynamic.Resource(gvr).Namespace(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
 	if err != nil {
-		glog.Errorf("Failed to find config maps from which to load the catalog: %s", err)
 		return nil, err
 	}
+	return list.Items, nil
+}
 
-	glog.Infof("Found <%d> entries.", len(list.Items))
-	for _, cm := range list.Items {
-		js := cm.Data[dataKey]
+func (k *RealKube) UpdateCustomResourceStatus(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	_, err := k.Dynamic.Resource(gvr).Namespace(obj.GetNamespace()).UpdateStatus(obj, metav1.UpdateOptions{})
+	return err
+}
 
-		var entry *Entry
-		if err := json.Unmarshal([]byte(js), &entry); err != nil {
-			glog.Errorf("Failed to unmarshal catalog data <%s> from ConfigMap: %s", js, err)
-			continue
-		}
-		catalog = append(catalog, *entry)
+// mesitis/kind label value of ConfigMaps holding catalog entries
+const catalogEntryKind = "catalog-entry"
+
+func (k *RealKube) RecordEvent(ref *v1.ObjectReference, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    ref.Namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source:         v1.EventSource{Component: "mesitis"},
 	}
 
-	return &catalog, nil
+	if _, err := k.Clientset.CoreV1().Events(ref.Namespace).Create(event); err != nil {
+		glog.Errorf("Failed to record event %s on %s %s: %s", reason, ref.Kind, ref.Name, err)
+		return err
+	}
+	return nil
+}
+
+var clusterServiceBrokers = schema.GroupVersionResource{
+	Group:    "servicecatalog.k8s.io",
+	Version:  "v1beta1",
+	Resource: "clusterservicebrokers",
+}
+
+// RelistServiceBroker asks Service Catalog to fetch the catalog again by
+// bumping spec.relistRequests on the named ClusterServiceBroker.
+func (k *RealKube) RelistServiceBroker(name string) error {
+	brokers := k.Dynamic.Resource(clusterServiceBrokers)
+
+	broker, err := brokers.Get(name, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to find ClusterServiceBroker %s: %s", name, err)
+		return err
+	}
+	requests, _, err := unstructured.NestedInt64(broker.Object, "spec", "relistRequests")
+	if err != nil {
+		glog.Errorf("Failed to read relistRequests of ClusterServiceBroker %s: %s", name, err)
+		return err
+	}
+
+	patch := fmt.Sprintf(`{"spec":{"relistRequests":%d}}`, requests+1)
+	if _, err := brokers.Patch(name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		glog.Errorf("Failed to request relist of ClusterServiceBroker %s: %s", name, err)
+		return err
+	}
+	glog.Infof("Requested relist of ClusterServiceBroker %s", name)
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// LoadCatalogFromConfigMaps loads the entries in the broker namespace that
+// pass validation. Problems are logged and recorded as Events on the
+// offending ConfigMaps and CatalogEntries.
+func LoadCatalogFromConfigMaps(k Kube) (*[]Entry, error) {
+	catalog, _, err := LoadCatalogFromSources([]CatalogSource{&KubeCatalogSource{Kube: k}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
 }
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// splitManifests breaks a ConfigMap payload into its documents, in order,
+// each converted to JSON. The payload may be JSON, YAML, or several YAML
+// documents separated by ---. Empty documents are dropped.
+func splitManifests(data string) ([]string, error) {
+	docs := make([]string, 0)
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(strings.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		js, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		if string(js) == "null" {
+			continue
+		}
+		docs = append(docs, string(js))
+	}
+	return docs, nil
+}
+
+// unmarshalManifest unmarshals a single JSON or YAML document
+func unmarshalManifest(data string, into interface{}) error {
+	js, err := yaml.YAMLToJSON([]byte(data))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, into)
+}
+
+// manifestKind is the lower cased kind of the object in a JSON document,
+// or def when the document does not say
+func manifestKind(js string, def string) string {
+	var meta struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal([]byte(js), &meta); err != nil || meta.Kind == "" {
+		return def
+	}
+	return strings.ToLower(meta.Kind)
+}
+
+// documentName is the name in a rendered document's metadata
+func documentName(doc string) string {
+	var meta struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal([]byte(doc), &meta); err != nil {
+		return ""
+	}
+	return meta.Metadata.Name
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestSplitManifests(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  string
+		kinds []string
+	}{
+		{"json", `{"apiVersion":"v1","kind":"Service","metadata":{"name":"s"}}`, []string{"service"}},
+		{"yaml", "apiVersion: v1\nkind: Pod\nmetadata:\n  name: p\n", []string{"pod"}},
+		{"multi", "kind: Deployment\n---\nkind: Service\n---\n", []string{"deployment", "service"}},
+		{"leading separator", "---\nkind: Secret\n", []string{"secret"}},
+		{"empty", "", []string{}},
+	}
+
+	for _, c := range cases {
+		docs, err := splitManifests(c.data)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+			continue
+		}
+		if len(docs) != len(c.kinds) {
+			t.Errorf("%s: expected %d documents, got %d", c.name, len(c.kinds), len(docs))
+			continue
+		}
+		for i, doc := range docs {
+			if kind := manifestKind(doc, ""); kind != c.kinds[i] {
+				t.Errorf("%s: expected kind %s, got %s", c.name, c.kinds[i], kind)
+			}
+		}
+	}
+}
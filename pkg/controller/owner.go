@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// Every object created for an instance is labeled with the broker, instance,
+// offering and consumer namespace it belongs to, so it can be traced, and
+// found again, without the broker's storage. The broker is named by its
+// namespace, which outlives its pods. Label values are limited to 63
+// characters, so the instance id is also kept whole in an annotation.
+const (
+	brokerLabel            = "mesitis/broker"
+	instanceLabel          = "mesitis/instance"
+	offeringLabel          = "mesitis/offering"
+	consumerNamespaceLabel = "mesitis/consumer-namespace"
+	instanceIDAnnotation   = "mesitis/instance-id"
+	entryUUIDAnnotation    = "mesitis/entry-uuid"
+	createdAnnotation      = "mesitis/created"
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// labelValue makes s a valid label value, at most 63 characters that begin
+// and end alphanumeric
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "_")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "_.-")
+}
+
+func ownerLabels(kube Kube, id string, entry *Entry, values *TemplateValues) map[string]string {
+	labels := map[string]string{
+		brokerLabel:   labelValue(kube.BrokerNamespace()),
+		instanceLabel: labelValue(id),
+		offeringLabel: labelValue(entry.serviceName()),
+	}
+	if values != nil && values.Namespace != "" {
+		labels[consumerNamespaceLabel] = labelValue(values.Namespace)
+	}
+	return labels
+}
+
+func ownerAnnotations(id string, entry *Entry) map[string]string {
+	return map[string]string{
+		instanceIDAnnotation: id,
+		entryUUIDAnnotation:  entry.UUID,
+		createdAnnotation:    time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// stampOwner adds the labels and annotations to the metadata of the object
+// in a JSON document, over any it has of the same name
+func stampOwner(doc string, labels, annotations map[string]string) (string, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &obj); err != nil {
+		return "", err
+	}
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		obj["metadata"] = metadata
+	}
+	for field, values := range map[string]map[string]string{"labels": labels, "annotations": annotations} {
+		merged, ok := metadata[field].(map[string]interface{})
+		if !ok {
+			merged = map[string]interface{}{}
+		}
+		for k, v := range values {
+			merged[k] = v
+		}
+		metadata[field] = merged
+	}
+	js, err := json.Marshal(obj)
+	return string(js), err
+}
+
+// checks whether an object of each kind exists
+var objectCheckers = map[string]func(kube Kube, namespace, name string) bool{
+	"pod":        Kube.PodExists,
+	"deployment": Kube.DeploymentExists,
+	"service":    Kube.ServiceExists,
+	"configmap":  Kube.ConfigMapExists,
+	"secret":     Kube.SecretExists,
+}
+
+// checkAdoptable allows an existing object to be adopted by an instance
+// only if it was created for that instance by this broker, as by an earlier
+// attempt whose response was lost
+func checkAdoptable(kube Kube, id, kind, namespace, name string) error {
+	obj, err := kube.GetObject(kind, namespace, name)
+	if err != nil {
+		glog.Errorf("Failed to read existing %s %s/%s: %s", kind, namespace, name, err)
+		return err
+	}
+	o := LabeledObject{}
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		o.Labels = stringMap(metadata["labels"])
+		o.Annotations = stringMap(metadata["annotations"])
+	}
+
+	var owner string
+	switch {
+	case o.Labels[brokerLabel] == "" || o.instanceID() == "":
+		owner = "is not managed by the broker"
+	case o.Labels[brokerLabel] != labelValue(kube.BrokerNamespace()):
+		owner = fmt.Sprintf("belongs to the broker in namespace %s", o.Labels[brokerLabel])
+	case o.instanceID() != id:
+		owner = fmt.Sprintf("belongs to instance %s", o.instanceID())
+	default:
+		return nil
+	}
+	glog.Errorf("Refusing to adopt %s %s/%s for instance %s, it %s", kind, namespace, name, id, owner)
+	return NewBrokerError(http.StatusConflict, "", "The %s %s already exists in namespace %s and %s.", kind, name, namespace, owner)
+}
+
+func stringMap(v interface{}) map[string]string {
+	m := map[string]string{}
+	if values, ok := v.(map[string]interface{}); ok {
+		for k, v := range values {
+			if s, ok := v.(string); ok {
+				m[k] = s
+			}
+		}
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// An object in the cluster carrying the broker's labels
+type LabeledObject struct {
+	ResourcesKubeObject
+	Labels      map[string]string
+	Annotations map[string]string
+	Created     time.Time
+}
+
+func (o *LabeledObject) instanceID() string {
+	if id := o.Annotations[instanceIDAnnotation]; id != "" {
+		return id
+	}
+	return o.Labels[instanceLabel]
+}
+
+// kinds and api versions of the objects provisioned, for events
+var objectReferenceKinds = map[string][2]string{
+	"pod":        {"Pod", "v1"},
+	"deployment": {"Deployment", "apps/v1beta1"},
+	"service":    {"Service", "v1"},
+	"configmap":  {"ConfigMap", "v1"},
+	"secret":     {"Secret", "v1"},
+}
+
+// The sweeper looks for objects labeled as the broker's whose instance is
+// not in storage, as after storage is lost. Orphans are logged and
+// recorded as events; when Delete is set, those still orphaned after Grace
+// are deleted.
+type SweeperOptions struct {
+	// how often to sweep, never if zero
+	Interval time.Duration
+	Delete   bool
+	// how long an object must stay orphaned before it is deleted
+	Grace time.Duration
+}
+
+type sweeper struct {
+	mutex sync.Mutex
+	// when each orphan was first seen, by kind/namespace/name
+	orphans map[string]time.Time
+}
+
+func objectKey(o ResourcesKubeObject) string {
+	return fmt.Sprintf("%s/%s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// findOrphans returns the objects whose instance is not in storage.
+// Objects younger than minAge may belong to a provision in progress. Any
+// error but an instance not being found stops the search, as storage that
+// cannot be read would make every object look orphaned.
+func findOrphans(s Storage, objects []LabeledObject, minAge time.Duration, now time.Time) ([]LabeledObject, error) {
+	orphans := make([]LabeledObject, 0)
+	for _, o := range objects {
+		if now.Sub(o.Created) < minAge {
+			continue
+		}
+		if id := o.instanceID(); id != "" {
+			_, err := LoadInstance(s, id)
+			if err == nil {
+				continue
+			}
+			if err != ErrNotFound {
+				return nil, err
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// Sweep finds, reports and, if asked, deletes orphaned objects. It returns
+// the orphans found.
+func (c *ProductionController) Sweep() ([]LabeledObject, error) {
+	options := c.Options.Sweeper
+	objects, err := c.Kube.ListLabeledObjects(fmt.Sprintf("%s=%s,%s", brokerLabel, labelValue(c.Kube.BrokerNamespace()), instanceLabel))
+	if err != nil {
+		glog.Errorf("Failed to list labeled objects to sweep: %s", err)
+		return nil, err
+	}
+
+	c.rwMutex.RLock()
+	orphans, err := findOrphans(c.Storage, objects, options.Interval, time.Now())
+	c.rwMutex.RUnlock()
+	if err != nil {
+		glog.Errorf("Failed to read instances, not sweeping: %s", err)
+		return nil, err
+	}
+
+	c.sweeper.mutex.Lock()
+	defer c.sweeper.mutex.Unlock()
+	seen := make(map[string]time.Time, len(orphans))
+	for _, o := range orphans {
+		key := objectKey(o.ResourcesKubeObject)
+		first, ok := c.sweeper.orphans[key]
+		if !ok {
+			first = time.Now()
+			message := fmt.Sprintf("Instance %s of %s is not known to the broker", o.instanceID(), o.Labels[offeringLabel])
+			glog.Warningf("Orphaned %s: %s", key, message)
+			kind := objectReferenceKinds[o.Kind]
+			ref := &v1.ObjectReference{Kind: kind[0], APIVersion: kind[1], Namespace: o.Namespace, Name: o.Name}
+			if err := c.Kube.RecordEvent(ref, v1.EventTypeWarning, "Orphaned", message); err != nil {
+				glog.Errorf("Failed to record orphaned event on %s: %s", key, err)
+			}
+		}
+
+		if options.Delete && time.Since(first) >= options.Grace {
+			glog.Infof("Deleting orphaned %s, orphaned since %s", key, first.Format(time.RFC3339))
+			if err := deleteObject(c.Kube, o.ResourcesKubeObject); err != nil {
+				glog.Errorf("Failed to delete orphaned %s: %s", key, err)
+				seen[key] = first
+			}
+			continue
+		}
+		seen[key] = first
+	}
+	// objects no longer orphaned, or gone, are forgotten
+	c.sweeper.orphans = seen
+
+	glog.Infof("Swept <%d> labeled objects, <%d> orphaned.", len(objects), len(orphans))
+	return orphans, nil
+}
+
+// runSweeper sweeps every interval until stop is closed
+func (c *ProductionController) runSweeper(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.Options.Sweeper.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Sweep()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStampOwner(t *testing.T) {
+	doc := `{"kind":"Service","metadata":{"name":"api","labels":{"app":"api","mesitis/instance":"old"}}}`
+	stamped, err := stampOwner(doc, map[string]string{instanceLabel: "a"}, map[string]string{entryUUIDAnnotation: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj struct {
+		Metadata struct {
+			Name        string
+			Labels      map[string]string
+			Annotations map[string]string
+		}
+	}
+	if err := json.Unmarshal([]byte(stamped), &obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.Metadata.Name != "api" || obj.Metadata.Labels["app"] != "api" || obj.Metadata.Labels[instanceLabel] != "a" || obj.Metadata.Annotations[entryUUIDAnnotation] != "1" {
+		t.Errorf("unexpected metadata %+v", obj.Metadata)
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"f1d0c814-9d40-4a60-ae0a-ebaadd9089ae", "f1d0c814-9d40-4a60-ae0a-ebaadd9089ae"},
+		{"infra/cache", "infra_cache"},
+		{"-cache-", "cache"},
+		{"f1d0c814-9d40-4a60-ae0a-ebaadd9089ae-a-very-long-prerequisite-name", "f1d0c814-9d40-4a60-ae0a-ebaadd9089ae-a-very-long-prerequisite-n"},
+	}
+	for _, test := range tests {
+		if v := labelValue(test.value); v != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.value, test.expected, v)
+		}
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	s := NewMemStorage()
+	if err := SaveInstance(s, "a", &Instance{InstanceID: "a", Entry: Entry{Team: "infra", Offering: "cache", UUID: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	object := func(name, instance string, created time.Time) LabeledObject {
+		return LabeledObject{
+			ResourcesKubeObject: ResourcesKubeObject{Kind: "service", Namespace: "infra", Name: name},
+			Labels:              map[string]string{instanceLabel: labelValue(instance)},
+			Annotations:         map[string]string{instanceIDAnnotation: instance},
+			Created:             created,
+		}
+	}
+	objects := []LabeledObject{
+		object("known", "a", old),
+		object("orphan", "b", old),
+		object("young", "c", now),
+	}
+	orphans, err := findOrphans(s, objects, 10*time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].Name != "orphan" {
+		t.Errorf("expected only orphan, got %v", orphans)
+	}
+
+	// storage that cannot be read orphans nothing
+	if orphans, err := findOrphans(&unreachableStorage{s}, objects, 10*time.Minute, now); err == nil {
+		t.Errorf("expected an error, got orphans %v", orphans)
+	}
+}
+
+// fails every read, as redis does when it cannot be reached
+type unreachableStorage struct {
+	Storage
+}
+
+func (u *unreachableStorage) Get(key string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+// serves the objects given, by kind/namespace/name
+type objectKube struct {
+	Kube
+	objects map[string]map[string]interface{}
+}
+
+func (k *objectKube) BrokerNamespace() string {
+	return "provider-ns"
+}
+
+func (k *objectKube) GetObject(kind, namespace, name string) (map[string]interface{}, error) {
+	return k.objects[kind+"/"+namespace+"/"+name], nil
+}
+
+func TestCheckAdoptable(t *testing.T) {
+	owned := func(broker, instance string) map[string]interface{} {
+		return map[string]interface{}{"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{brokerLabel: broker, instanceLabel: instance},
+			"annotations": map[string]interface{}{instanceIDAnnotation: instance},
+		}}
+	}
+	kube := &objectKube{objects: map[string]map[string]interface{}{
+		"service/infra/mine":      owned("provider-ns", "a"),
+		"service/infra/other":     owned("provider-ns", "b"),
+		"service/infra/elsewhere": owned("other-ns", "a"),
+		"service/infra/unmanaged": {"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "api"}}},
+	}}
+
+	if err := checkAdoptable(kube, "a", "service", "infra", "mine"); err != nil {
+		t.Errorf("mine: unexpected %s", err)
+	}
+	for _, name := range []string{"other", "elsewhere", "unmanaged"} {
+		if be, ok := checkAdoptable(kube, "a", "service", "infra", name).(*BrokerError); !ok || be.Status != 409 {
+			t.Errorf("%s: expected a 409, got %v", name, be)
+		}
+	}
+}
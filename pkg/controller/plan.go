@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// A plan is what provisioning an offering into a namespace would do, worked
+// out without changing anything: the admission checks are applied, the
+// wrapped resources rendered, and each object validated by the api server
+// with a server-side dry run. Providers plan to try catalog changes safely.
+
+// instance id templates see when planning
+const planInstanceID = "00000000-0000-0000-0000-000000000000"
+
+type PlanRequest struct {
+	// uuid, name or team-offering name of the entry
+	Offering   string                 `json:"offering"`
+	Namespace  string                 `json:"namespace"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type Plan struct {
+	Offering  string `json:"offering"`
+	Namespace string `json:"namespace"`
+	// whether the provision would be accepted
+	Allowed          bool                  `json:"allowed"`
+	RequiresApproval bool                  `json:"requiresApproval,omitempty"`
+	Problems         []string              `json:"problems,omitempty"`
+	Prerequisites    []PlannedPrerequisite `json:"prerequisites,omitempty"`
+	Objects          []PlannedObject       `json:"objects"`
+}
+
+type PlannedPrerequisite struct {
+	Name     string `json:"name"`
+	Offering string `json:"offering"`
+	// reuse an instance in the namespace, or provision one
+	Action     string `json:"action"`
+	InstanceID string `json:"instanceID,omitempty"`
+}
+
+type PlannedObject struct {
+	ResourcesKubeObject
+	// create, or adopt an object left by an earlier attempt
+	Action string `json:"action"`
+	// the object as the api server would create it
+	Object map[string]interface{} `json:"object,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// Plans provisions
+type Planner interface {
+	Plan(req *PlanRequest) (*Plan, error)
+}
+
+// findOffering finds an entry by uuid, team-offering or offering name
+func findOffering(catalog *[]Entry, name string) *Entry {
+	if e := findEntry(catalog, name); e != nil {
+		return e
+	}
+	for i := range *catalog {
+		if e := &(*catalog)[i]; e.serviceName() == name || e.Offering == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Plan works out the objects a provision of the entry would create. Only
+// ProvisionNewClusterObjects creates objects; Helm charts cannot be planned.
+func (e *Entry) Plan(kube Kube, id string, values *TemplateValues) ([]PlannedObject, error) {
+	planned := make([]PlannedObject, 0)
+	switch {
+	case e.ProvisionNewClusterObjects != nil:
+		namespace, objects, err := e.ProvisionNewClusterObjects.prepare(kube, id, e, values)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			p := PlannedObject{ResourcesKubeObject: ResourcesKubeObject{Kind: o.kind, Name: o.name, Namespace: namespace}, Action: "create"}
+			if o.adopt {
+				p.Action = "adopt"
+			} else if obj, err := kube.DryRunCreate(o.kind, namespace, o.doc); err != nil {
+				p.Error = err.Error()
+			} else {
+				p.Object = redactSecret(obj)
+				// as generated, if the document left it to the api server
+				if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+					if name, _ := metadata["name"].(string); name != "" {
+						p.Name = name
+					}
+				}
+			}
+			planned = append(planned, p)
+		}
+	case e.ProvisionExistingClusterService != nil:
+		p := e.ProvisionExistingClusterService
+		if _, err := kube.GetService(p.Namespace, p.Name); err != nil {
+			return nil, NewBrokerError(http.StatusUnprocessableEntity, "", "Service %s/%s of %s does not exist.", p.Namespace, p.Name, e.serviceName())
+		}
+	case e.ProvisionHelmChart != nil:
+		return nil, fmt.Errorf("Helm charts cannot be planned")
+	}
+	return planned, nil
+}
+
+// redactSecret hides the values of a Secret, keeping its keys, so a plan
+// does not hand out credentials the templates rendered
+func redactSecret(obj map[string]interface{}) map[string]interface{} {
+	if kind, _ := obj["kind"].(string); kind != "Secret" {
+		return obj
+	}
+	for _, field := range []string{"data", "stringData"} {
+		if values, ok := obj[field].(map[string]interface{}); ok {
+			for k := range values {
+				values[k] = "<redacted>"
+			}
+		}
+	}
+	return obj
+}
+
+func (c *ProductionController) Plan(req *PlanRequest) (*Plan, error) {
+	c.rwMutex.RLock()
+	defer c.rwMutex.RUnlock()
+
+	catalog, err := c.loadCatalog()
+	if err != nil {
+		glog.Errorf("Failed to load catalog: %s", err)
+		return nil, err
+	}
+	entry := findOffering(catalog, req.Offering)
+	if entry == nil {
+		return nil, NewBrokerError(http.StatusNotFound, "", "No offering %s.", req.Offering)
+	}
+
+	plan := &Plan{Offering: entry.serviceName(), Namespace: req.Namespace, RequiresApproval: entry.RequiresApproval, Problems: []string{}}
+	problem := func(err error) {
+		if err != nil {
+			plan.Problems = append(plan.Problems, err.Error())
+		}
+	}
+
+	problem(entry.CheckParameters(OperationProvision, req.Parameters))
+	problem(entry.CheckAccess(c.Kube, req.Namespace))
+	problem(entry.CheckPolicies(c.Kube, c.Storage, &PolicyRequest{
+		Operation:  OperationProvision,
+		Namespace:  req.Namespace,
+		Platform:   "kubernetes",
+		Parameters: req.Parameters,
+	}))
+	problem(c.checkProvisionQuota(entry, req.Namespace, ""))
+
+	// prerequisites in the namespace are used as they are, others would be
+	// provisioned and are seen by templates without coordinates or credentials
+	dependencies := make(map[string]*DependencyValues, len(entry.Dependencies))
+	for i := range entry.Dependencies {
+		d := &entry.Dependencies[i]
+		dependency := findEntry(catalog, d.UUID)
+		if dependency == nil {
+			problem(fmt.Errorf("Service %s depends on %s, which is not offered.", entry.serviceName(), d.UUID))
+			continue
+		}
+		p := PlannedPrerequisite{Name: d.Name, Offering: dependency.serviceName(), Action: "provision"}
+		if !d.Dedicated {
+			if existing, err := NamespaceInstances(c.Storage, d.UUID, req.Namespace); err == nil && len(existing) > 0 {
+				p.Action = "reuse"
+				p.InstanceID = existing[0]
+			}
+		}
+		if p.InstanceID != "" {
+			values, err := c.dependencyValues([]Prerequisite{{Name: d.Name, InstanceID: p.InstanceID}})
+			problem(err)
+			if err == nil {
+				dependencies[d.Name] = values[d.Name]
+			}
+		} else {
+			problem(dependency.CheckAccess(c.Kube, req.Namespace))
+			problem(c.checkProvisionQuota(dependency, req.Namespace, ""))
+			dependencies[d.Name] = &DependencyValues{InstanceID: prerequisiteID(planInstanceID, d), Coordinates: map[string]string{}, Credentials: map[string]string{}}
+		}
+		plan.Prerequisites = append(plan.Prerequisites, p)
+	}
+
+	objects, err := entry.Plan(c.Kube, planInstanceID, &TemplateValues{
+		InstanceID:   planInstanceID,
+		Namespace:    req.Namespace,
+		Parameters:   req.Parameters,
+		Dependencies: dependencies,
+	})
+	problem(err)
+	if objects == nil {
+		objects = []PlannedObject{}
+	}
+	for _, o := range objects {
+		if o.Error != "" {
+			problem(fmt.Errorf("%s %s/%s would be rejected: %s", o.Kind, o.Namespace, o.Name, o.Error))
+		}
+	}
+	plan.Objects = objects
+	plan.Allowed = len(plan.Problems) == 0
+
+	glog.Infof("Planned %s in namespace %s: <%d> objects, <%d> problems", plan.Offering, plan.Namespace, len(plan.Objects), len(plan.Problems))
+	return plan, nil
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestFindOffering(t *testing.T) {
+	catalog := &[]Entry{
+		{Team: "infra", Offering: "cache", UUID: "1"},
+		{Team: "data", Offering: "cache", UUID: "2"},
+		{Team: "data", Offering: "db", UUID: "3"},
+	}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"2", "2"},
+		{"data-cache", "2"},
+		{"db", "3"},
+		// the first of the offerings with that name
+		{"cache", "1"},
+		{"queue", ""},
+	}
+	for _, test := range tests {
+		e := findOffering(catalog, test.name)
+		if (e == nil && test.expected != "") || (e != nil && e.UUID != test.expected) {
+			t.Errorf("%s: expected %s, got %v", test.name, test.expected, e)
+		}
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	secret := redactSecret(map[string]interface{}{
+		"kind":       "Secret",
+		"data":       map[string]interface{}{"password": "aHVudGVyMg=="},
+		"stringData": map[string]interface{}{"username": "admin"},
+	})
+	if v := secret["data"].(map[string]interface{})["password"]; v != "<redacted>" {
+		t.Errorf("expected data to be redacted, got %v", v)
+	}
+	if v := secret["stringData"].(map[string]interface{})["username"]; v != "<redacted>" {
+		t.Errorf("expected stringData to be redacted, got %v", v)
+	}
+
+	configMap := redactSecret(map[string]interface{}{
+		"kind": "ConfigMap",
+		"data": map[string]interface{}{"mode": "cache"},
+	})
+	if v := configMap["data"].(map[string]interface{})["mode"]; v != "cache" {
+		t.Errorf("expected a ConfigMap to be left alone, got %v", v)
+	}
+}
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Rules a provider attaches to an entry to admit or deny provision, bind
+// and update requests, written as CEL expressions that must be true for
+// the request to be admitted. Rules see these variables:
+//
+//	operation        provision, bind or update
+//	namespace        the consumer namespace
+//	namespace_labels labels of the consumer namespace
+//	plan             name of the plan requested
+//	parameters       parameters of the request
+//	context          platform and namespace of the request
+//	entry            team, offering, uuid and version of the entry
+//	counts           instances of the entry, instances of the entry in the
+//	                 consumer namespace (namespace_instances), and bindings
+//	                 of the instance
+//	now              the time of the request
+//
+// ex counts.namespace_instances < 3
+type Policy struct {
+	Name string `json:"name"`
+	// operations the rule applies to, all if empty
+	Operations []string `json:"operations,omitempty"`
+	Rule       string   `json:"rule"`
+	// returned to the consumer when the rule denies a request
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	OperationProvision = "provision"
+	OperationBind      = "bind"
+	OperationUpdate    = "update"
+)
+
+// A request to be admitted by an entry's policies
+type PolicyRequest struct {
+	Operation  string
+	Namespace  string
+	Platform   string
+	Parameters map[string]interface{}
+	// the instance bound or updated, empty when provisioning
+	InstanceID string
+}
+
+var policyEnv *cel.Env
+
+func init() {
+	var err error
+	policyEnv, err = cel.NewEnv(cel.Declarations(
+		decls.NewIdent("operation", decls.String, nil),
+		decls.NewIdent("namespace", decls.String, nil),
+		decls.NewIdent("namespace_labels", decls.NewMapType(decls.String, decls.String), nil),
+		decls.NewIdent("plan", decls.String, nil),
+		decls.NewIdent("parameters", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent("context", decls.NewMapType(decls.String, decls.String), nil),
+		decls.NewIdent("entry", decls.NewMapType(decls.String, decls.String), nil),
+		decls.NewIdent("counts", decls.NewMapType(decls.String, decls.Int), nil),
+		decls.NewIdent("now", decls.Timestamp, nil),
+	))
+	if err != nil {
+		glog.Fatalf("Failed to create policy environment: %s", err)
+	}
+}
+
+// compiled programs by rule, shared by every policy written the same way
+var policyPrograms = struct {
+	sync.Mutex
+	programs map[string]cel.Program
+}{programs: make(map[string]cel.Program)}
+
+// program compiles the policy's rule once, and returns the same program
+// from then on. Rules that do not compile are compiled again each time,
+// and fail the same way.
+func (p *Policy) program() (cel.Program, error) {
+	policyPrograms.Lock()
+	prg, ok := policyPrograms.programs[p.Rule]
+	policyPrograms.Unlock()
+	if ok {
+		return prg, nil
+	}
+
+	ast, issues := policyEnv.Compile(p.Rule)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !proto.Equal(ast.ResultType(), decls.Bool) {
+		return nil, fmt.Errorf("rule must be a bool expression")
+	}
+	prg, err := policyEnv.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	policyPrograms.Lock()
+	policyPrograms.programs[p.Rule] = prg
+	policyPrograms.Unlock()
+	return prg, nil
+}
+
+func (p *Policy) appliesTo(operation string) bool {
+	if len(p.Operations) == 0 {
+		return true
+	}
+	for _, o := range p.Operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPolicies returns a BrokerError with the message of the first policy
+// denying the request, or nil if all admit it
+func (e *Entry) CheckPolicies(kube Kube, s Storage, req *PolicyRequest) error {
+	policies := make([]*Policy, 0)
+	for i := range e.Policies {
+		if e.Policies[i].appliesTo(req.Operation) {
+			policies = append(policies, &e.Policies[i])
+		}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+
+	vars, err := e.policyVariables(kube, s, req)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range policies {
+		prg, err := p.program()
+		if err != nil {
+			glog.Errorf("Policy %s of %s is invalid: %s", p.Name, e.serviceName(), err)
+			return err
+		}
+		out, _, err := prg.Eval(vars)
+		if err != nil {
+			glog.Errorf("Policy %s of %s failed on %s: %s", p.Name, e.serviceName(), req.Operation, err)
+			return forbidden("Policy %s could not be evaluated: %s", p.Name, err)
+		}
+		if admitted, ok := out.Value().(bool); !ok || !admitted {
+			message := p.Message
+			if message == "" {
+				message = fmt.Sprintf("Denied by policy %s.", p.Name)
+			}
+			return forbidden("%s", message)
+		}
+	}
+	return nil
+}
+
+func (e *Entry) policyVariables(kube Kube, s Storage, req *PolicyRequest) (map[string]interface{}, error) {
+	nsLabels := map[string]string{}
+	if req.Namespace != "" {
+		ns, err := kube.GetNamespace(req.Namespace)
+		switch {
+		case err == nil:
+			for k, v := range ns.Labels {
+				nsLabels[k] = v
+			}
+		case k8serr.IsNotFound(err):
+			glog.Warningf("Namespace %s not found for policies of %s", req.Namespace, e.serviceName())
+		default:
+			return nil, err
+		}
+	}
+
+	counts := map[string]int64{"instances": 0, "namespace_instances": 0, "bindings": 0}
+	for name, count := range map[string]func() (int, error){
+		"instances":           func() (int, error) { return CountInstances(s, e.UUID) },
+		"namespace_instances": func() (int, error) { return CountNamespaceInstances(s, e.UUID, req.Namespace) },
+		"bindings":            func() (int, error) { return CountBindings(s, req.InstanceID) },
+	} {
+		n, err := count()
+		if err != nil {
+			return nil, err
+		}
+		counts[name] = int64(n)
+	}
+
+	parameters := req.Parameters
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	now, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"operation":        req.Operation,
+		"namespace":        req.Namespace,
+		"namespace_labels": nsLabels,
+		"plan":             e.planName(),
+		"parameters":       parameters,
+		"context":          map[string]string{"platform": req.Platform, "namespace": req.Namespace},
+		"entry":            map[string]string{"team": e.Team, "offering": e.Offering, "uuid": e.UUID, "version": e.Version},
+		"counts":           counts,
+		"now":              now,
+	}, nil
+}
+
+// validatePolicies checks every rule compiles to a bool
+func (e *Entry) validatePolicies() ValidationErrors {
+	errs := ValidationErrors{}
+	for i := range e.Policies {
+		p := &e.Policies[i]
+		field := fmt.Sprintf("policies[%d]", i)
+		if p.Name == "" {
+			errs = append(errs, ValidationError{e.Origin, field + ".name", "required", SeverityError})
+		}
+		if _, err := p.program(); err != nil {
+			errs = append(errs, ValidationError{e.Origin, field + ".rule", fmt.Sprintf("invalid rule: %s", err), SeverityError})
+		}
+		for _, o := range p.Operations {
+			switch o {
+			case OperationProvision, OperationBind, OperationUpdate:
+			default:
+				errs = append(errs, ValidationError{e.Origin, field + ".operations", fmt.Sprintf("unknown operation %s", o), SeverityError})
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestCheckPolicies(t *testing.T) {
+	e := &Entry{Team: "api", Offering: "api-service", UUID: "3", Policies: []Policy{
+		{Name: "replicas", Operations: []string{OperationProvision}, Rule: `!has(parameters.replicas) || parameters.replicas <= 5.0`, Message: "At most 5 replicas."},
+		{Name: "bindings", Operations: []string{OperationBind}, Rule: `counts.bindings < 1`},
+	}}
+	s := NewMemStorage()
+
+	cases := []struct {
+		name     string
+		req      *PolicyRequest
+		admitted bool
+	}{
+		{"no parameters", &PolicyRequest{Operation: OperationProvision}, true},
+		{"few replicas", &PolicyRequest{Operation: OperationProvision, Parameters: map[string]interface{}{"replicas": 3.0}}, true},
+		{"many replicas", &PolicyRequest{Operation: OperationProvision, Parameters: map[string]interface{}{"replicas": 7.0}}, false},
+		{"other operation", &PolicyRequest{Operation: OperationUpdate, Parameters: map[string]interface{}{"replicas": 7.0}}, true},
+		{"first binding", &PolicyRequest{Operation: OperationBind, InstanceID: "i"}, true},
+	}
+
+	// without a namespace the namespace is never read, so no kube is needed
+	for _, c := range cases {
+		err := e.CheckPolicies(nil, s, c.req)
+		if (err == nil) != c.admitted {
+			t.Errorf("%s: expected admitted %t, got %v", c.name, c.admitted, err)
+		}
+	}
+}
+
+func TestValidatePolicies(t *testing.T) {
+	e := &Entry{Policies: []Policy{
+		{Name: "valid", Rule: `operation == "bind"`},
+		{Name: "not bool", Rule: `operation`},
+		{Name: "bad syntax", Rule: `operation ==`},
+		{Rule: `true`, Operations: []string{"delete"}},
+	}}
+
+	errs := e.validatePolicies()
+	fields := map[string]bool{}
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+	for _, field := range []string{"policies[1].rule", "policies[2].rule", "policies[3].name", "policies[3].operations"} {
+		if !fields[field] {
+			t.Errorf("expected a problem with %s, got %v", field, errs)
+		}
+	}
+	if fields["policies[0].rule"] {
+		t.Errorf("expected policies[0] valid, got %v", errs)
+	}
+}
+
+func TestPolicyProgramCached(t *testing.T) {
+	first, err := (&Policy{Name: "a", Rule: `operation != "bind"`}).program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := (&Policy{Name: "b", Rule: `operation != "bind"`}).program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expected the rule compiled once")
+	}
+	if _, err := (&Policy{Rule: "1 + 1"}).program(); err == nil {
+		t.Errorf("expected a rule that is not a bool expression to fail")
+	}
+}
@@ -3,6 +3,7 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"sort"
 
 	"github.com/golang/glog"
@@ -20,21 +21,7 @@ func (instance *Instance) Deprovision(kube Kube) error {
 	if instance.ResourcesKubeObjectList != nil {
 		for i := len(*(*instance).ResourcesKubeObjectList) - 1; i >= 0; i-- {
 			po := (*(*instance).ResourcesKubeObjectList)[i]
-			switch po.Kind {
-			case "pod":
-				err = kube.DeletePod(po.Namespace, po.Name)
-			case "deployment":
-				err = kube.DeleteDeployment(po.Namespace, po.Name)
-			case "service":
-				err = kube.DeleteService(po.Namespace, po.Name)
-			case "configmap":
-				err = kube.DeleteConfigMap(po.Namespace, po.Name)
-			case "secret":
-				err = kube.DeleteSecret(po.Namespace, po.Name)
-			default:
-				glog.Errorf("Unable to delete provisioned object kind: %s", po.Kind)
-			}
-			if err != nil {
+			if err = deleteObject(kube, po); err != nil {
 				glog.Errorf("Failed to delete provisioned object: %s", err)
 			}
 		}
@@ -53,19 +40,19 @@ func (instance *Instance) Deprovision(kube Kube) error {
 }
 
 type Provision interface {
-	Provision(kube Kube, id string, entry *Entry) (*Instance, error)
+	Provision(kube Kube, id string, entry *Entry, values *TemplateValues) (*Instance, error)
 }
 
 // TODO ugly: should be a function taking entry
-func (e *Entry) Provision(kube Kube, id string) (*Instance, error) {
+func (e *Entry) Provision(kube Kube, id string, values *TemplateValues) (*Instance, error) {
 	if e.ProvisionExistingClusterService != nil {
-		return e.ProvisionExistingClusterService.Provision(kube, id, e)
+		return e.ProvisionExistingClusterService.Provision(kube, id, e, values)
 	} else if e.ProvisionNonClusterURL != nil {
-		return e.ProvisionNonClusterURL.Provision(kube, id, e)
+		return e.ProvisionNonClusterURL.Provision(kube, id, e, values)
 	} else if e.ProvisionNewClusterObjects != nil {
-		return e.ProvisionNewClusterObjects.Provision(kube, id, e)
+		return e.ProvisionNewClusterObjects.Provision(kube, id, e, values)
 	} else if e.ProvisionHelmChart != nil {
-		return e.ProvisionHelmChart.Provision(kube, id, e)
+		return e.ProvisionHelmChart.Provision(kube, id, e, values)
 	} else {
 		glog.Errorln("Unknown provision type")
 		return nil, errors.New("Failed to provision")
@@ -73,15 +60,26 @@ func (e *Entry) Provision(kube Kube, id string) (*Instance, error) {
 }
 
 type Credential interface {
-	Credential(kube Kube) (map[string]string, error)
+	Credential(kube Kube, values *TemplateValues) (map[string]string, error)
 }
 
 // TODO ugly: make methods on each type
-func (e *Entry) Credential(kube Kube) (map[string]string, error) {
+func (e *Entry) Credential(kube Kube, values *TemplateValues) (map[string]string, error) {
 	if e.CredentialFromCatalog != nil {
 		m := make(map[string]string, 0)
 		m["Username"] = e.CredentialFromCatalog.Username
 		m["Password"] = e.CredentialFromCatalog.Password
+		if !e.CredentialFromCatalog.Template {
+			return m, nil
+		}
+		for k, v := range m {
+			rendered, err := values.render(k, v)
+			if err != nil {
+				glog.Errorf("Failed to render %s of CredentialFromCatalog: %s", k, err)
+				return nil, err
+			}
+			m[k] = rendered
+		}
 		return m, nil
 	} else if e.CredentialFromClusterSecret != nil {
 		name := e.CredentialFromClusterSecret.SecretName
@@ -107,40 +105,44 @@ func (e *Entry) Credential(kube Kube) (map[string]string, error) {
 	}
 }
 
-type Coordinates interface {
-	Coordinates() (map[string]string, error)
-}
-
-func (i *Instance) Coordinates() (map[string]string, error) {
-	if i.CoordinatesClusterURL != nil {
-		m := make(map[string]string, 0)
-		m["URL"] = i.CoordinatesClusterURL.URL
-		return m, nil
-	} else if i.CoordinatesExternalURL != nil {
-		m := make(map[string]string, 0)
-		m["URL"] = i.CoordinatesExternalURL.URL
-		return m, nil
-	} else {
-		glog.Errorln("Unknown coordinates type")
-		return nil, errors.New("Failed to generate coordinates")
-
+func (p ProvisionExistingClusterService) Provision(kube Kube, id string, entry *Entry, values *TemplateValues) (*Instance, error) {
+	service, err := kube.GetService(p.Namespace, p.Name)
+	if err != nil {
+		glog.Errorf("Service %s/%s of %s not found: %s", p.Namespace, p.Name, entry.serviceName(), err)
+		return nil, NewBrokerError(http.StatusUnprocessableEntity, "", "Service %s is unavailable, its Service %s/%s was not found.", entry.serviceName(), p.Namespace, p.Name)
+	}
+	if p.RequireEndpoints {
+		if ready, err := readyEndpoints(kube, p.Namespace, p.Name); err != nil || ready == 0 {
+			glog.Errorf("Service %s/%s of %s has no ready endpoints: %v", p.Namespace, p.Name, entry.serviceName(), err)
+			return nil, NewBrokerError(http.StatusUnprocessableEntity, "", "Service %s is unavailable, its Service %s/%s has no ready endpoints.", entry.serviceName(), p.Namespace, p.Name)
+		}
 	}
-}
 
-func (p ProvisionExistingClusterService) Provision(kube Kube, id string, entry *Entry) (*Instance, error) {
 	URL := fmt.Sprintf("%s.%s.svc.cluster.local", p.Name, p.Namespace)
-
-	instance := Instance{*entry, id, nil, &CoordinatesClusterURL{URL: URL}, &ResourcesNoResource{}, nil, nil}
+	instance := Instance{Entry: *entry, InstanceID: id, CoordinatesClusterURL: &CoordinatesClusterURL{URL: URL, Ports: servicePorts(service)}, ResourcesNoResource: &ResourcesNoResource{}}
 	return &instance, nil
 }
 
-func (p ProvisionNonClusterURL) Provision(kube Kube, id string, entry *Entry) (*Instance, error) {
+// readyEndpoints counts the ready addresses behind a Service
+func readyEndpoints(kube Kube, namespace, name string) (int, error) {
+	endpoints, err := kube.GetEndpoints(namespace, name)
+	if err != nil {
+		return 0, err
+	}
+	ready := 0
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+	}
+	return ready, nil
+}
+
+func (p ProvisionNonClusterURL) Provision(kube Kube, id string, entry *Entry, values *TemplateValues) (*Instance, error) {
 	URL := p.URL
-	instance := Instance{*entry, id, &CoordinatesExternalURL{URL: URL}, nil, &ResourcesNoResource{}, nil, nil}
+	instance := Instance{Entry: *entry, InstanceID: id, CoordinatesExternalURL: &CoordinatesExternalURL{URL: URL}, ResourcesNoResource: &ResourcesNoResource{}}
 	return &instance, nil
 }
 
-func (p ProvisionHelmChart) Provision(kube Kube, id string, entry *Entry) (*Instance, error) {
+func (p ProvisionHelmChart) Provision(kube Kube, id string, entry *Entry, values *TemplateValues) (*Instance, error) {
 
 	chartURL := p.ChartURL
 	// TODO consider adding tillerHost to kube object, getting it from app configuration
@@ -164,10 +166,28 @@ func (p ProvisionHelmChart) Provision(kube Kube, id string, entry *Entry) (*Inst
 	// _, err = helmClient.InstallRelease(tarroot, p.Namespace, helm.ReleaseName(name), helm.ValueOverrides(vals))
 
 	URL := fmt.Sprintf("%s.%s.svc.cluster.local", p.Name, p.Namespace)
-	instance := Instance{*entry, id, &CoordinatesExternalURL{URL: URL}, nil, nil, nil, &ResourcesHelmRelease{Namespace: p.Namespace, Name: p.Name}}
+	instance := Instance{Entry: *entry, InstanceID: id, CoordinatesExternalURL: &CoordinatesExternalURL{URL: URL}, ResourcesHelmRelease: &ResourcesHelmRelease{Namespace: p.Namespace, Name: p.Name}}
 	return &instance, nil
 }
 
+func deleteObject(kube Kube, po ResourcesKubeObject) error {
+	switch po.Kind {
+	case "pod":
+		return kube.DeletePod(po.Namespace, po.Name)
+	case "deployment":
+		return kube.DeleteDeployment(po.Namespace, po.Name)
+	case "service":
+		return kube.DeleteService(po.Namespace, po.Name)
+	case "configmap":
+		return kube.DeleteConfigMap(po.Namespace, po.Name)
+	case "secret":
+		return kube.DeleteSecret(po.Namespace, po.Name)
+	default:
+		glog.Errorf("Unable to delete provisioned object kind: %s", po.Kind)
+	}
+	return nil
+}
+
 // TODO rename to InOrder
 type ByOrder []v1.ConfigMap
 
@@ -177,116 +197,272 @@ func (a ByOrder) Less(i, j int) bool {
 	return a[i].ObjectMeta.Labels["mesitis/order"] < a[j].ObjectMeta.Labels["mesitis/order"]
 }
 
-func (p ProvisionNewClusterObjects) Provision(kube Kube, id string, entry *Entry) (*Instance, error) {
+// creates an object from a JSON document, returning its name
+type objectCreator func(kube Kube, namespace, JSON string) (string, error)
 
-	// TODO consider checking whether a service with the given name exists in the namespace
+var objectCreators = map[string]objectCreator{
+	"pod": func(kube Kube, namespace, JSON string) (string, error) {
+		pod, err := kube.CreatePodFromJSON(namespace, JSON)
+		if err != nil {
+			return "", err
+		}
+		return pod.ObjectMeta.Name, nil
+	},
+	"deployment": func(kube Kube, namespace, JSON string) (string, error) {
+		deployment, err := kube.CreateDeploymentFromJSON(namespace, JSON)
+		if err != nil {
+			return "", err
+		}
+		return deployment.ObjectMeta.Name, nil
+	},
+	"service": func(kube Kube, namespace, JSON string) (string, error) {
+		service, err := kube.CreateServiceFromJSON(namespace, JSON)
+		if err != nil {
+			return "", err
+		}
+		return service.ObjectMeta.Name, nil
+	},
+	"configmap": func(kube Kube, namespace, JSON string) (string, error) {
+		configMap, err := kube.CreateConfigMapFromJSON(namespace, JSON)
+		if err != nil {
+			return "", err
+		}
+		return configMap.ObjectMeta.Name, nil
+	},
+	"secret": func(kube Kube, namespace, JSON string) (string, error) {
+		secret, err := kube.CreateSecretFromJSON(namespace, JSON)
+		if err != nil {
+			return "", err
+		}
+		return secret.ObjectMeta.Name, nil
+	},
+}
 
-	const dataKey = "embedded-resource"
+// the api group and resource of each kind, for access reviews
+var objectResources = map[string]struct{ group, resource string }{
+	"pod":        {"", "pods"},
+	"deployment": {"apps", "deployments"},
+	"service":    {"", "services"},
+	"configmap":  {"", "configmaps"},
+	"secret":     {"", "secrets"},
+}
 
-	obj := p
+// checkObjectAccess makes sure the broker may create, apply and later
+// delete objects of each kind in the namespace, before any are created
+func checkObjectAccess(kube Kube, namespace string, kinds []string) error {
+	checked := make(map[string]bool, 0)
+	for _, kind := range kinds {
+		r, ok := objectResources[kind]
+		if !ok || checked[kind] {
+			continue
+		}
+		checked[kind] = true
+		for _, verb := range []string{"create", "patch", "delete"} {
+			allowed, reason, err := kube.CanI(namespace, verb, r.group, r.resource)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				if reason != "" {
+					reason = fmt.Sprintf(" (%s)", reason)
+				}
+				glog.Errorf("Not permitted to %s %s in namespace %s%s", verb, r.resource, namespace, reason)
+				return forbidden("The broker may not %s %s in namespace %s%s. Bind the broker's service account to a role allowing it there.", verb, r.resource, namespace, reason)
+			}
+		}
+	}
+	return nil
+}
 
-	glog.Infof("Attempting to find config maps matching labelselector: %s\n", obj.LabelSelector)
-	list, err := kube.ListConfigMaps(kube.BrokerNamespace(), obj.LabelSelector)
+func createObject(kube Kube, kind, namespace, JSON string) (*ResourcesKubeObject, error) {
+	create, ok := objectCreators[kind]
+	if !ok {
+		return nil, fmt.Errorf("Don't know how to create object: %s", kind)
+	}
+	name, err := create(kube, namespace, JSON)
+	if err != nil {
+		return nil, err
+	}
+	return &ResourcesKubeObject{Kind: kind, Name: name, Namespace: namespace}, nil
+}
+
+// a rendered wrapped resource and the kind of object it is
+type wrappedDoc struct {
+	kind, doc string
+}
+
+// targetNamespace is the namespace objects are created in
+func (p ProvisionNewClusterObjects) targetNamespace(entry *Entry, values *TemplateValues) (string, error) {
+	if !p.ConsumerNamespace {
+		return p.Namespace, nil
+	}
+	if values == nil || values.Namespace == "" {
+		return "", NewBrokerError(http.StatusBadRequest, "", "Service %s is provisioned into the consumer namespace, which the request did not give.", entry.serviceName())
+	}
+	return values.Namespace, nil
+}
+
+// render reads and renders every enabled wrapped resource, in order
+func (p ProvisionNewClusterObjects) render(kube Kube, entry *Entry, values *TemplateValues) ([]wrappedDoc, error) {
+	glog.Infof("Attempting to find config maps matching labelselector: %s\n", p.LabelSelector)
+	items, err := entry.wrappedResources(kube, p.LabelSelector)
 	if err != nil {
 		// TODO is this an error, or provision anyway?
 		glog.Errorf("Failed to find config maps from which to provision object: %s\n", err)
 		return nil, err
 	}
 
-	// TODO rename pcfo, no longer relevant
-	pcfo := ResourcesKubeObjectList{}
-
 	// ensure objects created in their specified order
-	sort.Sort(ByOrder(list.Items))
-	for _, cm := range list.Items {
+	sort.Sort(ByOrder(items))
+
+	wrapped := make([]wrappedDoc, 0)
+	for _, cm := range items {
 		if cm.ObjectMeta.Labels["mesitis/enabled"] != "true" {
 			continue
 		}
-		// TODO this should not be a switch but instead a map
-		// behavior is identical
-		// TODO check if the object exists already in the namespace. if so, don't provision again.
-		switch cm.ObjectMeta.Labels["mesitis/kind"] {
-		case "pod":
-			pod, cerr := kube.CreatePodFromJSON(obj.Namespace, cm.Data[dataKey])
-			if cerr == nil {
-				glog.Infof("Created pod: %s\n", pod)
-				pcfo = append(pcfo,
-					ResourcesKubeObject{
-						Kind:      "pod",
-						Name:      pod.ObjectMeta.Name,
-						Namespace: obj.Namespace})
-
-				glog.Infof("Resources: %s\n", pcfo)
-			} else {
-				kubeError(cerr)
-			}
-		case "deployment":
-			deployment, cerr := kube.CreateDeploymentFromJSON(obj.Namespace, cm.Data[dataKey])
-			if cerr == nil {
-				glog.Infof("Created deployment: %s\n", deployment)
-				pcfo = append(pcfo,
-					ResourcesKubeObject{
-						Kind:      "deployment",
-						Name:      deployment.ObjectMeta.Name,
-						Namespace: obj.Namespace})
-				glog.Infof("Resources: %s\n", pcfo)
-			} else {
-				kubeError(cerr)
-			}
 
-		case "service":
-			service, cerr := kube.CreateServiceFromJSON(obj.Namespace, cm.Data[dataKey])
-			if cerr == nil {
-				glog.Errorf("Created service: %s\n", service)
-				pcfo = append(pcfo,
-					ResourcesKubeObject{
-						Kind:      "service",
-						Name:      service.ObjectMeta.Name,
-						Namespace: obj.Namespace})
-				glog.Infof("Resources: %s\n", pcfo)
-			} else {
-				kubeError(cerr)
+		data := cm.Data[wrappedDataKey]
+		if cm.ObjectMeta.Labels["mesitis/template"] == "true" {
+			if data, err = values.render(cm.Name, data); err != nil {
+				glog.Errorf("Failed to render resources wrapped in ConfigMap %s: %s", cm.Name, err)
+				return nil, fmt.Errorf("failed to render resources wrapped in ConfigMap %s: %s", cm.Name, err)
 			}
+		}
 
-		case "configmap":
-			configMap, cerr := kube.CreateConfigMapFromJSON(obj.Namespace, cm.Data[dataKey])
-			if cerr == nil {
-				glog.Errorf("Created ConfigMap: %s\n", configMap)
-				pcfo = append(pcfo,
-					ResourcesKubeObject{
-						Kind:      "configmap",
-						Name:      configMap.ObjectMeta.Name,
-						Namespace: obj.Namespace})
-				glog.Infof("Resources: %s\n", pcfo)
-			} else {
-				kubeError(cerr)
-			}
+		// a ConfigMap may hold several documents, created in the order given
+		docs, err := splitManifests(data)
+		if err != nil {
+			glog.Errorf("Failed to read resources wrapped in ConfigMap %s: %s", cm.Name, err)
+			return nil, fmt.Errorf("failed to read resources wrapped in ConfigMap %s: %s", cm.Name, err)
+		}
+		for _, doc := range docs {
+			wrapped = append(wrapped, wrappedDoc{manifestKind(doc, cm.ObjectMeta.Labels["mesitis/kind"]), doc})
+		}
+	}
+	return wrapped, nil
+}
+
+// an object a provision applies, adopting it if left by an earlier attempt
+type preparedObject struct {
+	kind, name, doc string
+	adopt           bool
+}
+
+// prepare renders, checks and labels the objects of an instance, without
+// changing anything. Objects left by an earlier attempt for this instance
+// are to be adopted, not created again; any owned by something else stop
+// the provision before anything is created.
+func (p ProvisionNewClusterObjects) prepare(kube Kube, id string, entry *Entry, values *TemplateValues) (string, []preparedObject, error) {
+	namespace, err := p.targetNamespace(entry, values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// read and render every document before creating any, so a template
+	// error leaves nothing half provisioned
+	wrapped, err := p.render(kube, entry, values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the consumer namespace may not have been prepared for the broker
+	if p.ConsumerNamespace {
+		kinds := make([]string, 0, len(wrapped))
+		for _, w := range wrapped {
+			kinds = append(kinds, w.kind)
+		}
+		if err := checkObjectAccess(kube, namespace, kinds); err != nil {
+			return "", nil, err
+		}
+	}
 
-		case "secret":
-			secret, cerr := kube.CreateSecretFromJSON(obj.Namespace, cm.Data[dataKey])
-			if cerr == nil {
-				glog.Errorf("Created secret: %s\n", secret)
-				pcfo = append(pcfo,
-					ResourcesKubeObject{
-						Kind:      "secret",
-						Name:      secret.ObjectMeta.Name,
-						Namespace: obj.Namespace})
-				glog.Infof("Resources: %s\n", pcfo)
-			} else {
-				kubeError(cerr)
+	labels := ownerLabels(kube, id, entry, values)
+	annotations := ownerAnnotations(id, entry)
+
+	objects := make([]preparedObject, 0, len(wrapped))
+	for _, w := range wrapped {
+		name := documentName(w.doc)
+		adopt := false
+		if exists, ok := objectCheckers[w.kind]; ok && name != "" && exists(kube, namespace, name) {
+			if err := checkAdoptable(kube, id, w.kind, namespace, name); err != nil {
+				return "", nil, err
 			}
+			adopt = true
+		}
+		doc, err := stampOwner(w.doc, labels, annotations)
+		if err != nil {
+			glog.Errorf("Failed to label %s for instance %s: %s", w.kind, id, err)
+			return "", nil, err
+		}
+		objects = append(objects, preparedObject{kind: w.kind, name: name, doc: doc, adopt: adopt})
+	}
+	return namespace, objects, nil
+}
+
+func (p ProvisionNewClusterObjects) Provision(kube Kube, id string, entry *Entry, values *TemplateValues) (*Instance, error) {
+
+	// TODO consider checking whether a service with the given name exists in the namespace
 
-		default:
-			glog.Errorf("Don't know how to create object: %s", cm.ObjectMeta.Labels["mesitis/kind"])
+	namespace, objects, err := p.prepare(kube, id, entry, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO rename pcfo, no longer relevant
+	pcfo := ResourcesKubeObjectList{}
+	created := ResourcesKubeObjectList{}
+
+	for _, o := range objects {
+		// adopted objects are applied too, to finish what the earlier attempt began
+		applied, cerr := applyObject(kube, o.kind, namespace, o.doc, false)
+		if cerr != nil {
+			glog.Errorf("Failed to create %s %s in namespace %s for instance %s: %s", o.kind, o.name, namespace, id, cerr)
+			// objects this attempt created go, so a retry starts clean
+			for _, po := range created {
+				removeCreated(kube, po)
+			}
+			if be, ok := cerr.(*BrokerError); ok {
+				return nil, be
+			}
+			return nil, NewBrokerError(http.StatusInternalServerError, "", "Failed to create %s %s in namespace %s: %s", o.kind, o.name, namespace, cerr)
+		}
+		if o.adopt {
+			glog.Infof("Adopted %s: %s\n", o.kind, applied.Name)
+		} else {
+			glog.Infof("Created %s: %s\n", o.kind, applied.Name)
+			created = append(created, *applied)
 		}
+		pcfo = append(pcfo, *applied)
 	}
+	glog.Infof("Resources: %s\n", pcfo)
 
-	URL := fmt.Sprintf("%s.%s.svc.cluster.local", p.Name, p.Namespace)
-	instance := Instance{*entry, id, nil, &CoordinatesClusterURL{URL: URL}, nil, &pcfo, nil}
+	instance := Instance{Entry: *entry, InstanceID: id, CoordinatesClusterURL: p.coordinates(kube, entry, namespace), ResourcesKubeObjectList: &pcfo}
 
 	return &instance, nil
 }
 
+// coordinates are the URL and ports of the Service consumers reach, if one
+// was created
+func (p ProvisionNewClusterObjects) coordinates(kube Kube, entry *Entry, namespace string) *CoordinatesClusterURL {
+	var ports []CoordinatesPort
+	if service, err := kube.GetService(namespace, p.Name); err == nil {
+		ports = servicePorts(service)
+	} else {
+		glog.Warningf("Service %s/%s of %s not found, coordinates will have no port: %s", namespace, p.Name, entry.serviceName(), err)
+	}
+
+	URL := fmt.Sprintf("%s.%s.svc.cluster.local", p.Name, namespace)
+	return &CoordinatesClusterURL{URL: URL, Ports: ports}
+}
+
+func servicePorts(service *v1.Service) []CoordinatesPort {
+	ports := make([]CoordinatesPort, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		ports = append(ports, CoordinatesPort{Name: port.Name, Port: port.Port, Protocol: string(port.Protocol)})
+	}
+	return ports
+}
+
 func (c *Entry) serviceName() string {
 	return fmt.Sprintf("%s-%s", c.Team, c.Offering)
 }
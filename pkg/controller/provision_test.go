@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+// answers access reviews, denying the verb/resource pairs given
+type accessKube struct {
+	Kube
+	denied map[string]bool
+}
+
+func (k *accessKube) CanI(namespace, verb, group, resource string) (bool, string, error) {
+	if k.denied[verb+"/"+resource] {
+		return false, "no RBAC policy matched", nil
+	}
+	return true, "", nil
+}
+
+func TestCheckObjectAccess(t *testing.T) {
+	tests := []struct {
+		kinds  []string
+		denied map[string]bool
+		ok     bool
+	}{
+		{[]string{"deployment", "service"}, nil, true},
+		{[]string{"deployment", "service"}, map[string]bool{"create/services": true}, false},
+		{[]string{"deployment", "service"}, map[string]bool{"delete/deployments": true}, false},
+		{[]string{"service"}, map[string]bool{"patch/services": true}, false},
+		// only the kinds to be created are checked
+		{[]string{"configmap"}, map[string]bool{"create/secrets": true}, true},
+	}
+
+	for _, test := range tests {
+		err := checkObjectAccess(&accessKube{denied: test.denied}, "client-ns", test.kinds)
+		if test.ok && err != nil {
+			t.Errorf("%v denied %v: unexpected %s", test.kinds, test.denied, err)
+		}
+		if !test.ok {
+			if be, ok := err.(*BrokerError); !ok || be.Status != 403 {
+				t.Errorf("%v denied %v: expected a 403, got %v", test.kinds, test.denied, err)
+			}
+		}
+	}
+}
+
+func TestRenderUnreadable(t *testing.T) {
+	cm := templateConfigMap("t")
+	entry := &Entry{Team: "t", Offering: "o", source: &fakeSource{wrapped: []v1.ConfigMap{cm}}}
+	p := ProvisionNewClusterObjects{LabelSelector: "app=web"}
+	values := &TemplateValues{Parameters: map[string]interface{}{"size": `small"}}}`}}
+
+	// quoted, a value cannot change the document around it
+	if _, err := p.render(nil, entry, values); err != nil {
+		t.Errorf("expected the quoted value to render, got %s", err)
+	}
+	// spliced as it is, the resources cannot be read and none are rendered
+	cm.Data[wrappedDataKey] = `{"kind": "Deployment", "metadata": {"labels": {"size": "{{ .Parameters.size }}"}}}`
+	entry.source = &fakeSource{wrapped: []v1.ConfigMap{cm}}
+	if wrapped, err := p.render(nil, entry, values); err == nil {
+		t.Errorf("expected the unreadable resources to fail the render, got %v", wrapped)
+	}
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Limits on the instances and bindings of an entry, none where zero. An
+// entry's quota and the broker's both apply, so the lower limit wins.
+type Quota struct {
+	// instances of the entry in any one consumer namespace
+	InstancesPerNamespace int `json:"instancespernamespace,omitempty"`
+	// instances of the entry in all
+	Instances int `json:"instances,omitempty"`
+	// bindings of any one instance
+	BindingsPerInstance int `json:"bindingsperinstance,omitempty"`
+}
+
+// errorCode sent with a quota rejection
+const quotaExceeded = "QuotaExceeded"
+
+func quotaError(format string, args ...interface{}) *BrokerError {
+	return NewBrokerError(http.StatusForbidden, quotaExceeded, format, args...)
+}
+
+func lowerLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Merge returns the lower of each limit in the two quotas
+func (q Quota) Merge(other Quota) Quota {
+	return Quota{
+		InstancesPerNamespace: lowerLimit(q.InstancesPerNamespace, other.InstancesPerNamespace),
+		Instances:             lowerLimit(q.Instances, other.Instances),
+		BindingsPerInstance:   lowerLimit(q.BindingsPerInstance, other.BindingsPerInstance),
+	}
+}
+
+func (e *Entry) quota(broker Quota) Quota {
+	if e.Quota == nil {
+		return broker
+	}
+	return e.Quota.Merge(broker)
+}
+
+// An instance counted toward quota before it is saved
+type PendingInstance struct {
+	UUID      string
+	Namespace string
+}
+
+// CheckProvisionQuota returns a BrokerError naming the quota another
+// instance of the entry for the namespace would exceed, counting the
+// pending instances with those saved
+func (e *Entry) CheckProvisionQuota(s Storage, broker Quota, namespace string, pending ...PendingInstance) error {
+	q := e.quota(broker)
+	var all, inNamespace int
+	for _, p := range pending {
+		if p.UUID != e.UUID {
+			continue
+		}
+		all++
+		if p.Namespace == namespace {
+			inNamespace++
+		}
+	}
+
+	if q.Instances > 0 {
+		n, err := CountInstances(s, e.UUID)
+		if err != nil {
+			return err
+		}
+		if n += all; n >= q.Instances {
+			return quotaError("Quota exceeded: at most %d instances of service %s, %d exist.", q.Instances, e.serviceName(), n)
+		}
+	}
+	if q.InstancesPerNamespace > 0 {
+		n, err := CountNamespaceInstances(s, e.UUID, namespace)
+		if err != nil {
+			return err
+		}
+		if n += inNamespace; n >= q.InstancesPerNamespace {
+			return quotaError("Quota exceeded: at most %d instances of service %s per namespace, %s has %d.", q.InstancesPerNamespace, e.serviceName(), namespace, n)
+		}
+	}
+	return nil
+}
+
+// checkProvisionQuota checks the quota of the entry counting the instances
+// being provisioned or awaiting approval, other than the one given
+func (c *ProductionController) checkProvisionQuota(entry *Entry, namespace, except string) error {
+	awaiting, err := PendingProvisions(c.Storage, entry.UUID)
+	if err != nil {
+		return err
+	}
+	// an approved instance is both awaiting and being provisioned
+	for id, p := range c.provisioning {
+		awaiting[id] = p
+	}
+	delete(awaiting, except)
+	pending := make([]PendingInstance, 0, len(awaiting))
+	for _, p := range awaiting {
+		pending = append(pending, p)
+	}
+	return entry.CheckProvisionQuota(c.Storage, c.Options.Quota, namespace, pending...)
+}
+
+// reserveQuota counts an instance toward quota while it is provisioned,
+// until the returned func is called
+func (c *ProductionController) reserveQuota(id string, entry *Entry, namespace string) func() {
+	if c.provisioning == nil {
+		c.provisioning = make(map[string]PendingInstance)
+	}
+	c.provisioning[id] = PendingInstance{UUID: entry.UUID, Namespace: namespace}
+	return func() {
+		delete(c.provisioning, id)
+	}
+}
+
+// CheckBindQuota returns a BrokerError if another binding of the instance
+// would exceed the quota
+func (e *Entry) CheckBindQuota(s Storage, broker Quota, instanceID string) error {
+	q := e.quota(broker)
+
+	if q.BindingsPerInstance > 0 {
+		n, err := CountBindings(s, instanceID)
+		if err != nil {
+			return err
+		}
+		if n >= q.BindingsPerInstance {
+			return quotaError("Quota exceeded: at most %d bindings per instance of service %s, instance %s has %d.", q.BindingsPerInstance, e.serviceName(), instanceID, n)
+		}
+	}
+	return nil
+}
+
+func (e *Entry) validateQuota() ValidationErrors {
+	errs := ValidationErrors{}
+	if e.Quota == nil {
+		return errs
+	}
+	for _, field := range []struct {
+		name  string
+		limit int
+	}{
+		{"quota.instancespernamespace", e.Quota.InstancesPerNamespace},
+		{"quota.instances", e.Quota.Instances},
+		{"quota.bindingsperinstance", e.Quota.BindingsPerInstance},
+	} {
+		if field.limit < 0 {
+			errs = append(errs, ValidationError{e.Origin, field.name, fmt.Sprintf("negative limit %d", field.limit), SeverityError})
+		}
+	}
+	return errs
+}
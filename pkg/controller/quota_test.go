@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
+)
+
+func TestQuota(t *testing.T) {
+	s := NewMemStorage()
+	e := &Entry{Team: "api", Offering: "api-service", UUID: "3", Quota: &Quota{InstancesPerNamespace: 1, BindingsPerInstance: 1}}
+	broker := Quota{Instances: 2}
+
+	for _, i := range []*Instance{
+		{Entry: *e, InstanceID: "a", ConsumerNamespace: "client-ns"},
+		{Entry: *e, InstanceID: "b", ConsumerNamespace: "other-ns"},
+	} {
+		if err := e.CheckProvisionQuota(s, broker, i.ConsumerNamespace); err != nil {
+			t.Fatalf("instance %s: unexpected %v", i.InstanceID, err)
+		}
+		if err := SaveInstance(s, i.InstanceID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.CheckProvisionQuota(s, Quota{}, "client-ns"); err == nil {
+		t.Errorf("expected instances per namespace quota exceeded")
+	}
+	if err := e.CheckProvisionQuota(s, broker, "third-ns"); err == nil {
+		t.Errorf("expected broker instances quota exceeded")
+	}
+
+	// the quota frees up as instances are deleted
+	if err := DeleteInstance(s, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CheckProvisionQuota(s, broker, "third-ns"); err != nil {
+		t.Errorf("unexpected %v", err)
+	}
+
+	instance, _ := LoadInstance(s, "a")
+	if err := SaveBinding(s, "x", &Binding{Instance: instance, BindingID: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CheckBindQuota(s, broker, "a"); err == nil {
+		t.Errorf("expected bindings per instance quota exceeded")
+	}
+	if err := e.CheckBindQuota(s, broker, "b"); err != nil {
+		t.Errorf("unexpected %v", err)
+	}
+}
+
+func TestQuotaMerge(t *testing.T) {
+	q := Quota{InstancesPerNamespace: 3, Instances: 0, BindingsPerInstance: 5}.Merge(Quota{InstancesPerNamespace: 5, Instances: 10})
+	if q != (Quota{InstancesPerNamespace: 3, Instances: 10, BindingsPerInstance: 5}) {
+		t.Errorf("unexpected merge %v", q)
+	}
+}
+
+func TestQuotaAwaitingApproval(t *testing.T) {
+	s := NewMemStorage()
+	e := &Entry{Team: "api", Offering: "api-service", UUID: "3", Quota: &Quota{InstancesPerNamespace: 1}}
+	c := &ProductionController{Storage: s}
+
+	op := &Operation{InstanceID: "a", Kind: provisionOperation, State: brokerapi.StateInProgress, EntryUUID: e.UUID, Namespace: "client-ns"}
+	if err := SaveOperation(s, op.InstanceID, op); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkProvisionQuota(e, "client-ns", "b"); err == nil {
+		t.Errorf("expected the instance awaiting approval counted")
+	}
+	if err := c.checkProvisionQuota(e, "client-ns", "a"); err != nil {
+		t.Errorf("unexpected %v", err)
+	}
+
+	// indexes rebuilt from storage still count it
+	if err := RebuildIndexes(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkProvisionQuota(e, "client-ns", "b"); err == nil {
+		t.Errorf("expected the instance awaiting approval counted after a rebuild")
+	}
+
+	// a decided operation no longer holds quota
+	op.State = brokerapi.StateFailed
+	if err := SaveOperation(s, op.InstanceID, op); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkProvisionQuota(e, "client-ns", "b"); err != nil {
+		t.Errorf("unexpected %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// JSON Schemas of the parameters an entry accepts when an instance is
+// created or updated and when it is bound. They are published in the plan
+// of the catalog, and requests with parameters that do not match are
+// refused with a 400 naming each field in error.
+//
+// ex {"create": {"type": "object", "properties": {"replicas": {"type": "integer", "maximum": 5}}}}
+type ParameterSchemas struct {
+	Create map[string]interface{} `json:"create,omitempty"`
+	Update map[string]interface{} `json:"update,omitempty"`
+	Bind   map[string]interface{} `json:"bind,omitempty"`
+}
+
+// errorCode sent with parameters that do not match their schema
+const invalidParameters = "InvalidParameters"
+
+// compiled schemas by entry uuid, version and operation. An entry that
+// changes is expected to change its version.
+var compiledSchemas = struct {
+	sync.Mutex
+	schemas map[string]*gojsonschema.Schema
+}{schemas: make(map[string]*gojsonschema.Schema)}
+
+// compiledSchema compiles the entry's schema for an operation once per
+// version. Entries without a uuid or version never pass validation, and
+// are compiled every time.
+func (e *Entry) compiledSchema(operation string, schema map[string]interface{}) (*gojsonschema.Schema, error) {
+	key := e.UUID + "/" + e.Version + "/" + operation
+	cache := e.UUID != "" && e.Version != ""
+	if cache {
+		compiledSchemas.Lock()
+		compiled, ok := compiledSchemas.schemas[key]
+		compiledSchemas.Unlock()
+		if ok {
+			return compiled, nil
+		}
+	}
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(schema))
+	if err != nil {
+		return nil, err
+	}
+	if cache {
+		compiledSchemas.Lock()
+		compiledSchemas.schemas[key] = compiled
+		compiledSchemas.Unlock()
+	}
+	return compiled, nil
+}
+
+func (s *ParameterSchemas) forOperation(operation string) map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	switch operation {
+	case OperationProvision:
+		return s.Create
+	case OperationUpdate:
+		return s.Update
+	case OperationBind:
+		return s.Bind
+	}
+	return nil
+}
+
+func inputParameters(schema map[string]interface{}) *brokerapi.InputParameters {
+	if schema == nil {
+		return nil
+	}
+	return &brokerapi.InputParameters{Parameters: schema}
+}
+
+// planSchemas is the schemas block of the entry's plan, nil if it has none
+func (e *Entry) planSchemas() *brokerapi.Schemas {
+	s := e.Schemas
+	if s == nil || (s.Create == nil && s.Update == nil && s.Bind == nil) {
+		return nil
+	}
+	schemas := &brokerapi.Schemas{}
+	if s.Create != nil || s.Update != nil {
+		schemas.ServiceInstance = &brokerapi.ServiceInstanceSchema{
+			Create: inputParameters(s.Create),
+			Update: inputParameters(s.Update),
+		}
+	}
+	if s.Bind != nil {
+		schemas.ServiceBinding = &brokerapi.ServiceBindingSchema{Create: inputParameters(s.Bind)}
+	}
+	return schemas
+}
+
+// CheckParameters returns a BrokerError listing every field of the
+// parameters that does not match the entry's schema for the operation
+func (e *Entry) CheckParameters(operation string, parameters map[string]interface{}) error {
+	schema := e.Schemas.forOperation(operation)
+	if schema == nil {
+		return nil
+	}
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+
+	compiled, err := e.compiledSchema(operation, schema)
+	if err != nil {
+		return fmt.Errorf("invalid %s schema of %s: %s", operation, e.serviceName(), err)
+	}
+	result, err := compiled.Validate(gojsonschema.NewGoLoader(parameters))
+	if err != nil {
+		return NewBrokerError(http.StatusBadRequest, invalidParameters, "Parameters could not be read: %s", err)
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	problems := make([]string, 0, len(result.Errors()))
+	for _, re := range result.Errors() {
+		problems = append(problems, fmt.Sprintf("%s: %s", re.Field(), re.Description()))
+	}
+	return NewBrokerError(http.StatusBadRequest, invalidParameters, "Invalid parameters for %s of service %s: %s.", operation, e.serviceName(), strings.Join(problems, "; "))
+}
+
+// validateSchemas checks every schema can be compiled
+func (e *Entry) validateSchemas() ValidationErrors {
+	errs := ValidationErrors{}
+	if e.Schemas == nil {
+		return errs
+	}
+	for _, s := range []struct {
+		field  string
+		schema map[string]interface{}
+	}{
+		{"schemas.create", e.Schemas.Create},
+		{"schemas.update", e.Schemas.Update},
+		{"schemas.bind", e.Schemas.Bind},
+	} {
+		if s.schema == nil {
+			continue
+		}
+		if _, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(s.schema)); err != nil {
+			errs = append(errs, ValidationError{e.Origin, s.field, fmt.Sprintf("invalid schema: %s", err), SeverityError})
+		}
+	}
+	return errs
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// What wrapped resources labeled mesitis/template=true and credentials
+// kept in the catalog can refer to as Go templates, ex {{ .Parameters.replicas }}
+type TemplateValues struct {
+	InstanceID string
+	// the consumer namespace
+	Namespace  string
+	Parameters map[string]interface{}
+	// prerequisites by dependency name
+	Dependencies map[string]*DependencyValues
+	// set when binding
+	BindingID      string
+	BindParameters map[string]interface{}
+}
+
+var templateFuncs = template.FuncMap{
+	// {{ default 3 (index .Parameters "replicas") }}
+	"default": func(d interface{}, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return d
+		}
+		return v
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// templates fail on a field that is not there rather than render
+// "<no value>"; index reads a parameter that may not be set
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// renderTemplate executes text as a template of data
+func renderTemplate(name, text string, data interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// render executes text as a template of the values
+func (v *TemplateValues) render(name, text string) (string, error) {
+	if v == nil {
+		return text, nil
+	}
+	return renderTemplate(name, text, v)
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestCheckParameters(t *testing.T) {
+	e := &Entry{Team: "api", Offering: "api-service", Schemas: &ParameterSchemas{
+		Create: map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"size"},
+			"properties": map[string]interface{}{
+				"size":     map[string]interface{}{"type": "string", "enum": []interface{}{"small", "large"}},
+				"replicas": map[string]interface{}{"type": "integer", "maximum": 5},
+			},
+		},
+	}}
+
+	tests := []struct {
+		operation  string
+		parameters map[string]interface{}
+		valid      bool
+	}{
+		{OperationProvision, map[string]interface{}{"size": "small"}, true},
+		{OperationProvision, map[string]interface{}{"size": "small", "replicas": 3.0}, true},
+		{OperationProvision, map[string]interface{}{"size": "medium"}, false},
+		{OperationProvision, map[string]interface{}{"size": "large", "replicas": 6.0}, false},
+		{OperationProvision, nil, false},
+		// no schema for these
+		{OperationUpdate, map[string]interface{}{"size": "medium"}, true},
+		{OperationBind, nil, true},
+	}
+
+	for _, test := range tests {
+		err := e.CheckParameters(test.operation, test.parameters)
+		if test.valid && err != nil {
+			t.Errorf("%s %v: unexpected %s", test.operation, test.parameters, err)
+		}
+		if !test.valid {
+			if be, ok := err.(*BrokerError); !ok || be.ErrorCode != invalidParameters {
+				t.Errorf("%s %v: expected %s, got %v", test.operation, test.parameters, invalidParameters, err)
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	values := &TemplateValues{InstanceID: "a", Namespace: "client-ns", Parameters: map[string]interface{}{"replicas": 3.0}}
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{`{"replicas": 1}`, `{"replicas": 1}`},
+		{`{"replicas": {{ .Parameters.replicas }}}`, `{"replicas": 3}`},
+		{`{"size": {{ default "small" (index .Parameters "size") | json }}}`, `{"size": "small"}`},
+		{`{"name": "db-{{ .InstanceID }}", "namespace": "{{ .Namespace }}"}`, `{"name": "db-a", "namespace": "client-ns"}`},
+	}
+
+	if _, err := values.render("test", `{"size": {{ .Parameters.size | json }}}`); err == nil {
+		t.Errorf("expected an error for a parameter that is not set")
+	}
+
+	for _, test := range tests {
+		rendered, err := values.render("test", test.text)
+		if err != nil {
+			t.Errorf("%s: unexpected %s", test.text, err)
+		} else if rendered != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.text, test.expected, rendered)
+		}
+	}
+}
+
+func TestCredentialFromCatalog(t *testing.T) {
+	values := &TemplateValues{BindingID: "b"}
+	for _, template := range []bool{false, true} {
+		e := &Entry{CredentialFromCatalog: &CredentialFromCatalog{Username: "user-{{ .BindingID }}", Password: "p{{", Template: template}}
+		m, err := e.Credential(nil, values)
+		if template {
+			if err == nil {
+				t.Errorf("template: expected the password to fail to render, got %v", m)
+			}
+		} else if err != nil || m["Username"] != "user-{{ .BindingID }}" || m["Password"] != "p{{" {
+			t.Errorf("not a template: expected the credential as written, got %v %v", m, err)
+		}
+	}
+}
@@ -1,19 +1,41 @@
 package controller
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/golang/glog"
 )
 
+// returned by Get when nothing is stored under the key
+var ErrNotFound = errors.New("nothing under that key")
+
 type Storage interface {
 	Set(key string, value string, expiration time.Duration) error
 	Get(key string) (value string, err error)
 	Del(key string) error
+	Keys(pattern string) ([]string, error)
+
+	// sets of members, used for indexes
+	SAdd(key string, member string) error
+	SRem(key string, member string) error
+	SCard(key string) (int, error)
+	SMembers(key string) ([]string, error)
+}
+
+// Storage that can report whether it is reachable
+type HealthChecker interface {
+	Healthy() error
 }
 
 type PreMarshal interface {
@@ -28,31 +50,182 @@ type PostUnmarshal interface {
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
 
+// Options for reaching redis. A non-empty MasterName selects a Sentinel
+// failover client, non-empty ClusterAddresses a cluster client, otherwise
+// a single node at Address is used.
+type RedisOptions struct {
+	Address           string
+	Password          string
+	Database          int
+	MasterName        string
+	SentinelAddresses []string
+	ClusterAddresses  []string
+
+	// prepended to every key, so several brokers can share one redis
+	KeyPrefix string
+
+	TLS                   bool
+	TLSCAFile             string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxRetries   int
+}
+
 // TODO redis handles concurrency?
 type RedisStorage struct {
-	Redis *redis.Client
+	Redis  redis.UniversalClient
+	Prefix string
 }
 
-func NewRedisStorage(address, password string, database int) *RedisStorage {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: password,
-		DB:       database,
-	})
-	return &RedisStorage{redisClient}
+func NewRedisStorage(options *RedisOptions) (*RedisStorage, error) {
+	var tlsConfig *tls.Config
+	if options.TLS {
+		var err error
+		if tlsConfig, err = redisTLSConfig(options); err != nil {
+			glog.Errorf("Failed to configure redis TLS: %s", err)
+			return nil, err
+		}
+	}
+
+	var client redis.UniversalClient
+	switch {
+	case options.MasterName != "":
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    options.MasterName,
+			SentinelAddrs: options.SentinelAddresses,
+			Password:      options.Password,
+			DB:            options.Database,
+			DialTimeout:   options.DialTimeout,
+			ReadTimeout:   options.ReadTimeout,
+			WriteTimeout:  options.WriteTimeout,
+			MaxRetries:    options.MaxRetries,
+			TLSConfig:     tlsConfig,
+		})
+	case len(options.ClusterAddresses) > 0:
+		if options.Database != 0 {
+			return nil, errors.New("redis cluster supports only database 0")
+		}
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        options.ClusterAddresses,
+			Password:     options.Password,
+			DialTimeout:  options.DialTimeout,
+			ReadTimeout:  options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			MaxRetries:   options.MaxRetries,
+			TLSConfig:    tlsConfig,
+		})
+	default:
+		client = redis.NewClient(&redis.Options{
+			Addr:         options.Address,
+			Password:     options.Password,
+			DB:           options.Database,
+			DialTimeout:  options.DialTimeout,
+			ReadTimeout:  options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			MaxRetries:   options.MaxRetries,
+			TLSConfig:    tlsConfig,
+		})
+	}
+	return &RedisStorage{Redis: client, Prefix: options.KeyPrefix}, nil
+}
+
+func redisTLSConfig(options *RedisOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         options.TLSServerName,
+		InsecureSkipVerify: options.TLSInsecureSkipVerify,
+	}
+	if options.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(options.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", options.TLSCAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
 }
 
 func (r *RedisStorage) Set(key string, value string, expiration time.Duration) error {
-	return r.Redis.Set(key, value, expiration).Err()
+	return r.Redis.Set(r.Prefix+key, value, expiration).Err()
 }
 
 func (r *RedisStorage) Get(key string) (string, error) {
-	v, e := r.Redis.Get(key).Result()
+	v, e := r.Redis.Get(r.Prefix + key).Result()
+	if e == redis.Nil {
+		return "", ErrNotFound
+	}
 	return v, e
 }
 
 func (r *RedisStorage) Del(key string) error {
-	return r.Redis.Del(key).Err()
+	return r.Redis.Del(r.Prefix + key).Err()
+}
+
+// TODO KEYS blocks redis, consider SCAN for large keyspaces
+func (r *RedisStorage) Keys(pattern string) ([]string, error) {
+	var keys []string
+
+	// a cluster client sends KEYS to a single node, so ask every master
+	if cluster, ok := r.Redis.(*redis.ClusterClient); ok {
+		var mutex sync.Mutex
+		err := cluster.ForEachMaster(func(c *redis.Client) error {
+			k, err := c.Keys(r.Prefix + pattern).Result()
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			keys = append(keys, k...)
+			mutex.Unlock()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if keys, err = r.Redis.Keys(r.Prefix + pattern).Result(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, r.Prefix)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (r *RedisStorage) SAdd(key string, member string) error {
+	return r.Redis.SAdd(r.Prefix+key, member).Err()
+}
+
+func (r *RedisStorage) SRem(key string, member string) error {
+	return r.Redis.SRem(r.Prefix+key, member).Err()
+}
+
+func (r *RedisStorage) SCard(key string) (int, error) {
+	n, err := r.Redis.SCard(r.Prefix + key).Result()
+	return int(n), err
+}
+
+func (r *RedisStorage) SMembers(key string) ([]string, error) {
+	members, err := r.Redis.SMembers(r.Prefix + key).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (r *RedisStorage) Healthy() error {
+	return r.Redis.Ping().Err()
 }
 
 /////////////////////////////////////////////////////////////////
@@ -62,31 +235,109 @@ func (r *RedisStorage) Del(key string) error {
 // TODO handle concurrent access?
 type MemStorage struct {
 	storage map[string]string
+	// when keys saved with an expiration expire
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
 }
 
 func NewMemStorage() *MemStorage {
-	return &MemStorage{storage: make(map[string]string, 0)}
+	return &MemStorage{storage: make(map[string]string, 0), expires: make(map[string]time.Time, 0), sets: make(map[string]map[string]bool, 0)}
 }
 
 func (m *MemStorage) Set(key string, value string, expiration time.Duration) error {
 	glog.Infof("Saving: <%s> to key: <%s>\n", value, key)
 	m.storage[key] = value
+	if expiration > 0 {
+		m.expires[key] = time.Now().Add(expiration)
+	} else {
+		delete(m.expires, key)
+	}
 	return nil
 }
 
+// expire drops the key if it has expired, as redis would have
+func (m *MemStorage) expire(key string) {
+	if at, ok := m.expires[key]; ok && !time.Now().Before(at) {
+		delete(m.storage, key)
+		delete(m.expires, key)
+	}
+}
+
 func (m *MemStorage) Get(key string) (value string, err error) {
+	m.expire(key)
 	if v, ok := m.storage[key]; ok {
 		return v, nil
 	} else {
-		return "", errors.New("nothing under that key")
+		return "", ErrNotFound
 	}
 }
 
 func (m *MemStorage) Del(key string) error {
 	delete(m.storage, key)
+	delete(m.expires, key)
+	delete(m.sets, key)
+	return nil
+}
+
+// Keys matches with glob patterns, close enough to redis KEYS semantics
+func (m *MemStorage) Keys(pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	for k := range m.storage {
+		m.expire(k)
+		if _, ok := m.storage[k]; !ok {
+			continue
+		}
+		matched, err := path.Match(pattern, k)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			keys = append(keys, k)
+		}
+	}
+	for k := range m.sets {
+		matched, err := path.Match(pattern, k)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemStorage) SAdd(key string, member string) error {
+	if m.sets[key] == nil {
+		m.sets[key] = make(map[string]bool, 0)
+	}
+	m.sets[key][member] = true
+	return nil
+}
+
+// an emptied set is removed, as in redis
+func (m *MemStorage) SRem(key string, member string) error {
+	delete(m.sets[key], member)
+	if len(m.sets[key]) == 0 {
+		delete(m.sets, key)
+	}
 	return nil
 }
 
+func (m *MemStorage) SCard(key string) (int, error) {
+	return len(m.sets[key]), nil
+}
+
+func (m *MemStorage) SMembers(key string) ([]string, error) {
+	members := make([]string, 0, len(m.sets[key]))
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
@@ -141,10 +392,45 @@ func LoadInstance(s Storage, id string) (*Instance, error) {
 	}
 }
 
+// ListInstances loads every stored instance
+func ListInstances(s Storage) ([]*Instance, error) {
+	keys, err := s.Keys(instanceName("*"))
+	if err != nil {
+		glog.Errorf("Failed to list instances: %s", err)
+		return nil, err
+	}
+	instances := make([]*Instance, 0, len(keys))
+	for _, key := range keys {
+		instance, err := LoadInstance(s, strings.TrimPrefix(key, instanceName("")))
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
 func SaveInstance(s Storage, id string, instance *Instance) error {
+	return saveInstance(s, id, instance, 0)
+}
+
+// SaveExpiredInstance saves an expired instance, kept for retention
+func SaveExpiredInstance(s Storage, id string, instance *Instance, retention time.Duration) error {
+	return saveInstance(s, id, instance, retention)
+}
+
+func saveInstance(s Storage, id string, instance *Instance, expiration time.Duration) error {
+
+	// the consumer namespace may have changed
+	if previous, err := s.Get(instanceName(id)); err == nil {
+		var i Instance
+		if json.Unmarshal([]byte(previous), &i) == nil {
+			unindexInstance(s, &i)
+		}
+	}
 
 	if js, err := json.Marshal(instance); err == nil {
-		if err := s.Set(instanceName(id), string(js[:]), 0); err != nil {
+		if err := s.Set(instanceName(id), string(js[:]), expiration); err != nil {
 			glog.Errorf("Failed to save Instance: %s", err)
 			return err
 		}
@@ -152,10 +438,17 @@ func SaveInstance(s Storage, id string, instance *Instance) error {
 		glog.Errorf("Failed to marshal Instance: %s", err)
 		return err
 	}
-	return nil
+	return indexInstance(s, instance)
 }
 
 func DeleteInstance(s Storage, id string) error {
+	if previous, err := s.Get(instanceName(id)); err == nil {
+		var i Instance
+		if json.Unmarshal([]byte(previous), &i) == nil {
+			unindexInstance(s, &i)
+		}
+	}
+
 	if err := s.Del(instanceName(id)); err != nil {
 		glog.Errorf("Failed to delete instance: %s", err)
 		return err
@@ -199,6 +492,24 @@ func LoadBinding(s Storage, id string) (*Binding, error) {
 	}
 }
 
+// ListBindings loads every stored binding
+func ListBindings(s Storage) ([]*Binding, error) {
+	keys, err := s.Keys(bindingName("*"))
+	if err != nil {
+		glog.Errorf("Failed to list bindings: %s", err)
+		return nil, err
+	}
+	bindings := make([]*Binding, 0, len(keys))
+	for _, key := range keys {
+		binding, err := LoadBinding(s, strings.TrimPrefix(key, bindingName("")))
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
 func SaveBinding(s Storage, id string, binding *Binding) error {
 
 	if err := binding.PreMarshal(); err != nil {
@@ -214,13 +525,94 @@ func SaveBinding(s Storage, id string, binding *Binding) error {
 		glog.Errorf("Failed to marshal Binding: %s", err)
 		return err
 	}
-	return nil
+	return addIndexEntries(s, bindingIndexEntries(binding))
 }
 
 func DeleteBinding(s Storage, id string) error {
+	if previous, err := s.Get(bindingName(id)); err == nil {
+		var b Binding
+		if json.Unmarshal([]byte(previous), &b) == nil {
+			remIndexEntries(s, bindingIndexEntries(&b))
+		}
+	}
+
 	if err := s.Del(bindingName(id)); err != nil {
 		glog.Errorf("Failed to delete Binding: %s", err)
 		return err
 	}
 	return nil
 }
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+func operationName(id string) string {
+	return fmt.Sprintf("operation-%s", id)
+}
+
+func LoadOperation(s Storage, id string) (*Operation, error) {
+
+	js, err := s.Get(operationName(id))
+	if err != nil {
+		return nil, err
+	}
+	o := Operation{}
+	if err := json.Unmarshal([]byte(js), &o); err != nil {
+		glog.Errorf("Error unmarshaling Operation: %s", err)
+		return nil, err
+	}
+	return &o, nil
+}
+
+func ListOperations(s Storage) ([]*Operation, error) {
+	keys, err := s.Keys(operationName("*"))
+	if err != nil {
+		glog.Errorf("Failed to list operations: %s", err)
+		return nil, err
+	}
+	operations := make([]*Operation, 0, len(keys))
+	for _, key := range keys {
+		op, err := LoadOperation(s, strings.TrimPrefix(key, operationName("")))
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+// unindexOperation removes a stored operation from the indexes
+func unindexOperation(s Storage, id string) {
+	if previous, err := s.Get(operationName(id)); err == nil {
+		var op Operation
+		if json.Unmarshal([]byte(previous), &op) == nil {
+			remIndexEntries(s, operationIndexEntries(&op))
+		}
+	}
+}
+
+func SaveOperation(s Storage, id string, operation *Operation) error {
+
+	js, err := json.Marshal(operation)
+	if err != nil {
+		glog.Errorf("Failed to marshal Operation: %s", err)
+		return err
+	}
+	// the operation may have finished
+	unindexOperation(s, id)
+	if err := s.Set(operationName(id), string(js[:]), 0); err != nil {
+		glog.Errorf("Failed to save Operation: %s", err)
+		return err
+	}
+	return addIndexEntries(s, operationIndexEntries(operation))
+}
+
+func DeleteOperation(s Storage, id string) error {
+	unindexOperation(s, id)
+	if err := s.Del(operationName(id)); err != nil {
+		glog.Errorf("Failed to delete Operation: %s", err)
+		return err
+	}
+	return nil
+}
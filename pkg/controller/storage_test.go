@@ -1,10 +1,11 @@
 package controller
 
 import (
-	"error"
 	"time"
 )
 
+var _ Storage = &FakeStorage{}
+
 type FakeStorage struct{}
 
 func NewFakeStorage() *FakeStorage {
@@ -22,3 +23,23 @@ func (f *FakeStorage) Get(key string) (string, error) {
 func (f *FakeStorage) Del(key string) error {
 	return nil
 }
+
+func (f *FakeStorage) Keys(pattern string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (f *FakeStorage) SAdd(key string, member string) error {
+	return nil
+}
+
+func (f *FakeStorage) SRem(key string, member string) error {
+	return nil
+}
+
+func (f *FakeStorage) SCard(key string) (int, error) {
+	return 0, nil
+}
+
+func (f *FakeStorage) SMembers(key string) ([]string, error) {
+	return []string{}, nil
+}
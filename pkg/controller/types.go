@@ -2,6 +2,7 @@ package controller
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/kubernetes-incubator/service-catalog/contrib/pkg/brokerapi"
 )
@@ -14,6 +15,21 @@ type Entry struct {
 	UUID                            string                           `json:"uuid"`
 	Version                         string                           `json:"version"`
 	Whitelist                       []string                         `json:"whitelist"`
+	NamespaceSelector               string                           `json:"namespaceselector,omitempty"`
+	Denylist                        []string                         `json:"denylist,omitempty"`
+	DenyNamespaceSelector           string                           `json:"denynamespaceselector,omitempty"`
+	Policies                        []Policy                         `json:"policies,omitempty"`
+	Quota                           *Quota                           `json:"quota,omitempty"`
+	RequiresApproval                bool                             `json:"requiresapproval,omitempty"`
+	ApprovalTimeout                 string                           `json:"approvaltimeout,omitempty"`
+	Schemas                         *ParameterSchemas                `json:"schemas,omitempty"`
+	Dependencies                    []Dependency                     `json:"dependencies,omitempty"`
+	Connection                      *Connection                      `json:"connection,omitempty"`
+	Drift                           string                           `json:"drift,omitempty"`
+	MaxLifetime                     string                           `json:"maxlifetime,omitempty"`
+	IdleTimeout                     string                           `json:"idletimeout,omitempty"`
+	ExpiryWarning                   string                           `json:"expirywarning,omitempty"`
+	Hooks                           map[string]*Hook                 `json:"hooks,omitempty"`
 	ProvisionExistingClusterService *ProvisionExistingClusterService `json:"ProvisionExistingClusterService"`
 	ProvisionNonClusterURL          *ProvisionNonClusterURL          `json:"ProvisionNonClusterURL"`
 	ProvisionNewClusterObjects      *ProvisionNewClusterObjects      `json:"ProvisionNewClusterObjects"`
@@ -22,11 +38,30 @@ type Entry struct {
 	CredentialFromCatalog           *CredentialFromCatalog           `json:"CredentialFromCatalog"`
 	CredentialFromVault             *CredentialFromVault             `json:"CredentialFromVault"`
 	CredentialNoCredential          *CredentialNoCredential          `json:"CredentialNoCredential"`
+
+	// where the entry was loaded from, ex configmap/catalog-entry-api-service
+	Origin string `json:"origin,omitempty"`
+	// commit the entry was read at, when loaded from git
+	Revision string `json:"revision,omitempty"`
+	// name of the source the entry was loaded from, ex namespace mesitis
+	Source string `json:"source,omitempty"`
+
+	// the source itself, which holds its wrapped resources, found again by
+	// name for entries read from storage
+	source CatalogSource
 }
 
 type Instance struct {
 	Entry
 	InstanceID              string                   `json:"instanceID"`
+	ConsumerNamespace       string                   `json:"consumerNamespace,omitempty"`
+	Parameters              map[string]interface{}   `json:"parameters,omitempty"`
+	Prerequisites           []Prerequisite           `json:"prerequisites,omitempty"`
+	Created                 time.Time                `json:"created,omitempty"`
+	LastUsed                time.Time                `json:"lastused,omitempty"`
+	ExpiryWarned            bool                     `json:"expirywarned,omitempty"`
+	Expired                 *time.Time               `json:"expired,omitempty"`
+	History                 []VersionChange          `json:"history,omitempty"`
 	CoordinatesExternalURL  *CoordinatesExternalURL  `json:"CoordinatesExternalURL"`
 	CoordinatesClusterURL   *CoordinatesClusterURL   `json:"CoordinatesClusterURL"`
 	ResourcesNoResource     *ResourcesNoResource     `json:"ResourcesNoResource"`
@@ -44,10 +79,12 @@ type Binding struct {
 /////////////////////////////////////////////////////////////////
 /////////////////////////////////////////////////////////////////
 
-// An existing service living in the cluster
+// An existing service living in the cluster, shared by its consumers
+// RequireEndpoints: refuse to provision unless the Service has ready endpoints
 type ProvisionExistingClusterService struct {
-	Namespace string `json:"namespace"`
-	Name      string `json:"name"`
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	RequireEndpoints bool   `json:"requireendpoints,omitempty"`
 }
 
 // A URL that exists out of cluster
@@ -59,10 +96,12 @@ type ProvisionNonClusterURL struct {
 // Namespace- into which should the objects be provisioned
 // Namespace and Name: how to compose the URL for the provisioned service
 // LabelSelector: how to pick out the specific ConfigMaps
+// ConsumerNamespace: provision into the requesting namespace instead of Namespace
 type ProvisionNewClusterObjects struct {
-	Namespace     string `json:"namespace"`
-	Name          string `json:"name"`
-	LabelSelector string `json:"labelselector"`
+	Namespace         string `json:"namespace"`
+	Name              string `json:"name"`
+	LabelSelector     string `json:"labelselector"`
+	ConsumerNamespace bool   `json:"consumernamespace,omitempty"`
 }
 
 // Provision the chart specified in the struct below via the registry
@@ -81,9 +120,11 @@ type CredentialFromClusterSecret struct {
 }
 
 // Credential is kept in line in the catalog
+// Template: render the username and password as templates when binding
 type CredentialFromCatalog struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Template bool   `json:"template,omitempty"`
 }
 
 // Vault is the repository for this credential
@@ -101,7 +142,15 @@ type CoordinatesExternalURL struct {
 }
 
 type CoordinatesClusterURL struct {
-	URL string `json:"url"`
+	URL   string            `json:"url"`
+	Ports []CoordinatesPort `json:"ports,omitempty"`
+}
+
+// A port of a Service, as found when the instance was provisioned
+type CoordinatesPort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol,omitempty"`
 }
 
 type ResourcesNoResource struct{}
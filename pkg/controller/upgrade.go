@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// An instance keeps the entry it was provisioned with, so a new version of
+// an entry does not reach existing instances by itself. A rollout, asked
+// for by the provider, upgrades the instances of an offering on any other
+// version, a batch at a time. The wrapped resources are rendered again for
+// each instance and applied: objects are patched in place or created, and
+// those no longer rendered deleted. An instance that fails is rolled back
+// to the objects it had, and the rollout stops after that batch. Every
+// attempt is recorded in the history of the instance.
+
+const defaultRolloutBatchSize = 5
+
+const (
+	UpgradeSucceeded  = "upgraded"
+	UpgradeRolledBack = "rolledback"
+)
+
+// An attempt to change the version of an instance
+type VersionChange struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	At     time.Time `json:"at"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type RolloutRequest struct {
+	// uuid, name or team-offering name of the entry
+	Offering string `json:"offering"`
+	// how many instances are upgraded before checking for failures, 5 if zero
+	BatchSize int `json:"batchSize,omitempty"`
+	// list the instances to upgrade without upgrading them
+	DryRun bool `json:"dryRun,omitempty"`
+	// take over fields of the objects other field managers have changed
+	Force bool `json:"force,omitempty"`
+}
+
+type Rollout struct {
+	Offering string           `json:"offering"`
+	Version  string           `json:"version"`
+	Upgraded []string         `json:"upgraded"`
+	Failed   []RolloutFailure `json:"failed,omitempty"`
+	// instances still on another version when the rollout stopped
+	Pending []string `json:"pending"`
+}
+
+type RolloutFailure struct {
+	InstanceID string `json:"instanceID"`
+	Error      string `json:"error"`
+}
+
+// Upgrades instances to the current version of their entry
+type Upgrader interface {
+	Rollout(req *RolloutRequest) (*Rollout, error)
+}
+
+// outdatedInstances are the live instances of the entry on another version,
+// oldest first
+func outdatedInstances(instances []*Instance, entry *Entry) []*Instance {
+	outdated := make([]*Instance, 0)
+	for _, i := range instances {
+		if i.UUID == entry.UUID && i.Version != entry.Version && i.Expired == nil {
+			outdated = append(outdated, i)
+		}
+	}
+	sort.SliceStable(outdated, func(a, b int) bool {
+		return outdated[a].Created.Before(outdated[b].Created)
+	})
+	return outdated
+}
+
+func (c *ProductionController) Rollout(req *RolloutRequest) (*Rollout, error) {
+	c.rwMutex.RLock()
+	catalog, err := c.loadCatalog()
+	if err != nil {
+		c.rwMutex.RUnlock()
+		glog.Errorf("Failed to load catalog: %s", err)
+		return nil, err
+	}
+	entry := findOffering(catalog, req.Offering)
+	if entry == nil {
+		c.rwMutex.RUnlock()
+		return nil, NewBrokerError(http.StatusNotFound, "", "No offering %s.", req.Offering)
+	}
+	instances, err := ListInstances(c.Storage)
+	c.rwMutex.RUnlock()
+	if err != nil {
+		glog.Errorf("Failed to list instances to upgrade: %s", err)
+		return nil, err
+	}
+	if entry.ProvisionHelmChart != nil {
+		return nil, NewBrokerError(http.StatusUnprocessableEntity, "", "Instances of %s cannot be upgraded, Helm charts are not supported.", entry.serviceName())
+	}
+
+	outdated := outdatedInstances(instances, entry)
+	rollout := &Rollout{Offering: entry.serviceName(), Version: entry.Version, Upgraded: []string{}, Pending: []string{}}
+	for _, i := range outdated {
+		rollout.Pending = append(rollout.Pending, i.InstanceID)
+	}
+	if req.DryRun {
+		return rollout, nil
+	}
+
+	size := req.BatchSize
+	if size <= 0 {
+		size = defaultRolloutBatchSize
+	}
+	glog.Infof("Rolling out %s version %s to <%d> instances, <%d> at a time", rollout.Offering, entry.Version, len(outdated), size)
+	pending := rollout.Pending
+	for len(pending) > 0 {
+		n := size
+		if n > len(pending) {
+			n = len(pending)
+		}
+		for _, id := range pending[:n] {
+			if err := c.upgradeInstance(id, entry, req.Force); err != nil {
+				rollout.Failed = append(rollout.Failed, RolloutFailure{InstanceID: id, Error: err.Error()})
+			} else {
+				rollout.Upgraded = append(rollout.Upgraded, id)
+			}
+		}
+		pending = pending[n:]
+		if len(rollout.Failed) > 0 {
+			glog.Warningf("Stopping the rollout of %s after <%d> failures, <%d> instances not attempted", rollout.Offering, len(rollout.Failed), len(pending))
+			break
+		}
+	}
+	rollout.Pending = append(failedIDs(rollout.Failed), pending...)
+
+	glog.Infof("Rolled out %s version %s: <%d> upgraded, <%d> failed, <%d> pending", rollout.Offering, entry.Version, len(rollout.Upgraded), len(rollout.Failed), len(rollout.Pending))
+	return rollout, nil
+}
+
+func failedIDs(failures []RolloutFailure) []string {
+	ids := make([]string, 0, len(failures))
+	for _, f := range failures {
+		ids = append(ids, f.InstanceID)
+	}
+	return ids
+}
+
+// upgradeInstance brings one instance to the version of the entry, or
+// leaves it as it was
+func (c *ProductionController) upgradeInstance(id string, entry *Entry, force bool) error {
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+
+	if err := c.checkNotBusy(id); err != nil {
+		return err
+	}
+	instance, err := LoadInstance(c.Storage, id)
+	if err != nil {
+		return err
+	}
+	if instance.Expired != nil || instance.Version == entry.Version {
+		// expired or upgraded since listed
+		return nil
+	}
+	change := VersionChange{From: instance.Version, To: entry.Version, At: time.Now(), Result: UpgradeSucceeded}
+
+	upgraded, err := c.upgradeResources(instance, entry, force)
+	if err != nil {
+		glog.Errorf("Failed to upgrade instance %s of %s from %s to %s, rolled back: %s", id, entry.serviceName(), change.From, change.To, err)
+		change.Result = UpgradeRolledBack
+		change.Error = err.Error()
+		instance.History = append(instance.History, change)
+		if err := SaveInstance(c.Storage, id, instance); err != nil {
+			glog.Errorf("Failed to record the failed upgrade of instance %s: %s", id, err)
+		}
+		c.recordInstanceEvent(instance, v1.EventTypeWarning, "UpgradeFailed",
+			fmt.Sprintf("Instance %s of %s could not be upgraded to version %s and was rolled back: %s", id, entry.serviceName(), change.To, err))
+		return err
+	}
+
+	instance.Entry = upgraded.Entry
+	instance.CoordinatesExternalURL = upgraded.CoordinatesExternalURL
+	instance.CoordinatesClusterURL = upgraded.CoordinatesClusterURL
+	instance.ResourcesNoResource = upgraded.ResourcesNoResource
+	instance.ResourcesKubeObjectList = upgraded.ResourcesKubeObjectList
+	instance.History = append(instance.History, change)
+	if err := SaveInstance(c.Storage, id, instance); err != nil {
+		return err
+	}
+	glog.Infof("Upgraded instance %s of %s from %s to %s", id, entry.serviceName(), change.From, change.To)
+	c.recordInstanceEvent(instance, v1.EventTypeNormal, "Upgraded",
+		fmt.Sprintf("Instance %s of %s was upgraded from version %s to %s", id, entry.serviceName(), change.From, change.To))
+	return nil
+}
+
+// upgradeResources renders and applies the resources of the entry for an
+// instance, returning the instance as the entry would provision it
+func (c *ProductionController) upgradeResources(instance *Instance, entry *Entry, force bool) (*Instance, error) {
+	values, err := c.instanceValues(instance)
+	if err != nil {
+		return nil, err
+	}
+	// objects are only managed by ProvisionNewClusterObjects
+	if (entry.ProvisionNewClusterObjects != nil) != (instance.ResourcesKubeObjectList != nil) {
+		return nil, fmt.Errorf("version %s of %s provisions in another way than version %s", entry.Version, entry.serviceName(), instance.Version)
+	}
+	if entry.ProvisionNewClusterObjects == nil {
+		return entry.Provision(c.Kube, instance.InstanceID, values)
+	}
+	return entry.ProvisionNewClusterObjects.Apply(c.Kube, instance, entry, values, force)
+}
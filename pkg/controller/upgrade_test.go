@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutdatedInstances(t *testing.T) {
+	now := time.Now()
+	instance := func(id, uuid, version string, created time.Time) *Instance {
+		return &Instance{Entry: Entry{UUID: uuid, Version: version}, InstanceID: id, Created: created}
+	}
+	expired := instance("e", "1", "1.0", now)
+	expired.Expired = &now
+	instances := []*Instance{
+		instance("b", "1", "1.0", now),
+		instance("a", "1", "0.9", now.Add(-time.Hour)),
+		instance("current", "1", "2.0", now),
+		instance("other", "2", "1.0", now),
+		expired,
+	}
+
+	ids := []string{}
+	for _, i := range outdatedInstances(instances, &Entry{UUID: "1", Version: "2.0"}) {
+		ids = append(ids, i.InstanceID)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+}
@@ -0,0 +1,469 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// A problem found in a catalog entry. Source names where the entry came
+// from, ex configmap/catalog-entry-api-service, and Field is the path of
+// the offending field within the entry.
+type ValidationError struct {
+	Source   string `json:"source"`
+	Field    string `json:"field"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+const (
+	// entries with errors are left out of the catalog
+	SeverityError = "Error"
+	// warnings are reported, the entry is still offered
+	SeverityWarning = "Warning"
+)
+
+type ValidationErrors []ValidationError
+
+// the data key in catalog entry ConfigMaps
+const catalogDataKey = "wrapped-resource"
+
+// the data key in ConfigMaps wrapping provisionable resources
+const wrappedDataKey = "embedded-resource"
+
+// selects the ConfigMaps that wrap provisionable resources
+const wrappedResourceSelector = "mesitis/kind,mesitis/kind notin (" + catalogEntryKind + "," + approvalRequestKind + ")"
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", e.Source, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Source, e.Field, e.Message)
+}
+
+func (errs ValidationErrors) HasErrors() bool {
+	for _, e := range errs {
+		if e.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// bySource returns the problems reported against one source
+func (errs ValidationErrors) bySource(source string) ValidationErrors {
+	found := ValidationErrors{}
+	for _, e := range errs {
+		if e.Source == source {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// fromConfigMap returns the problems found anywhere in a ConfigMap,
+// including each of the documents it holds
+func (errs ValidationErrors) fromConfigMap(cm *v1.ConfigMap) ValidationErrors {
+	origin := configMapOrigin(cm)
+	found := ValidationErrors{}
+	for _, e := range errs {
+		if e.Source == origin || strings.HasPrefix(e.Source, origin+"#") {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func configMapOrigin(cm *v1.ConfigMap) string {
+	if origin, ok := cm.Annotations[originAnnotation]; ok {
+		return origin
+	}
+	return fmt.Sprintf("configmap/%s", cm.Name)
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// ParseCatalogConfigMaps unmarshals the entry held in each ConfigMap,
+// ordered by source so duplicates resolve the same way every time.
+func ParseCatalogConfigMaps(items []v1.ConfigMap) ([]Entry, ValidationErrors) {
+	entries := make([]Entry, 0)
+	errs := ValidationErrors{}
+
+	for i := range items {
+		cm := &items[i]
+		origin := configMapOrigin(cm)
+
+		js, ok := cm.Data[catalogDataKey]
+		if !ok {
+			errs = append(errs, ValidationError{origin, "data." + catalogDataKey, "missing", SeverityError})
+			continue
+		}
+
+		// several entries may share a ConfigMap as YAML documents
+		docs, err := splitManifests(js)
+		if err != nil {
+			errs = append(errs, ValidationError{origin, "data." + catalogDataKey, fmt.Sprintf("invalid entry: %s", err), SeverityError})
+			continue
+		}
+		if len(docs) == 0 {
+			errs = append(errs, ValidationError{origin, "data." + catalogDataKey, "empty", SeverityError})
+			continue
+		}
+
+		for n, doc := range docs {
+			docOrigin := origin
+			if len(docs) > 1 {
+				docOrigin = fmt.Sprintf("%s#%d", origin, n+1)
+			}
+			entry, problems := parseEntry(docOrigin, []byte(doc))
+			errs = append(errs, problems...)
+			if entry != nil {
+				entries = append(entries, *entry)
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Origin < entries[j].Origin })
+	return entries, errs
+}
+
+func parseEntry(origin string, data []byte) (*Entry, ValidationErrors) {
+	errs := ValidationErrors{}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		errs = append(errs, ValidationError{origin, "data." + catalogDataKey, fmt.Sprintf("invalid entry: %s", err), SeverityError})
+		return nil, errs
+	}
+	entry.Origin = origin
+
+	// a second, strict pass catches misspelled fields that are otherwise silently dropped
+	strict := json.NewDecoder(bytes.NewReader(data))
+	strict.DisallowUnknownFields()
+	var ignored Entry
+	if err := strict.Decode(&ignored); err != nil {
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		errs = append(errs, ValidationError{origin, field, "unknown field", SeverityWarning})
+	}
+
+	return &entry, errs
+}
+
+// ValidateCatalog checks entries individually and against each other.
+// wrapped are the ConfigMaps that label selectors are expected to match.
+func ValidateCatalog(entries []Entry, wrapped []v1.ConfigMap) ValidationErrors {
+	errs := ValidationErrors{}
+	for i := range entries {
+		errs = append(errs, entries[i].Validate(wrapped)...)
+	}
+	errs = append(errs, validateDuplicates(entries)...)
+	return append(errs, validateDependencies(entries, errs)...)
+}
+
+// validateDuplicates reports entries reusing the uuid or service name of
+// an earlier entry
+func validateDuplicates(entries []Entry) ValidationErrors {
+	errs := ValidationErrors{}
+
+	uuids := make(map[string]string, 0)
+	names := make(map[string]string, 0)
+	for i := range entries {
+		e := &entries[i]
+		if first, ok := uuids[e.UUID]; ok && e.UUID != "" {
+			errs = append(errs, ValidationError{e.Origin, "uuid", fmt.Sprintf("duplicate uuid %s, already used by %s", e.UUID, first), SeverityError})
+		} else {
+			uuids[e.UUID] = e.Origin
+		}
+		if first, ok := names[e.serviceName()]; ok {
+			errs = append(errs, ValidationError{e.Origin, "offering", fmt.Sprintf("duplicate service %s, already offered by %s", e.serviceName(), first), SeverityError})
+		} else {
+			names[e.serviceName()] = e.Origin
+		}
+	}
+	return errs
+}
+
+// Validate checks a single entry
+func (e *Entry) Validate(wrapped []v1.ConfigMap) ValidationErrors {
+	errs := ValidationErrors{}
+	problem := func(field, severity, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{e.Origin, field, fmt.Sprintf(format, args...), severity})
+	}
+
+	required := []struct{ field, value string }{
+		{"team", e.Team}, {"offering", e.Offering}, {"uuid", e.UUID}, {"version", e.Version},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			problem(r.field, SeverityError, "required")
+		}
+	}
+
+	provisioners := make([]string, 0)
+	if e.ProvisionExistingClusterService != nil {
+		provisioners = append(provisioners, "ProvisionExistingClusterService")
+		if e.ProvisionExistingClusterService.Name == "" || e.ProvisionExistingClusterService.Namespace == "" {
+			problem("ProvisionExistingClusterService", SeverityError, "name and namespace are required")
+		}
+	}
+	if e.ProvisionNonClusterURL != nil {
+		provisioners = append(provisioners, "ProvisionNonClusterURL")
+		if e.ProvisionNonClusterURL.URL == "" {
+			problem("ProvisionNonClusterURL.url", SeverityError, "required")
+		}
+	}
+	if e.ProvisionNewClusterObjects != nil {
+		provisioners = append(provisioners, "ProvisionNewClusterObjects")
+		errs = append(errs, e.validateLabelSelector("ProvisionNewClusterObjects.labelselector", e.ProvisionNewClusterObjects.LabelSelector, wrapped)...)
+		if selector, err := labels.Parse(e.ProvisionNewClusterObjects.LabelSelector); err == nil && e.ProvisionNewClusterObjects.LabelSelector != "" && selectsJob(selector, wrapped) {
+			problem("ProvisionNewClusterObjects.labelselector", SeverityError, "selects Jobs, which only run as hooks")
+		}
+		if e.ProvisionNewClusterObjects.ConsumerNamespace && e.ProvisionNewClusterObjects.Namespace != "" {
+			problem("ProvisionNewClusterObjects.namespace", SeverityWarning, "ignored, objects are provisioned into the consumer namespace")
+		}
+	}
+	if e.ProvisionHelmChart != nil {
+		provisioners = append(provisioners, "ProvisionHelmChart")
+		if e.ProvisionHelmChart.ChartURL == "" {
+			problem("ProvisionHelmChart.charturl", SeverityError, "required")
+		}
+	}
+	switch len(provisioners) {
+	case 0:
+		problem("", SeverityError, "no provisioner, expected one of ProvisionExistingClusterService, ProvisionNonClusterURL, ProvisionNewClusterObjects, ProvisionHelmChart")
+	case 1:
+	default:
+		problem("", SeverityError, "several provisioners, expected one of %s", strings.Join(provisioners, ", "))
+	}
+
+	credentials := make([]string, 0)
+	if e.CredentialFromClusterSecret != nil {
+		credentials = append(credentials, "CredentialFromClusterSecret")
+		if e.CredentialFromClusterSecret.SecretName == "" {
+			problem("CredentialFromClusterSecret.secretname", SeverityError, "required")
+		}
+	}
+	if e.CredentialFromCatalog != nil {
+		credentials = append(credentials, "CredentialFromCatalog")
+	}
+	if e.CredentialFromVault != nil {
+		credentials = append(credentials, "CredentialFromVault")
+	}
+	if e.CredentialNoCredential != nil {
+		credentials = append(credentials, "CredentialNoCredential")
+	}
+	switch len(credentials) {
+	case 0:
+		problem("", SeverityError, "no credential kind, expected one of CredentialFromClusterSecret, CredentialFromCatalog, CredentialFromVault, CredentialNoCredential")
+	case 1:
+	default:
+		problem("", SeverityError, "several credential kinds, expected one of %s", strings.Join(credentials, ", "))
+	}
+
+	errs = append(errs, e.validateAccess()...)
+	errs = append(errs, e.validatePolicies()...)
+	errs = append(errs, e.validateQuota()...)
+	errs = append(errs, e.validateApproval()...)
+	errs = append(errs, e.validateSchemas()...)
+	errs = append(errs, e.validateConnection()...)
+	errs = append(errs, e.validateDrift()...)
+	errs = append(errs, e.validateExpiry()...)
+	return append(errs, e.validateHooks(wrapped)...)
+}
+
+// a selector must parse, and should match at least one enabled wrapped resource
+func (e *Entry) validateLabelSelector(field, selector string, wrapped []v1.ConfigMap) ValidationErrors {
+	errs := ValidationErrors{}
+
+	if selector == "" {
+		return append(errs, ValidationError{e.Origin, field, "required", SeverityError})
+	}
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return append(errs, ValidationError{e.Origin, field, fmt.Sprintf("invalid selector: %s", err), SeverityError})
+	}
+	for _, cm := range wrapped {
+		if parsed.Matches(labels.Set(cm.Labels)) && cm.Labels["mesitis/enabled"] == "true" {
+			return errs
+		}
+	}
+	return append(errs, ValidationError{e.Origin, field, fmt.Sprintf("selector %s matches no enabled wrapped resources", selector), SeverityWarning})
+}
+
+// ValidateWrappedResources checks that every document in the wrapped
+// resources can be read and is of a kind that can be provisioned. Jobs are
+// only run as hooks, so must be selected by a hook of one of the entries.
+// Templates can only be read once rendered, when an instance is provisioned.
+func ValidateWrappedResources(wrapped []v1.ConfigMap, entries []Entry) ValidationErrors {
+	errs := ValidationErrors{}
+	for i := range wrapped {
+		cm := &wrapped[i]
+		origin := configMapOrigin(cm)
+		hooked := hookSelected(cm, entries)
+		if cm.Labels["mesitis/template"] == "true" {
+			if templateMayHoldJob(cm) && !hooked {
+				errs = append(errs, ValidationError{origin, "data." + wrappedDataKey, "Jobs only run as hooks, and no hook selects this resource", SeverityError})
+			}
+			continue
+		}
+
+		docs, err := splitManifests(cm.Data[wrappedDataKey])
+		if err != nil {
+			errs = append(errs, ValidationError{origin, "data." + wrappedDataKey, fmt.Sprintf("invalid resource: %s", err), SeverityError})
+			continue
+		}
+		for n, doc := range docs {
+			kind := manifestKind(doc, cm.Labels["mesitis/kind"])
+			field := fmt.Sprintf("data.%s[%d].kind", wrappedDataKey, n)
+			if kind == hookJobKind && !hooked {
+				errs = append(errs, ValidationError{origin, field, "Jobs only run as hooks, and no hook selects this resource", SeverityError})
+			} else if _, ok := objectCreators[kind]; !ok && kind != hookJobKind {
+				errs = append(errs, ValidationError{origin, field, fmt.Sprintf("cannot provision kind %s", kind), SeverityError})
+			}
+		}
+	}
+	return errs
+}
+
+// validEntries drops entries with errors
+func validEntries(entries []Entry, errs ValidationErrors) []Entry {
+	valid := make([]Entry, 0)
+	for _, e := range entries {
+		if !errs.bySource(e.Origin).HasErrors() {
+			valid = append(valid, e)
+		}
+	}
+	return valid
+}
+
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////
+
+// ReadConfigMapManifests decodes the ConfigMaps in a stream of YAML or JSON
+// manifests, such as those applied with kubectl. Other kinds are skipped.
+func ReadConfigMapManifests(r io.Reader) ([]v1.ConfigMap, error) {
+	items := make([]v1.ConfigMap, 0)
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var cm v1.ConfigMap
+		if err := decoder.Decode(&cm); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if cm.Kind == "ConfigMap" {
+			items = append(items, cm)
+		}
+	}
+	return items, nil
+}
+
+// LintConfigMaps validates catalog entries against wrapped resources, both
+// drawn from the given ConfigMaps
+func LintConfigMaps(items []v1.ConfigMap) ValidationErrors {
+	catalog := make([]v1.ConfigMap, 0)
+	wrapped := make([]v1.ConfigMap, 0)
+	for _, cm := range items {
+		switch kind, ok := cm.Labels["mesitis/kind"]; {
+		case kind == catalogEntryKind:
+			catalog = append(catalog, cm)
+		case ok:
+			wrapped = append(wrapped, cm)
+		}
+	}
+
+	entries, errs := ParseCatalogConfigMaps(catalog)
+	errs = append(errs, ValidateCatalog(entries, wrapped)...)
+	return append(errs, ValidateWrappedResources(wrapped, entries)...)
+}
+
+// validationReports remembers the problems last reported on each object,
+// so the catalog loading again records no events unless they change
+type validationReports struct {
+	sync.Mutex
+	reported map[string]string
+}
+
+// changed records the problems of an object, returning whether they
+// differ from those last recorded. An object never reported had none.
+func (r *validationReports) changed(ref *v1.ObjectReference, errs ValidationErrors) bool {
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Error())
+	}
+	sort.Strings(messages)
+	problems := strings.Join(messages, "\n")
+
+	r.Lock()
+	defer r.Unlock()
+	if r.reported == nil {
+		r.reported = make(map[string]string)
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s", ref.Kind, ref.Namespace, ref.Name, ref.UID)
+	if r.reported[key] == problems {
+		return false
+	}
+	if problems == "" {
+		delete(r.reported, key)
+	} else {
+		r.reported[key] = problems
+	}
+	return true
+}
+
+// recordValidation records the problems of an object as Events, or that
+// it is valid again
+func recordValidation(k Kube, ref *v1.ObjectReference, errs ValidationErrors, reports *validationReports) {
+	if !reports.changed(ref, errs) {
+		return
+	}
+	if len(errs) == 0 {
+		k.RecordEvent(ref, v1.EventTypeNormal, "Valid", "No problems found")
+		return
+	}
+	for _, e := range errs {
+		eventType := v1.EventTypeWarning
+		if e.Severity == SeverityWarning {
+			eventType = v1.EventTypeNormal
+		}
+		k.RecordEvent(ref, eventType, "Invalid"+e.Severity, e.Error())
+	}
+}
+
+// recordValidationEvents records problems as Events on the ConfigMaps
+// they were found in
+func recordValidationEvents(k Kube, items []v1.ConfigMap, errs ValidationErrors, reports *validationReports) {
+	for i := range items {
+		cm := &items[i]
+		if _, converted := cm.Annotations[originAnnotation]; converted {
+			continue
+		}
+		recordValidation(k, configMapReference(cm), errs.fromConfigMap(cm), reports)
+	}
+}
+
+func configMapReference(cm *v1.ConfigMap) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:            "ConfigMap",
+		APIVersion:      "v1",
+		Namespace:       cm.Namespace,
+		Name:            cm.Name,
+		UID:             cm.UID,
+		ResourceVersion: cm.ResourceVersion,
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func catalogConfigMap(name, js string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"mesitis/kind": catalogEntryKind},
+		},
+		Data: map[string]string{catalogDataKey: js},
+	}
+}
+
+func jobConfigMap(name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"mesitis/kind": hookJobKind, "mesitis/enabled": "true", "app": "db"},
+		},
+		Data: map[string]string{wrappedDataKey: `{"kind":"Job","metadata":{"name":"migrate"}}`},
+	}
+}
+
+func templatedJob(name string) v1.ConfigMap {
+	cm := jobConfigMap(name)
+	cm.Labels["mesitis/kind"] = "manifests"
+	cm.Labels["mesitis/template"] = "true"
+	cm.Data[wrappedDataKey] = `{"kind": "Job", "spec": {"parallelism": {{ .Parameters.workers }}}}`
+	return cm
+}
+
+// the templated Deployment of the README, which reads only once rendered
+func templateConfigMap(name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"mesitis/kind": "manifests", "mesitis/enabled": "true", "mesitis/template": "true", "app": "web"},
+		},
+		Data: map[string]string{wrappedDataKey: `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "web"},
+	"spec": {"replicas": {{ default 1 (index .Parameters "replicas") | json }},
+	         "template": {"metadata": {"labels": {"size": {{ .Parameters.size | json }}}}}}}`},
+	}
+}
+
+func TestLintConfigMaps(t *testing.T) {
+	valid := `{"team":"api","offering":"api-service","uuid":"3","version":"1","whitelist":["client-ns"],
+		"ProvisionNonClusterURL":{"url":"https://example.com"},"CredentialNoCredential":{}}`
+
+	cases := []struct {
+		name   string
+		items  []v1.ConfigMap
+		errors bool
+		fields []string
+	}{
+		{"valid", []v1.ConfigMap{catalogConfigMap("a", valid)}, false, nil},
+		{"bad json", []v1.ConfigMap{catalogConfigMap("a", `{`)}, true, []string{"data.wrapped-resource"}},
+		{"duplicate uuid", []v1.ConfigMap{catalogConfigMap("a", valid), catalogConfigMap("b", valid)}, true, []string{"uuid", "offering"}},
+		{"no provisioner", []v1.ConfigMap{catalogConfigMap("a", `{"team":"t","offering":"o","uuid":"1","version":"1","whitelist":["n"],"CredentialNoCredential":{}}`)}, true, []string{""}},
+		{"unknown field", []v1.ConfigMap{catalogConfigMap("a", `{"team":"api","offering":"api-service","uuid":"3","version":"1","whitelist":["client-ns"],
+			"ProvisionNonClusterURL":{"url":"u"},"CredentialNoCredential":{},"provisionkind":"x"}`)}, false, []string{"provisionkind"}},
+		{"dangling selector", []v1.ConfigMap{catalogConfigMap("a", `{"team":"t","offering":"o","uuid":"1","version":"1","whitelist":["n"],
+			"ProvisionNewClusterObjects":{"namespace":"ns","name":"svc","labelselector":"mesitis/offering=o"},"CredentialNoCredential":{}}`)}, false, []string{"ProvisionNewClusterObjects.labelselector"}},
+		{"job without hook", []v1.ConfigMap{catalogConfigMap("a", valid), jobConfigMap("j")}, true, []string{"data." + wrappedDataKey + "[0].kind"}},
+		{"job of a hook", []v1.ConfigMap{catalogConfigMap("a", `{"team":"api","offering":"api-service","uuid":"3","version":"1","whitelist":["client-ns"],
+			"ProvisionNonClusterURL":{"url":"https://example.com"},"CredentialNoCredential":{},"hooks":{"postprovision":{"labelselector":"app=db"}}}`), jobConfigMap("j")}, false, nil},
+		{"job provisioned", []v1.ConfigMap{catalogConfigMap("a", `{"team":"t","offering":"o","uuid":"1","version":"1","whitelist":["n"],
+			"ProvisionNewClusterObjects":{"namespace":"ns","name":"svc","labelselector":"app=db"},"CredentialNoCredential":{},"hooks":{"postprovision":{"labelselector":"app=db"}}}`), jobConfigMap("j")}, true, []string{"ProvisionNewClusterObjects.labelselector"}},
+		{"templated job", []v1.ConfigMap{catalogConfigMap("a", `{"team":"t","offering":"o","uuid":"1","version":"1","whitelist":["n"],
+			"ProvisionNewClusterObjects":{"namespace":"ns","name":"svc","labelselector":"app=db"},"CredentialNoCredential":{}}`), templatedJob("j")}, true,
+			[]string{"data." + wrappedDataKey, "ProvisionNewClusterObjects.labelselector"}},
+		{"template", []v1.ConfigMap{catalogConfigMap("a", `{"team":"t","offering":"o","uuid":"1","version":"1","whitelist":["n"],
+			"ProvisionNewClusterObjects":{"namespace":"ns","name":"svc","labelselector":"app=web"},"CredentialNoCredential":{}}`), templateConfigMap("t")}, false, nil},
+	}
+
+	for _, c := range cases {
+		errs := LintConfigMaps(c.items)
+		if errs.HasErrors() != c.errors {
+			t.Errorf("%s: expected errors %t, got %v", c.name, c.errors, errs)
+		}
+		for _, field := range c.fields {
+			found := false
+			for _, e := range errs {
+				found = found || e.Field == field
+			}
+			if !found {
+				t.Errorf("%s: expected a problem with field %q, got %v", c.name, field, errs)
+			}
+		}
+	}
+}
+
+func TestValidationReportsChanged(t *testing.T) {
+	reports := &validationReports{}
+	ref := &v1.ObjectReference{Kind: "ConfigMap", Namespace: "mesitis", Name: "a"}
+	problem := ValidationErrors{{"configmap/a", "uuid", "required", SeverityError}}
+
+	steps := []struct {
+		errs    ValidationErrors
+		changed bool
+	}{
+		{ValidationErrors{}, false},
+		{problem, true},
+		{problem, false},
+		{ValidationErrors{}, true},
+		{ValidationErrors{}, false},
+	}
+	for i, step := range steps {
+		if changed := reports.changed(ref, step.errs); changed != step.changed {
+			t.Errorf("step %d: expected changed %t, got %t", i, step.changed, changed)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package controller
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
+	"expvar"
 	"io/ioutil"
 	"net/http"
 
@@ -15,6 +16,12 @@ type emptyJSON struct{}
 
 type ControllerHTTPWrapper struct {
 	controller Controller
+	updater    InstanceUpdater
+	admin      Admin
+	registry   ConsumerRegistry
+	ready      ReadinessChecker
+	planner    Planner
+	upgrader   Upgrader
 }
 
 // TODO this logging needs to be V level trace
@@ -24,6 +31,9 @@ func headerMiddleware(next http.Handler) http.Handler {
 		glog.Infof("M: %q\n", r.Method)
 		glog.Infof("U: %q\n", r.RequestURI)
 		for k, v := range r.Header {
+			if k == "Authorization" {
+				v = []string{"<redacted>"}
+			}
 			glog.Infof("H: %q: %q\n", k, v)
 		}
 		next.ServeHTTP(w, r)
@@ -45,18 +55,84 @@ func CreateHTTPWrapper(c Controller) http.Handler {
 	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", cw.bind).Methods("PUT")
 	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", cw.unBind).Methods("DELETE")
 
+	if updater, ok := c.(InstanceUpdater); ok {
+		cw.updater = updater
+		router.HandleFunc("/v2/service_instances/{instance_id}", cw.updateServiceInstance).Methods("PATCH")
+	}
+
+	router.HandleFunc("/healthz", cw.healthz).Methods("GET")
+	if ready, ok := c.(ReadinessChecker); ok {
+		cw.ready = ready
+		router.HandleFunc("/readyz", cw.readyz).Methods("GET")
+	}
+
 	// TODO why is this a func reference, not a function call?
 	router.Use(headerMiddleware)
 
 	return router
 }
 
+// CreateAdminHTTPWrapper serves the admin endpoints and /debug/vars, meant
+// for a listener of their own that platforms do not reach. Every request
+// must carry the token as a bearer token.
+func CreateAdminHTTPWrapper(c Controller, token string) http.Handler {
+
+	var router = mux.NewRouter()
+
+	cw := ControllerHTTPWrapper{
+		controller: c,
+	}
+
+	if admin, ok := c.(Admin); ok {
+		cw.admin = admin
+		router.HandleFunc("/admin/export", cw.export).Methods("GET")
+		router.HandleFunc("/admin/import", cw.importArchive).Methods("POST")
+	}
+
+	if registry, ok := c.(ConsumerRegistry); ok {
+		cw.registry = registry
+		router.HandleFunc("/admin/shared-services", cw.sharedServices).Methods("GET")
+		router.HandleFunc("/admin/shared-services/{namespace}/{name}", cw.sharedService).Methods("GET")
+	}
+
+	if planner, ok := c.(Planner); ok {
+		cw.planner = planner
+		router.HandleFunc("/admin/plan", cw.plan).Methods("POST")
+	}
+
+	if upgrader, ok := c.(Upgrader); ok {
+		cw.upgrader = upgrader
+		router.HandleFunc("/admin/rollout", cw.rollout).Methods("POST")
+	}
+
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+
+	router.Use(headerMiddleware)
+	router.Use(tokenMiddleware(token))
+
+	return router
+}
+
+// tokenMiddleware refuses requests without the bearer token
+func tokenMiddleware(token string) mux.MiddlewareFunc {
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				sendError(w, http.StatusUnauthorized, NewBrokerError(http.StatusUnauthorized, "", "A valid admin token is required."))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (cw *ControllerHTTPWrapper) catalog(w http.ResponseWriter, r *http.Request) {
 
 	if result, err := cw.controller.Catalog(); err == nil {
 		sendJSONObject(w, http.StatusOK, result)
 	} else {
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
 	}
 }
 
@@ -71,7 +147,7 @@ func (cw *ControllerHTTPWrapper) getServiceInstanceLastOperation(w http.Response
 	if result, err := cw.controller.GetServiceInstanceLastOperation(instanceID, serviceID, planID, operation); err == nil {
 		sendJSONObject(w, http.StatusOK, result)
 	} else {
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
 	}
 }
 
@@ -81,14 +157,39 @@ func (cw *ControllerHTTPWrapper) createServiceInstance(w http.ResponseWriter, r
 	var req brokerapi.CreateServiceInstanceRequest
 	if err := getJSONObject(r, &req); err != nil {
 		glog.Errorf("error unmarshalling: %v", err)
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	req.AcceptsIncomplete = req.AcceptsIncomplete || r.URL.Query().Get("accepts_incomplete") == "true"
+
 	if result, err := cw.controller.CreateServiceInstance(id, &req); err == nil {
-		sendJSONObject(w, http.StatusCreated, result)
+		status := http.StatusCreated
+		if result.Operation != "" {
+			// awaiting approval, the platform polls last_operation
+			status = http.StatusAccepted
+		}
+		sendJSONObject(w, status, result)
 	} else {
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) updateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["instance_id"]
+
+	var req UpdateServiceInstanceRequest
+	if err := getJSONObject(r, &req); err != nil {
+		glog.Errorf("error unmarshalling: %v", err)
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	req.AcceptsIncomplete = req.AcceptsIncomplete || r.URL.Query().Get("accepts_incomplete") == "true"
+
+	if result, err := cw.updater.UpdateServiceInstance(id, &req); err == nil {
+		sendJSONObject(w, http.StatusOK, result)
+	} else {
+		sendError(w, http.StatusBadRequest, err)
 	}
 }
 
@@ -102,7 +203,7 @@ func (cw *ControllerHTTPWrapper) removeServiceInstance(w http.ResponseWriter, r
 	if result, err := cw.controller.RemoveServiceInstance(instanceID, serviceID, planID, acceptsIncomplete); err == nil {
 		sendJSONObject(w, http.StatusOK, result)
 	} else {
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
 	}
 }
 
@@ -114,14 +215,14 @@ func (cw *ControllerHTTPWrapper) bind(w http.ResponseWriter, r *http.Request) {
 
 	if err := getJSONObject(r, &req); err != nil {
 		glog.Errorf("Failed to unmarshall request: %v", err)
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	if result, err := cw.controller.Bind(instanceID, bindingID, &req); err == nil {
 		sendJSONObject(w, http.StatusOK, result)
 	} else {
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
 	}
 }
 
@@ -135,10 +236,110 @@ func (cw *ControllerHTTPWrapper) unBind(w http.ResponseWriter, r *http.Request)
 	if err := cw.controller.UnBind(instanceID, bindingID, serviceID, planID); err == nil {
 		sendJSONObject(w, http.StatusOK, &emptyJSON{})
 	} else {
-		sendJSONObject(w, http.StatusBadRequest, err)
+		sendError(w, http.StatusBadRequest, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) healthz(w http.ResponseWriter, r *http.Request) {
+	sendJSONObject(w, http.StatusOK, &emptyJSON{})
+}
+
+func (cw *ControllerHTTPWrapper) readyz(w http.ResponseWriter, r *http.Request) {
+
+	if err := cw.ready.Ready(); err == nil {
+		sendJSONObject(w, http.StatusOK, &emptyJSON{})
+	} else {
+		sendError(w, http.StatusServiceUnavailable, err)
 	}
 }
 
+// the archive travels unencrypted, callers seal it at rest
+func (cw *ControllerHTTPWrapper) export(w http.ResponseWriter, r *http.Request) {
+
+	if result, err := cw.admin.Export(); err == nil {
+		sendJSONObject(w, http.StatusOK, result)
+	} else {
+		sendError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) importArchive(w http.ResponseWriter, r *http.Request) {
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+
+	var archive Archive
+	if err := getJSONObject(r, &archive); err != nil {
+		glog.Errorf("Failed to unmarshall archive: %v", err)
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if written, err := cw.admin.Import(&archive, overwrite); err == nil {
+		sendJSONObject(w, http.StatusOK, map[string]int{"imported": written})
+	} else {
+		sendError(w, http.StatusBadRequest, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) sharedServices(w http.ResponseWriter, r *http.Request) {
+
+	if result, err := cw.registry.SharedServices(); err == nil {
+		sendJSONObject(w, http.StatusOK, result)
+	} else {
+		sendError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) sharedService(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	name := mux.Vars(r)["name"]
+
+	if result, err := cw.registry.SharedService(namespace, name); err == nil {
+		sendJSONObject(w, http.StatusOK, result)
+	} else {
+		sendError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) plan(w http.ResponseWriter, r *http.Request) {
+	var req PlanRequest
+	if err := getJSONObject(r, &req); err != nil {
+		glog.Errorf("Failed to unmarshall plan request: %v", err)
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if result, err := cw.planner.Plan(&req); err == nil {
+		sendJSONObject(w, http.StatusOK, result)
+	} else {
+		sendError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (cw *ControllerHTTPWrapper) rollout(w http.ResponseWriter, r *http.Request) {
+	var req RolloutRequest
+	if err := getJSONObject(r, &req); err != nil {
+		glog.Errorf("Failed to unmarshall rollout request: %v", err)
+		sendError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if result, err := cw.upgrader.Rollout(&req); err == nil {
+		sendJSONObject(w, http.StatusOK, result)
+	} else {
+		sendError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// sendError sends a BrokerError with its own status, any other error with
+// the given status
+func sendError(w http.ResponseWriter, code int, err error) {
+	if brokerErr, ok := err.(*BrokerError); ok {
+		sendJSONObject(w, brokerErr.Status, brokerErr)
+		return
+	}
+	sendJSONObject(w, code, &BrokerError{Description: err.Error()})
+}
+
 func sendJSONObject(w http.ResponseWriter, code int, object interface{}) {
 	data, err := json.Marshal(object)
 	if err != nil {
@@ -146,9 +347,9 @@ func sendJSONObject(w http.ResponseWriter, code int, object interface{}) {
 		return
 	}
 
-	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(data))
+	w.WriteHeader(code)
+	w.Write(data)
 }
 
 func getJSONObject(r *http.Request, object interface{}) error {
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendJSONObject(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendJSONObject(w, 201, map[string]string{"password": "100%s"})
+
+	if w.Code != 201 {
+		t.Errorf("expected status 201, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+	if body := w.Body.String(); body != `{"password":"100%s"}` {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestTokenMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		token         string
+		authorization string
+		expected      int
+	}{
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/admin/export", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		tokenMiddleware(c.token)(ok).ServeHTTP(w, r)
+		if w.Code != c.expected {
+			t.Errorf("token %q with %q: expected %d, got %d", c.token, c.authorization, c.expected, w.Code)
+		}
+	}
+}